@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// ABTest splits the clients of a host between destination servers. Each
+// new client is assigned a bucket at random, in proportion to the buckets'
+// percentages, and the bucket is remembered in a cookie so that returning
+// clients stay in it.
+type ABTest struct {
+	// Cookie is the name of the cookie that holds the bucket name.
+	Cookie  string     `json:"cookie"`
+	Buckets []ABBucket `json:"buckets"`
+}
+
+type ABBucket struct {
+	Name string `json:"name"`
+	// URL is the destination server base URL for the bucket.
+	URL string `json:"url"`
+	// Percent is the percentage of new clients assigned to the bucket.
+	// The percentages of the buckets must add up to 100.
+	Percent int `json:"percent"`
+}
+
+// abCookieMaxAge is how long a client stays in its bucket.
+const abCookieMaxAge = 30 * 24 * time.Hour
+
+// abTest is the ready-to-use form of an ABTest.
+type abTest struct {
+	cookie  string
+	buckets []abBucket
+}
+
+type abBucket struct {
+	name    string
+	target  url.URL
+	percent int
+}
+
+func newABTest(c *ABTest) (*abTest, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if !httpguts.ValidHeaderFieldName(c.Cookie) {
+		return nil, fmt.Errorf("bad abTest.cookie %q", c.Cookie)
+	}
+	t := &abTest{cookie: c.Cookie}
+	total := 0
+	seen := make(map[string]bool)
+	for _, b := range c.Buckets {
+		if b.Name == "" || !httpguts.ValidHeaderFieldName(b.Name) || seen[b.Name] {
+			return nil, fmt.Errorf("bad or duplicate abTest bucket name %q", b.Name)
+		}
+		seen[b.Name] = true
+		if b.Percent < 0 {
+			return nil, fmt.Errorf("negative percent for abTest bucket %s", b.Name)
+		}
+		u, err := url.Parse(b.URL)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %s", b.URL, err)
+		}
+		total += b.Percent
+		t.buckets = append(t.buckets, abBucket{name: b.Name, target: *u, percent: b.Percent})
+	}
+	if total != 100 {
+		return nil, errors.New("abTest bucket percentages must add up to 100")
+	}
+	return t, nil
+}
+
+// pick returns the bucket for n, which is in [0, 100).
+func (t *abTest) pick(n int) *abBucket {
+	for i := range t.buckets {
+		if n < t.buckets[i].percent {
+			return &t.buckets[i]
+		}
+		n -= t.buckets[i].percent
+	}
+	return &t.buckets[len(t.buckets)-1] // unreachable; percentages add up to 100
+}
+
+// bucket returns the bucket of the client that sent r. A client without a
+// valid bucket cookie is assigned a bucket, and the cookie is set on w.
+func (t *abTest) bucket(w http.ResponseWriter, r *http.Request) *abBucket {
+	if c, err := r.Cookie(t.cookie); err == nil {
+		for i := range t.buckets {
+			if t.buckets[i].name == c.Value {
+				return &t.buckets[i]
+			}
+		}
+	}
+	b := t.pick(rand.Intn(100))
+	http.SetCookie(w, &http.Cookie{
+		Name:     t.cookie,
+		Value:    b.name,
+		Path:     "/",
+		MaxAge:   int(abCookieMaxAge / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return b
+}
+
+type targetKey struct{}
+
+// withTarget returns a copy of ctx that records the destination server
+// chosen for the request, such as by its A/B test bucket or round-robin
+// between the route's backends.
+func withTarget(ctx context.Context, u *url.URL) context.Context {
+	return context.WithValue(ctx, targetKey{}, u)
+}
+
+func targetFrom(ctx context.Context) *url.URL {
+	u, _ := ctx.Value(targetKey{}).(*url.URL)
+	return u
+}
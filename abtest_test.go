@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestABTest(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	a, b := backend("a"), backend("b")
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {
+		URL: a.URL,
+		ABTest: &ABTest{
+			Cookie: "bucket",
+			Buckets: []ABBucket{
+				{Name: "control", URL: a.URL, Percent: 20},
+				{Name: "new", URL: b.URL, Percent: 80},
+			},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+
+	t.Run("split", func(t *testing.T) {
+		at := routes["foo.com"].abTest
+		counts := make(map[string]int)
+		for n := 0; n < 100; n++ {
+			counts[at.pick(n).name]++
+		}
+		if counts["control"] != 20 || counts["new"] != 80 {
+			t.Errorf("want 20 control and 80 new, got %v", counts)
+		}
+
+		// random assignment of new clients follows the split.
+		const requests = 2000
+		served := make(map[string]int)
+		for i := 0; i < requests; i++ {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+			served[w.Body.String()]++
+		}
+		if frac := float64(served["a"]) / requests; frac < 0.15 || frac > 0.25 {
+			t.Errorf("want about 20%% of new clients in control, got %.1f%%", frac*100)
+		}
+	})
+
+	t.Run("sticky", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != "bucket" {
+			t.Fatalf("want bucket cookie, got %v", cookies)
+		}
+		first := w.Body.String()
+
+		for i := 0; i < 20; i++ {
+			r := httptest.NewRequest("GET", "https://foo.com/", nil)
+			r.AddCookie(cookies[0])
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Body.String() != first {
+				t.Fatalf("returning client: want %q, got %q", first, w.Body.String())
+			}
+			if got := w.Header().Values("Set-Cookie"); len(got) != 0 {
+				t.Errorf("returning client: want no new cookie, got %q", got)
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, ab := range []*ABTest{
+			{Cookie: "bucket", Buckets: []ABBucket{{Name: "a", URL: a.URL, Percent: 50}}},
+			{Cookie: "bucket", Buckets: []ABBucket{{Name: "a", URL: a.URL, Percent: 50}, {Name: "a", URL: b.URL, Percent: 50}}},
+			{Cookie: "", Buckets: []ABBucket{{Name: "a", URL: a.URL, Percent: 100}}},
+		} {
+			if _, err := newRoutes(map[string]Upstream{"foo.com": {URL: a.URL, ABTest: ab}}); err == nil {
+				t.Errorf("%+v: want error, got nil", ab)
+			}
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// accessLog returns a handler that serves requests using h and writes a
+// line to w for each, in format "text" or "json". The empty string is the
+// same as "text". The line has the request ID, if the request has one when
+// it reaches the returned handler.
+func accessLog(h http.Handler, format string, w io.Writer) http.Handler {
+	l := log.New(w, "", 0)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: rw}
+		lh := &loggedHeaders{}
+		h.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), loggedHeadersKey{}, lh)))
+		d := time.Since(start)
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		client := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+
+		if format == "json" {
+			b, err := json.Marshal(accessLogEntry{
+				Time:      start.UTC().Format(time.RFC3339Nano),
+				Client:    client,
+				Method:    r.Method,
+				Host:      r.Host,
+				Path:      r.URL.EscapedPath(),
+				Status:    status,
+				Bytes:     sw.n,
+				Duration:  d.Seconds(),
+				RequestID: requestIDFrom(r.Context()),
+				Headers:   lh.jsonValue(),
+			})
+			if err != nil {
+				panic(err) // all fields are marshalable
+			}
+			l.Print(string(b))
+			return
+		}
+		var id string
+		if v := requestIDFrom(r.Context()); v != "" {
+			id = fmt.Sprintf(" requestId=%q", v)
+		}
+		l.Printf("%s %s %s %s %s %d %d %s%s%s",
+			start.UTC().Format(time.RFC3339Nano), client, r.Method, r.Host,
+			r.URL.EscapedPath(), status, sw.n, d, id, lh.text())
+	})
+}
+
+type accessLogEntry struct {
+	Time     string  `json:"time"`
+	Client   string  `json:"client"`
+	Method   string  `json:"method"`
+	Host     string  `json:"host"`
+	Path     string  `json:"path"`
+	Status   int     `json:"status"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration"` // seconds
+
+	RequestID string            `json:"requestId,omitempty"`
+	Headers   map[string]string `json:"upstreamHeaders,omitempty"`
+}
+
+// loggedHeaders are the headers of the destination server's response
+// that are logged with the request, in the order of accessLogHeaders.
+type loggedHeaders struct {
+	names, values []string
+}
+
+type loggedHeadersKey struct{}
+
+// captureHeaders records the headers of rsp named by names for the access
+// log line of the request, if it is logged.
+func captureHeaders(rsp *http.Response, names []string) {
+	lh, _ := rsp.Request.Context().Value(loggedHeadersKey{}).(*loggedHeaders)
+	if lh == nil || len(names) == 0 {
+		return
+	}
+	// a retried request replaces the headers of the earlier response.
+	lh.names, lh.values = names, make([]string, len(names))
+	for i, k := range names {
+		lh.values[i] = rsp.Header.Get(k)
+	}
+}
+
+// text returns the headers as space-separated name="value" pairs with a
+// leading space, or the empty string if there are none.
+func (lh *loggedHeaders) text() string {
+	var b strings.Builder
+	for i, k := range lh.names {
+		fmt.Fprintf(&b, " %s=%q", k, lh.values[i])
+	}
+	return b.String()
+}
+
+// jsonValue returns the headers that were present, or nil if none were.
+func (lh *loggedHeaders) jsonValue() map[string]string {
+	var m map[string]string
+	for i, k := range lh.names {
+		if lh.values[i] == "" {
+			continue
+		}
+		if m == nil {
+			m = make(map[string]string)
+		}
+		m[k] = lh.values[i]
+	}
+	return m
+}
+
+// statusWriter records the status code and the number of body bytes of a
+// response. It supports http.Flusher and http.Hijacker, the latter for
+// protocol upgrades such as WebSocket, if the underlying ResponseWriter
+// does.
+type statusWriter struct {
+	http.ResponseWriter
+	status int   // zero until the final or switching protocols status
+	n      int64 // body bytes written
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		// the response, typically a 101, is written to the connection
+		// directly.
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// Unwrap supports http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(201)
+		io.WriteString(w, "hello")
+	})
+
+	t.Run("text", func(t *testing.T) {
+		var buf bytes.Buffer
+		r := httptest.NewRequest("POST", "https://foo.com/a%20b?q=1", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		accessLog(h, "", &buf).ServeHTTP(httptest.NewRecorder(), r)
+
+		re := regexp.MustCompile(`^\S+Z 192\.0\.2\.1 POST foo\.com /a%20b 201 5 \S+\n$`)
+		if !re.MatchString(buf.String()) {
+			t.Errorf("unexpected line %q", buf.String())
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		r := httptest.NewRequest("GET", "https://foo.com/x", nil)
+		r.RemoteAddr = "[2001:db8::1]:1234"
+		accessLog(h, "json", &buf).ServeHTTP(httptest.NewRecorder(), r)
+
+		var e accessLogEntry
+		if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Time == "" || e.Duration < 0 {
+			t.Errorf("unexpected time or duration in %+v", e)
+		}
+		e.Time, e.Duration = "", 0
+		want := accessLogEntry{Client: "2001:db8::1", Method: "GET", Host: "foo.com", Path: "/x", Status: 201, Bytes: 5}
+		if !reflect.DeepEqual(e, want) {
+			t.Errorf("want %+v, got %+v", want, e)
+		}
+	})
+
+	t.Run("implicit status", func(t *testing.T) {
+		var buf bytes.Buffer
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		accessLog(h, "text", &buf).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if !strings.Contains(buf.String(), " 200 0 ") {
+			t.Errorf("unexpected line %q", buf.String())
+		}
+	})
+
+	t.Run("flush and hijack", func(t *testing.T) {
+		var buf bytes.Buffer
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := w.(http.Flusher); !ok {
+				t.Error("not a http.Flusher")
+			}
+			conn, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+			brw.Flush()
+		})
+		done := make(chan struct{})
+		logged := accessLog(h, "text", &buf)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer close(done)
+			logged.ServeHTTP(w, r)
+		}))
+		defer s.Close()
+
+		req, _ := http.NewRequest("GET", s.URL, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "test")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 101 {
+			t.Errorf("status code: want 101, got %d", resp.StatusCode)
+		}
+		<-done
+		if !strings.Contains(buf.String(), " 101 0 ") {
+			t.Errorf("unexpected line %q", buf.String())
+		}
+	})
+}
+
+func TestAccessLogHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Trace-Id", "trace-"+r.URL.Path[1:])
+	}))
+	defer backend.Close()
+
+	o, err := newOptions(Conf{AccessLogHeaders: []string{"x-trace-id", "X-Span-Id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(mustRoutes(map[string]string{"foo.com": backend.URL}), o)
+
+	var buf bytes.Buffer
+	accessLog(h, "text", &buf).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://foo.com/abc", nil))
+	if got := buf.String(); !strings.HasSuffix(got, ` X-Trace-Id="trace-abc" X-Span-Id=""`+"\n") {
+		t.Errorf("text: unexpected line %q", got)
+	}
+
+	buf.Reset()
+	accessLog(h, "json", &buf).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://foo.com/def", nil))
+	var e accessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"X-Trace-Id": "trace-def"}; !reflect.DeepEqual(e.Headers, want) {
+		t.Errorf("json: want %v, got %v", want, e.Headers)
+	}
+
+	// responses that aren't from a destination server log no headers.
+	buf.Reset()
+	accessLog(h, "text", &buf).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://bar.com/", nil))
+	if got := buf.String(); strings.Contains(got, "=") {
+		t.Errorf("unknown host: unexpected line %q", got)
+	}
+
+	for _, c := range []Conf{
+		{AccessLogHeaders: []string{"X Trace"}},
+		{AccessLog: "off", AccessLogHeaders: []string{"X-Trace-Id"}},
+	} {
+		c.Certs = Certs{Auto: true, CertDir: t.TempDir()}
+		if err := checkConf(c); err == nil {
+			t.Errorf("%+v: want error", c)
+		}
+	}
+}
+
+func TestAccessLogRequestID(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Request-Id"))
+	}))
+	defer backend.Close()
+
+	o, err := newOptions(Conf{RequestIDHeader: "X-Request-Id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(mustRoutes(map[string]string{"foo.com": backend.URL}), o)
+
+	for _, clientID := range []string{"", "abc-123"} {
+		var buf bytes.Buffer
+		r := httptest.NewRequest("GET", "https://foo.com/", nil)
+		if clientID != "" {
+			r.Header.Set("X-Request-Id", clientID)
+		}
+		w := httptest.NewRecorder()
+		o.requestIDHandler(accessLog(h, "text", &buf)).ServeHTTP(w, r)
+
+		id := w.Body.String()
+		if id == "" || clientID != "" && id != clientID {
+			t.Fatalf("client ID %q: destination server got ID %q", clientID, id)
+		}
+		if got := buf.String(); !strings.HasSuffix(got, ` requestId="`+id+`"`+"\n") {
+			t.Errorf("client ID %q: want line with ID %q, got %q", clientID, id, got)
+		}
+	}
+
+	var buf bytes.Buffer
+	o.requestIDHandler(accessLog(h, "json", &buf)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://bar.com/", nil))
+	var e accessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if !validRequestID(e.RequestID) {
+		t.Errorf("json: unexpected request ID %q", e.RequestID)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// pathAllowlist is the ready-to-use form of Upstream.AllowPaths.
+type pathAllowlist struct {
+	exact    map[string]bool
+	prefixes []string
+}
+
+// newPathAllowlist returns the allowlist of paths, which are exact paths,
+// or prefixes if they end in "*". It returns nil if paths is empty.
+func newPathAllowlist(paths []string) (*pathAllowlist, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	l := &pathAllowlist{exact: make(map[string]bool)}
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") || strings.Contains(strings.TrimSuffix(p, "*"), "*") {
+			return nil, fmt.Errorf("bad allowPaths entry %q", p)
+		}
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			l.prefixes = append(l.prefixes, prefix)
+		} else {
+			l.exact[p] = true
+		}
+	}
+	return l, nil
+}
+
+// allows reports whether the request path p is allowed. Paths with dot
+// segments or empty segments aren't, as the destination server may
+// resolve them to a path outside the allowlist.
+func (l *pathAllowlist) allows(p string) bool {
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	if clean != p {
+		return false
+	}
+	if l.exact[p] {
+		return true
+	}
+	for _, prefix := range l.prefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
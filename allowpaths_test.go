@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowPaths(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{
+		"foo.com":      {URL: backend.URL, AllowPaths: []string{"/login", "/api/*", "/static*"}},
+		"foo.com/v2":   {URL: backend.URL, AllowPaths: []string{"/v2/public/*"}},
+		"bar.com":      {URL: backend.URL},
+		"baz.com:8443": {URL: backend.URL, AllowPaths: []string{"/"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+
+	for _, tt := range []struct {
+		url  string
+		want int
+	}{
+		{"https://foo.com/login", 200},
+		{"https://foo.com/login?next=/admin", 200},
+		{"https://foo.com/api/users", 200},
+		{"https://foo.com/api/", 200},
+		{"https://foo.com/static.css", 200},
+		{"https://foo.com/static/app.js", 200},
+		{"https://foo.com/v2/public/a", 200},
+		{"https://bar.com/admin", 200},
+		{"https://baz.com:8443/", 200},
+
+		{"https://foo.com/", 404},
+		{"https://foo.com/login/", 404},
+		{"https://foo.com/loginx", 404},
+		{"https://foo.com/api", 404},
+		{"https://foo.com/admin", 404},
+		{"https://foo.com/api/../admin", 404},
+		{"https://foo.com/api/%2e%2e/admin", 404},
+		{"https://foo.com/api//admin", 404},
+		{"https://foo.com/api/./users", 404},
+		{"https://foo.com/v2/private", 404},
+		{"https://baz.com:8443/a", 404},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: status code: want %d, got %d", tt.url, tt.want, w.Code)
+		}
+	}
+
+	for _, paths := range [][]string{{"api/*"}, {""}, {"/a*b"}, {"/*/x"}} {
+		if _, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, AllowPaths: paths}}); err == nil {
+			t.Errorf("%q: want error", paths)
+		}
+	}
+}
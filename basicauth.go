@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuth is the credentials of a host protected by Conf.Auth.
+type basicAuth struct {
+	users  []string
+	hashes [][]byte // bcrypt hash of the password of users[i]
+
+	// verified has the SHA-256 sums of the user and password of requests
+	// that were authenticated, so that bcrypt, which is slow by design,
+	// runs once per credential.
+	verified sync.Map
+}
+
+// parseAuth parses Conf.Auth, keyed by canonical host.
+func parseAuth(auth map[string][]string) (map[string]*basicAuth, error) {
+	if len(auth) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]*basicAuth)
+	for host, entries := range auth {
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("no auth entries for %s", host)
+		}
+		a := &basicAuth{}
+		for _, e := range entries {
+			user, hash, ok := strings.Cut(e, ":")
+			if !ok || user == "" {
+				return nil, fmt.Errorf("auth entry for %s must be user:bcrypt-hash", host)
+			}
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return nil, fmt.Errorf("auth entry for %s for user %s: %s", host, user, err)
+			}
+			a.users = append(a.users, user)
+			a.hashes = append(a.hashes, []byte(hash))
+		}
+		m[canonicalHost(host)] = a
+	}
+	return m, nil
+}
+
+// valid reports whether the request has the Basic credentials of one of
+// the users.
+func (a *basicAuth) valid(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(strconv.Quote(user) + ":" + pass))
+	if _, ok := a.verified.Load(sum); ok {
+		return true
+	}
+
+	// compare with every user so that the time taken doesn't reveal
+	// which users exist.
+	found := -1
+	for i, u := range a.users {
+		if subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1 && found < 0 {
+			found = i
+		}
+	}
+	hash := a.hashes[0]
+	if found >= 0 {
+		hash = a.hashes[found]
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil || found < 0 {
+		return false
+	}
+	a.verified.Store(sum, true)
+	return true
+}
+
+// requireAuth responds with a 401 and returns true if the request's host is
+// protected by Conf.Auth and the request doesn't have valid credentials.
+// Valid credentials are removed from the request, so that they aren't
+// sent to the destination server.
+func (o options) requireAuth(w http.ResponseWriter, r *http.Request) bool {
+	a := o.auth[canonicalHost(r.Host)]
+	if a == nil {
+		return false
+	}
+	if a.valid(r) {
+		r.Header.Del("Authorization")
+		return false
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm=`+strconv.Quote(hostname(r.Host))+`, charset="UTF-8"`)
+	o.httpError(w, r, http.StatusUnauthorized)
+	return true
+}
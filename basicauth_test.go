@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Error("credentials sent to the destination server")
+		}
+	}))
+	defer backend.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := bcrypt.GenerateFromPassword([]byte("other"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Conf{
+		Proxy: map[string]Upstream{
+			"staging.foo.com": {URL: backend.URL},
+			"foo.com":         {URL: backend.URL},
+		},
+		Auth: map[string][]string{"staging.foo.com": {"alice:" + string(hash), "bob:" + string(other)}},
+	}
+	o, err := newOptions(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := newRoutes(c.Proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), o)
+
+	testcases := []struct {
+		host       string
+		user, pass string // empty means no credentials
+		want       int
+	}{
+		{"foo.com", "", "", 200},
+		{"staging.foo.com", "", "", 401},
+		{"staging.foo.com", "alice", "secret", 200},
+		{"staging.foo.com", "alice", "secret", 200}, // verified before
+		{"staging.foo.com", "alice", "wrong", 401},
+		{"staging.foo.com", "bob", "secret", 401},
+		{"staging.foo.com", "carol", "secret", 401},
+		{"staging.foo.com", "bob", "other", 200},
+	}
+	for _, tc := range testcases {
+		r := httptest.NewRequest("GET", "https://"+tc.host+"/", nil)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, tc.pass)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s %s:%s: status code: want %d, got %d", tc.host, tc.user, tc.pass, tc.want, w.Code)
+		}
+		if want := `Basic realm="staging.foo.com", charset="UTF-8"`; tc.want == 401 && w.Header().Get("WWW-Authenticate") != want {
+			t.Errorf("%s %s: WWW-Authenticate: want %q, got %q", tc.host, tc.user, want, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	for name, auth := range map[string]map[string][]string{
+		"bad hash":     {"staging.foo.com": {"alice:notahash"}},
+		"no colon":     {"staging.foo.com": {"alice"}},
+		"no entries":   {"staging.foo.com": {}},
+		"unknown host": {"bar.com": {"alice:" + string(hash)}},
+	} {
+		c.Auth = auth
+		if _, err := newOptions(c); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
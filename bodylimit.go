@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+// maxBodyMemory is the size of the largest request body that limitBody
+// buffers in memory. Larger bodies are buffered in a temporary file.
+const maxBodyMemory = 1 << 20
+
+// limitBody responds with a 413 and returns false if the request body is
+// larger than max bytes. A body of unknown length, such as a chunked one,
+// is buffered to find its length before anything is forwarded, so that the
+// destination server never gets a body cut short at the limit; the request
+// body is then replaced with the buffered body, which is in memory up to
+// maxBodyMemory bytes and in a temporary file beyond that. The file is
+// removed when the body is closed.
+func (o options) limitBody(w http.ResponseWriter, r *http.Request, max int64) bool {
+	if r.ContentLength > max {
+		o.tooLarge(w, r)
+		return false
+	}
+	if r.ContentLength >= 0 || r.Body == nil || r.Body == http.NoBody {
+		// net/http ensures the body is exactly ContentLength bytes.
+		return true
+	}
+
+	inMemory := int64(maxBodyMemory)
+	if max < inMemory {
+		inMemory = max
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, inMemory+1))
+	if err != nil {
+		r.Body.Close()
+		o.bodyError(w, r, err)
+		return false
+	}
+	if int64(len(b)) <= inMemory {
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		r.ContentLength = int64(len(b))
+		r.TransferEncoding = nil
+		return true
+	}
+	if inMemory == max {
+		r.Body.Close()
+		o.tooLarge(w, r)
+		return false
+	}
+
+	f, err := os.CreateTemp("", "httpserver-request-")
+	if err != nil {
+		r.Body.Close()
+		log.Printf("buffer request body for %s%s: %s", r.Host, r.URL.Path, err)
+		o.httpError(w, r, http.StatusInternalServerError)
+		return false
+	}
+	body := &tempFileBody{f}
+	if _, err := f.Write(b); err != nil {
+		r.Body.Close()
+		body.Close()
+		log.Printf("buffer request body for %s%s: %s", r.Host, r.URL.Path, err)
+		o.httpError(w, r, http.StatusInternalServerError)
+		return false
+	}
+	n, err := io.Copy(f, io.LimitReader(r.Body, max+1-int64(len(b))))
+	r.Body.Close()
+	if err != nil {
+		body.Close()
+		var pe *os.PathError
+		if errors.As(err, &pe) {
+			log.Printf("buffer request body for %s%s: %s", r.Host, r.URL.Path, err)
+			o.httpError(w, r, http.StatusInternalServerError)
+			return false
+		}
+		o.bodyError(w, r, err)
+		return false
+	}
+	if int64(len(b))+n > max {
+		body.Close()
+		o.tooLarge(w, r)
+		return false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		body.Close()
+		o.httpError(w, r, http.StatusInternalServerError)
+		return false
+	}
+	r.Body = body
+	r.ContentLength = int64(len(b)) + n
+	r.TransferEncoding = nil
+	return true
+}
+
+// bodyError responds to a request whose body couldn't be read with a 413 if
+// it is a decompressed body over its limit, or else a 400.
+func (o options) bodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		o.tooLarge(w, r)
+		return
+	}
+	o.httpError(w, r, http.StatusBadRequest)
+}
+
+func (o options) tooLarge(w http.ResponseWriter, r *http.Request) {
+	// the rest of the body isn't read.
+	w.Header().Set("Connection", "close")
+	o.httpError(w, r, http.StatusRequestEntityTooLarge)
+}
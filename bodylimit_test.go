@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMaxBodyBytes(t *testing.T) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d %v %d", r.ContentLength, r.TransferEncoding, len(b))
+	}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, MaxBodyBytes: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(httpsHandler(newRouteTable(routes), options{}))
+	defer s.Close()
+
+	post := func(body io.Reader) (int, string) {
+		req, err := http.NewRequest("POST", s.URL, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "foo.com"
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		b, _ := io.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(b)
+	}
+	// chunked hides the length of r, so that the request is sent chunked.
+	chunked := func(s string) io.Reader {
+		return io.MultiReader(strings.NewReader(s))
+	}
+
+	for _, tt := range []struct {
+		name string
+		body io.Reader
+		code int
+		want string
+	}{
+		{"content-length within limit", strings.NewReader("0123456789"), 200, "10 [] 10"},
+		{"content-length over limit", strings.NewReader("0123456789a"), 413, ""},
+		{"chunked within limit", chunked("0123456789"), 200, "10 [] 10"},
+		{"chunked over limit", chunked(strings.Repeat("x", 1000)), 413, ""},
+	} {
+		hits.Store(0)
+		code, body := post(tt.body)
+		if code != tt.code {
+			t.Errorf("%s: status code: want %d, got %d", tt.name, tt.code, code)
+		}
+		if tt.code == 200 && body != tt.want {
+			t.Errorf("%s: backend saw %q, want %q", tt.name, body, tt.want)
+		}
+		if tt.code == 413 && hits.Load() != 0 {
+			t.Errorf("%s: want backend not to get the request", tt.name)
+		}
+	}
+}
+
+func TestMaxBodyBytesTempFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d %d", r.ContentLength, len(b))
+	}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, MaxBodyBytes: 3 * maxBodyMemory}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(httpsHandler(newRouteTable(routes), options{}))
+	defer s.Close()
+
+	for _, tt := range []struct {
+		size int
+		code int
+	}{
+		{2 * maxBodyMemory, 200},
+		{3*maxBodyMemory + 1, 413},
+	} {
+		// the MultiReader hides the length, so that the request is sent
+		// chunked.
+		req, err := http.NewRequest("POST", s.URL, io.MultiReader(strings.NewReader(strings.Repeat("x", tt.size))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "foo.com"
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != tt.code {
+			t.Errorf("%d bytes: status code: want %d, got %d", tt.size, tt.code, rsp.StatusCode)
+		}
+		if want := fmt.Sprintf("%d %d", tt.size, tt.size); tt.code == 200 && string(b) != want {
+			t.Errorf("%d bytes: backend saw %q, want %q", tt.size, b, want)
+		}
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Errorf("%d bytes: temporary files left: %v", tt.size, files)
+		}
+	}
+}
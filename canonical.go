@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Canonical configures redirects from the "www." form of domains to the
+// apex form, or the reverse.
+type Canonical struct {
+	// Mode is "apex" to redirect www.example.com to example.com, "www"
+	// to redirect example.com to www.example.com, or "" for neither.
+	Mode string `json:"mode"`
+	// Domains lists the apex domains, such as "example.com", that Mode
+	// applies to.
+	Domains []string `json:"domains"`
+}
+
+// newCanonicalHosts returns a map from each non-canonical host to its
+// canonical form, or nil if c.Mode is "". Canonical hosts are never keys,
+// so a redirect is never followed by another.
+func newCanonicalHosts(c Canonical) (map[string]string, error) {
+	if c.Mode == "" {
+		if len(c.Domains) > 0 {
+			return nil, errors.New("require canonical.mode for canonical.domains")
+		}
+		return nil, nil
+	}
+	if c.Mode != "apex" && c.Mode != "www" {
+		return nil, fmt.Errorf("unknown canonical.mode %q", c.Mode)
+	}
+	if len(c.Domains) == 0 {
+		return nil, errors.New("require canonical.domains for canonical.mode")
+	}
+	m := make(map[string]string)
+	for _, d := range c.Domains {
+		d = strings.ToLower(d)
+		if d == "" || strings.HasPrefix(d, "www.") || strings.ContainsAny(d, ":*/[]") || !strings.Contains(d, ".") {
+			return nil, fmt.Errorf("bad canonical.domains entry %q", d)
+		}
+		if c.Mode == "apex" {
+			m["www."+d] = d
+		} else {
+			m[d] = "www." + d
+		}
+	}
+	return m, nil
+}
+
+// serveCanonical redirects the request to the canonical form of its host,
+// keeping the scheme, port, path, and query, if the host isn't canonical.
+// It reports whether it redirected.
+func (o options) serveCanonical(w http.ResponseWriter, r *http.Request) bool {
+	to, ok := o.canonical[strings.ToLower(hostname(r.Host))]
+	if !ok {
+		return false
+	}
+	u := o.requestURL(r)
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		u.Host = net.JoinHostPort(to, port)
+	} else {
+		u.Host = to
+	}
+	o.redirect(w, r, u.String(), o.hostRedirectCode(r.Method))
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	table := mustRoutes(map[string]string{
+		"example.com":     backend.URL,
+		"www.example.com": backend.URL,
+		"www.foo.com":     backend.URL,
+		"bar.com":         backend.URL,
+	})
+
+	for _, tt := range []struct {
+		mode     string
+		https    bool
+		method   string
+		url      string
+		wantCode int
+		wantLoc  string
+	}{
+		{"apex", true, "GET", "https://www.example.com/a?b=c", 301, "https://example.com/a?b=c"},
+		{"apex", true, "GET", "https://WWW.Example.com:8443/a", 301, "https://example.com:8443/a"},
+		{"apex", true, "POST", "https://www.example.com/a", 308, "https://example.com/a"},
+		{"apex", false, "GET", "http://www.example.com/a", 301, "http://example.com/a"},
+		{"apex", true, "GET", "https://example.com/a", 200, ""},
+		{"apex", true, "GET", "https://bar.com/a", 200, ""},
+		// not in the proxy map, but the redirect comes first.
+		{"apex", true, "GET", "https://www.bar.com/a", 301, "https://bar.com/a"},
+		{"www", true, "GET", "https://example.com/a", 301, "https://www.example.com/a"},
+		{"www", true, "GET", "https://foo.com/", 301, "https://www.foo.com/"},
+		{"www", true, "GET", "https://www.example.com/a", 200, ""},
+		{"www", true, "GET", "https://www.www.example.com/a", 502, ""},
+	} {
+		o, err := newOptions(Conf{Canonical: Canonical{Mode: tt.mode, Domains: []string{"example.com", "foo.com", "Bar.com"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := httpsHandler(table, o)
+		if !tt.https {
+			h = httpHandler(table, o)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.url, nil))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s %s %s: status code: want %d, got %d", tt.mode, tt.method, tt.url, tt.wantCode, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != tt.wantLoc {
+			t.Errorf("%s %s %s: Location: want %q, got %q", tt.mode, tt.method, tt.url, tt.wantLoc, got)
+		}
+	}
+
+	// the configured redirect status is used instead of a 301.
+	o, err := newOptions(Conf{Canonical: Canonical{Mode: "apex", Domains: []string{"example.com"}}, RedirectStatus: http.StatusFound})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for method, want := range map[string]int{"GET": http.StatusFound, "POST": http.StatusTemporaryRedirect} {
+		w := httptest.NewRecorder()
+		httpsHandler(table, o).ServeHTTP(w, httptest.NewRequest(method, "https://www.example.com/", nil))
+		if w.Code != want {
+			t.Errorf("redirectStatus 302, %s: status code: want %d, got %d", method, want, w.Code)
+		}
+	}
+
+	for _, c := range []Canonical{
+		{Mode: "naked", Domains: []string{"example.com"}},
+		{Mode: "apex"},
+		{Domains: []string{"example.com"}},
+		{Mode: "www", Domains: []string{"www.example.com"}},
+		{Mode: "www", Domains: []string{"example.com:8443"}},
+		{Mode: "www", Domains: []string{"*.example.com"}},
+		{Mode: "www", Domains: []string{"localhost"}},
+	} {
+		if _, err := newOptions(Conf{Canonical: c}); err == nil {
+			t.Errorf("%+v: want error", c)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certRotationCheckInterval is how often wildcard certificates are checked
+// against Certs.MaxAge.
+const certRotationCheckInterval = time.Hour
+
+// certLifetime is the lifetime of certificates from Let's Encrypt, which
+// autocert certificates are assumed to have for Certs.MaxAge.
+const certLifetime = 90 * 24 * time.Hour
+
+// minCertMaxAge is the smallest Certs.MaxAge. With a smaller one, the
+// renewal time derived from it would be within autocert's jitter of the
+// certificate lifetime, and renewed certificates would be due at once.
+const minCertMaxAge = 24 * time.Hour
+
+// autocertRenewBefore returns how long before expiry autocert renews a
+// certificate so that it is replaced once it is maxAge old, or the default
+// renewBefore if that is earlier or maxAge is zero. An autocert.Manager
+// keeps the certificates it has loaded in memory and replaces them only
+// when they are due for renewal, so this is how it rotates them.
+func autocertRenewBefore(maxAge time.Duration) time.Duration {
+	if maxAge == 0 || certLifetime-maxAge < renewBefore {
+		return renewBefore
+	}
+	return certLifetime - maxAge
+}
+
+// maxAgeCache is an autocert.Cache that reports certificates that are at
+// least maxAge old as missing, so that autocert obtains new ones instead of
+// loading them, such as at startup after downtime.
+type maxAgeCache struct {
+	autocert.Cache
+	maxAge time.Duration
+	now    func() time.Time
+}
+
+func (c maxAgeCache) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := c.Cache.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	// keys without a certificate are the account key, challenge tokens,
+	// and so on.
+	if leaf := firstCertificate(b); leaf != nil && c.now().Sub(leaf.NotBefore) >= c.maxAge {
+		return nil, autocert.ErrCacheMiss
+	}
+	return b, nil
+}
+
+// Put warns about certificates whose lifetime is too short for maxAge: ones
+// due for renewal as soon as they are obtained, which autocert would renew
+// again and again.
+func (c maxAgeCache) Put(ctx context.Context, key string, data []byte) error {
+	if leaf := firstCertificate(data); leaf != nil && leaf.NotAfter.Sub(leaf.NotBefore) <= autocertRenewBefore(c.maxAge)+time.Hour {
+		log.Printf("certificate %s is valid for only %s, too short for certs.maxAge %s; raise certs.maxAge",
+			key, leaf.NotAfter.Sub(leaf.NotBefore), c.maxAge)
+	}
+	return c.Cache.Put(ctx, key, data)
+}
+
+// firstCertificate returns the first certificate in PEM data, or nil if
+// there is none. autocert stores the private key followed by the
+// certificate chain, leaf first.
+func firstCertificate(data []byte) *x509.Certificate {
+	for {
+		var b *pem.Block
+		b, data = pem.Decode(data)
+		if b == nil {
+			return nil
+		}
+		if b.Type == "CERTIFICATE" {
+			c, err := x509.ParseCertificate(b.Bytes)
+			if err != nil {
+				return nil
+			}
+			return c
+		}
+	}
+}
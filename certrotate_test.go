@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// writeCachedCert writes a certificate for host obtained at notBefore to
+// dir in the form of autocert.DirCache.
+func writeCachedCert(t *testing.T, dir, key, host string, notBefore time.Time) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := os.WriteFile(filepath.Join(dir, key), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxAgeCache(t *testing.T) {
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	dir := t.TempDir()
+	writeCachedCert(t, dir, "old.org", "old.org", now.Add(-61*day))
+	writeCachedCert(t, dir, "new.org", "new.org", now.Add(-10*day))
+	if err := os.WriteFile(filepath.Join(dir, "acme_account+key"), []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := maxAgeCache{Cache: autocert.DirCache(dir), maxAge: 60 * day, now: func() time.Time { return now }}
+	ctx := context.Background()
+	if _, err := c.Get(ctx, "old.org"); err != autocert.ErrCacheMiss {
+		t.Errorf("old.org: want ErrCacheMiss, got %v", err)
+	}
+	for _, k := range []string{"new.org", "acme_account+key"} {
+		if _, err := c.Get(ctx, k); err != nil {
+			t.Errorf("%s: want found, got %v", k, err)
+		}
+	}
+	if _, err := c.Get(ctx, "missing.org"); err != autocert.ErrCacheMiss {
+		t.Errorf("missing.org: want ErrCacheMiss, got %v", err)
+	}
+
+	// the test certificates are valid for 90 days, which is due for
+	// renewal at once with a maxAge within autocert's jitter of an hour.
+	buf := captureLog(t)
+	b, err := os.ReadFile(filepath.Join(dir, "new.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.maxAge = 30 * time.Minute
+	if err := c.Put(ctx, "put.org", b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "too short for certs.maxAge") {
+		t.Errorf("want a warning, got %q", buf.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "put.org")); err != nil {
+		t.Errorf("want put.org stored, got %v", err)
+	}
+}
+
+func TestAutocertRenewBefore(t *testing.T) {
+	day := 24 * time.Hour
+	for _, tt := range []struct {
+		maxAge, want time.Duration
+	}{
+		{0, renewBefore},
+		{day, 89 * day},
+		{45 * day, 45 * day},
+		{60 * day, renewBefore},
+		{80 * day, renewBefore},
+	} {
+		if got := autocertRenewBefore(tt.maxAge); got != tt.want {
+			t.Errorf("%s: want %s, got %s", tt.maxAge, tt.want, got)
+		}
+	}
+
+	dir := t.TempDir()
+	m := newAutocertManager(Conf{Domains: []string{"example.com"}, Certs: Certs{Auto: true, CertDir: dir, MaxAge: Duration(45 * day)}})
+	if m.RenewBefore != 45*day {
+		t.Errorf("RenewBefore: want %s, got %s", 45*day, m.RenewBefore)
+	}
+	if _, ok := m.Cache.(maxAgeCache); !ok {
+		t.Errorf("Cache: want a maxAgeCache, got %T", m.Cache)
+	}
+
+	if err := checkConf(Conf{Certs: Certs{Auto: true, CertDir: dir, MaxAge: Duration(time.Hour)}}); err == nil {
+		t.Error("maxAge 1h: want error")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// issuanceLimiter wraps the GetCertificate method of an autocert.Manager to
+// limit the number of certificates that are obtained concurrently. Handshakes
+// for hosts that already have a certificate are not limited.
+type issuanceLimiter struct {
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	sem            chan struct{} // nil means no limit
+
+	mu        sync.Mutex
+	ready     map[string]bool // hosts that have a certificate
+	preparing map[string]bool // hosts being prepared by Prepare
+}
+
+// newIssuanceLimiter returns an issuanceLimiter that allows at most n
+// certificates to be obtained concurrently. If n is zero, there is no limit.
+func newIssuanceLimiter(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), n int) *issuanceLimiter {
+	l := &issuanceLimiter{
+		getCertificate: getCertificate,
+		ready:          make(map[string]bool),
+		preparing:      make(map[string]bool),
+	}
+	if n > 0 {
+		l.sem = make(chan struct{}, n)
+	}
+	return l
+}
+
+// GetCertificate is suitable for use as the GetCertificate field of
+// tls.Config.
+func (l *issuanceLimiter) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// Never block a TLS-ALPN challenge handshake: the issuance that is
+	// holding a slot may be waiting on it.
+	if isChallengeHello(hello) {
+		return l.getCertificate(hello)
+	}
+	return l.obtain(hello.Context(), hello)
+}
+
+func (l *issuanceLimiter) obtain(ctx context.Context, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := certHost(hello.ServerName)
+	if l.sem != nil && !l.isReady(host) {
+		select {
+		case l.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-l.sem }()
+	}
+
+	cert, err := l.getCertificate(hello)
+	if err == nil {
+		l.setReady(host)
+	}
+	return cert, err
+}
+
+// Prepare reports whether a certificate is ready for the host. If it isn't,
+// Prepare starts obtaining one in the background, as though a TLS handshake
+// for the host had begun.
+func (l *issuanceLimiter) Prepare(host string) bool {
+	host = certHost(host)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ready[host] {
+		return true
+	}
+	if l.preparing[host] {
+		return false
+	}
+	l.preparing[host] = true
+
+	go func() {
+		defer func() {
+			l.mu.Lock()
+			delete(l.preparing, host)
+			l.mu.Unlock()
+		}()
+		// Present as a modern client so that an ECDSA certificate,
+		// which is what most clients will want, is obtained.
+		hello := &tls.ClientHelloInfo{
+			ServerName:       host,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		}
+		if _, err := l.obtain(context.Background(), hello); err != nil {
+			log.Printf("prepare certificate for %s: %s", host, err)
+		}
+	}()
+	return false
+}
+
+func (l *issuanceLimiter) isReady(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ready[host]
+}
+
+func (l *issuanceLimiter) setReady(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ready[host] = true
+}
+
+// isChallengeHello reports whether the hello is from a CA verifying a
+// TLS-ALPN-01 challenge.
+func isChallengeHello(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// certHost returns the canonical form of the server name for keying
+// certificates.
+func certHost(serverName string) string {
+	return strings.TrimSuffix(strings.ToLower(serverName), ".")
+}
+
+// whitelistDomains returns the domains that autocert obtains certificates
+// for: domains other than wildcard domains and, if includeWWW is true, the
+// "www." or apex counterpart of each.
+func whitelistDomains(domains []string, includeWWW bool) []string {
+	var list []string
+	for _, d := range domains {
+		if isWildcard(d) {
+			continue
+		}
+		list = append(list, d)
+		if !includeWWW {
+			continue
+		}
+		if apex, ok := cutPrefixFold(d, "www."); ok {
+			list = append(list, apex)
+		} else {
+			list = append(list, "www."+d)
+		}
+	}
+	return list
+}
+
+// missingDomains returns the hosts in c.Proxy, other than c.HTTPOnlyHosts,
+// that autocert wouldn't obtain a certificate for because c.Domains doesn't
+// cover them, sorted.
+func missingDomains(c Conf) []string {
+	covered := make(map[string]bool)
+	for _, d := range whitelistDomains(c.Domains, c.Certs.AutoIncludeWWW) {
+		covered[certHost(d)] = true
+	}
+	httpOnly := make(map[string]bool)
+	for _, h := range c.HTTPOnlyHosts {
+		httpOnly[certHost(hostname(h))] = true
+	}
+
+	missing := make(map[string]bool)
+	for k := range c.Proxy {
+		h, _ := splitRouteKey(k)
+		h = certHost(hostname(h))
+		if covered[h] || httpOnly[h] {
+			continue
+		}
+		wildcard := false
+		for _, d := range c.Domains {
+			if isWildcard(d) && wildcardCovers(d, h) {
+				wildcard = true
+				break
+			}
+		}
+		if !wildcard {
+			missing[h] = true
+		}
+	}
+	list := make([]string, 0, len(missing))
+	for h := range missing {
+		list = append(list, h)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) > len(prefix) && strings.EqualFold(s[:len(prefix)], prefix) {
+		return s[len(prefix):], true
+	}
+	return s, false
+}
+
+// letsEncryptStagingURL is the directory URL of Let's Encrypt's staging
+// environment, whose rate limits are higher and whose certificates aren't
+// trusted by browsers.
+const letsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// acmeDirectoryURL returns the ACME directory URL for Certs.ACMEDirectory,
+// which is "staging" or a URL. The empty string means Let's Encrypt's
+// production directory, which is autocert's default.
+func acmeDirectoryURL(dir string) (string, error) {
+	switch dir {
+	case "":
+		return "", nil
+	case "staging":
+		return letsEncryptStagingURL, nil
+	}
+	u, err := url.Parse(dir)
+	if err != nil {
+		return "", fmt.Errorf("parse certs.acmeDirectory: %s", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", errors.New("certs.acmeDirectory must be \"staging\" or a http or https URL")
+	}
+	return dir, nil
+}
+
+// newAutocertManager returns a manager that obtains certificates for the
+// domains in c, as configured by c.Certs, which must be valid.
+func newAutocertManager(c Conf) *autocert.Manager {
+	maxAge := time.Duration(c.Certs.MaxAge)
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(c.Certs.CertDir),
+		HostPolicy:  autocert.HostWhitelist(whitelistDomains(c.Domains, c.Certs.AutoIncludeWWW)...),
+		RenewBefore: autocertRenewBefore(maxAge),
+		Email:       c.Certs.ACMEEmail,
+	}
+	if maxAge > 0 {
+		m.Cache = maxAgeCache{Cache: m.Cache, maxAge: maxAge, now: time.Now}
+	}
+	dir, err := acmeDirectoryURL(c.Certs.ACMEDirectory)
+	if err != nil {
+		// should be nil; should have been handled earlier in checkConf.
+		panic(err)
+	}
+	if dir != "" {
+		m.Client = &acme.Client{DirectoryURL: dir}
+	}
+	return m
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// handshake performs a TLS handshake with a server that uses getCertificate,
+// returning the server's handshake error.
+func handshake(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), serverName string, protos ...string) error {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	go func() {
+		client := tls.Client(c, &tls.Config{
+			ServerName:         serverName,
+			NextProtos:         protos,
+			InsecureSkipVerify: true,
+		})
+		client.Handshake()
+		client.Close()
+	}()
+
+	server := tls.Server(s, &tls.Config{
+		GetCertificate: getCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+	})
+	return server.Handshake()
+}
+
+func TestIssuanceLimiter(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join("testdata", "cert.pem"), filepath.Join("testdata", "key.pem"))
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err)
+	}
+
+	t.Run("limits concurrent issuance", func(t *testing.T) {
+		var mu sync.Mutex
+		var active, maxActive int
+		l := newIssuanceLimiter(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+			return &cert, nil
+		}, 2)
+
+		var wg sync.WaitGroup
+		for _, host := range []string{"a.org", "b.org", "c.org", "d.org", "e.org"} {
+			host := host
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := handshake(l.GetCertificate, host); err != nil {
+					t.Errorf("%s: handshake: %s", host, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if maxActive != 2 {
+			t.Errorf("max concurrent: want 2, got %d", maxActive)
+		}
+	})
+
+	t.Run("ready host and challenge not limited", func(t *testing.T) {
+		l := newIssuanceLimiter(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}, 1)
+
+		if err := handshake(l.GetCertificate, "Ready.org."); err != nil {
+			t.Fatalf("handshake: %s", err)
+		}
+
+		l.sem <- struct{}{} // occupy the only slot
+		defer func() { <-l.sem }()
+
+		if err := handshake(l.GetCertificate, "ready.org"); err != nil {
+			t.Errorf("ready host: handshake: %s", err)
+		}
+		if err := handshake(l.GetCertificate, "new.org", acme.ALPNProto); err != nil {
+			t.Errorf("challenge: handshake: %s", err)
+		}
+	})
+}
+
+func TestIssuanceLimiterPrepare(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join("testdata", "cert.pem"), filepath.Join("testdata", "key.pem"))
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err)
+	}
+
+	obtained := make(chan string, 1)
+	l := newIssuanceLimiter(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		obtained <- hello.ServerName
+		return &cert, nil
+	}, 1)
+
+	if l.Prepare("foo.com") {
+		t.Fatalf("want not ready before obtaining certificate")
+	}
+	select {
+	case name := <-obtained:
+		if name != "foo.com" {
+			t.Errorf("server name: want %q, got %q", "foo.com", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("certificate not obtained in background")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !l.Prepare("foo.com") {
+		if time.Now().After(deadline) {
+			t.Fatalf("want ready after obtaining certificate")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWhitelistDomains(t *testing.T) {
+	domains := []string{"example.com", "www.foo.org", "WWW.bar.net"}
+	testcases := []struct {
+		includeWWW bool
+		allowed    []string
+		rejected   []string
+	}{
+		{false, []string{"example.com", "www.foo.org", "www.bar.net"}, []string{"www.example.com", "foo.org", "bar.net"}},
+		{true, []string{"example.com", "www.example.com", "www.foo.org", "foo.org", "www.bar.net", "bar.net"}, []string{"www.www.foo.org", "other.com"}},
+	}
+	for _, tc := range testcases {
+		policy := autocert.HostWhitelist(whitelistDomains(domains, tc.includeWWW)...)
+		for _, h := range tc.allowed {
+			if err := policy(context.Background(), h); err != nil {
+				t.Errorf("includeWWW %v: %s: want allowed, got %s", tc.includeWWW, h, err)
+			}
+		}
+		for _, h := range tc.rejected {
+			if err := policy(context.Background(), h); err == nil {
+				t.Errorf("includeWWW %v: %s: want rejected", tc.includeWWW, h)
+			}
+		}
+	}
+}
+
+func TestACMEDirectory(t *testing.T) {
+	testcases := []struct {
+		dir     string
+		wantURL string // empty for autocert's default client
+		wantErr bool
+	}{
+		{"", "", false},
+		{"staging", letsEncryptStagingURL, false},
+		{"https://acme.example.com/directory", "https://acme.example.com/directory", false},
+		{"http://localhost:14000/dir", "http://localhost:14000/dir", false},
+		{"acme.example.com/directory", "", true},
+		{"ftp://acme.example.com/", "", true},
+		{"https://%zz", "", true},
+	}
+	for _, tc := range testcases {
+		c := Conf{Certs: Certs{Auto: true, CertDir: t.TempDir(), ACMEDirectory: tc.dir, ACMEEmail: "ops@example.com"}}
+		err := checkConf(c)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: want error %v, got %v", tc.dir, tc.wantErr, err)
+			continue
+		}
+		if tc.wantErr {
+			continue
+		}
+		m := newAutocertManager(c)
+		if m.Email != "ops@example.com" {
+			t.Errorf("%q: want email set, got %q", tc.dir, m.Email)
+		}
+		var got string
+		if m.Client != nil {
+			got = m.Client.DirectoryURL
+		}
+		if got != tc.wantURL {
+			t.Errorf("%q: want directory %q, got %q", tc.dir, tc.wantURL, got)
+		}
+	}
+}
+
+func TestMissingDomains(t *testing.T) {
+	t.Setenv("CLOUDFLARE_API_TOKEN", "token")
+	c := Conf{
+		Domains: []string{"foo.com", "*.bar.com", "Baz.com"},
+		Proxy: map[string]Upstream{
+			"foo.com":        {URL: "http://a"},
+			"foo.com/api":    {URL: "http://a"},
+			"www.foo.com":    {URL: "http://a"},
+			"a.bar.com":      {URL: "http://a"},
+			"a.b.bar.com":    {URL: "http://a"},
+			"baz.com:8443":   {URL: "http://a"},
+			"qux.com/static": {URL: "http://a"},
+			"plain.com":      {URL: "http://a"},
+		},
+		HTTPOnlyHosts: []string{"plain.com"},
+		Certs:         Certs{Auto: true, CertDir: t.TempDir(), DNSProvider: &DNSProvider{Name: "cloudflare"}},
+	}
+	err := checkConf(c)
+	if err == nil || !strings.HasSuffix(err.Error(), "missing: a.b.bar.com, qux.com, www.foo.com") {
+		t.Errorf("want the missing hosts listed, got %v", err)
+	}
+
+	c.Certs.AutoIncludeWWW = true
+	c.Domains = append(c.Domains, "qux.com", "a.b.bar.com")
+	if err := checkConf(c); err != nil {
+		t.Errorf("want ok, got %s", err)
+	}
+
+	// certificates from files needn't match domains.
+	c.Domains = nil
+	c.Certs = Certs{CertFile: filepath.Join("testdata", "cert.pem"), KeyFile: filepath.Join("testdata", "key.pem")}
+	if err := checkConf(c); err != nil {
+		t.Errorf("certs.auto == false: want ok, got %s", err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+)
+
+// clientBody is a request body whose read errors are wrapped in
+// clientBodyError, so that a failure to read the request from the client
+// can be told apart from a failure of the destination server.
+type clientBody struct {
+	io.ReadCloser
+}
+
+func (b clientBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = &clientBodyError{err}
+	}
+	return n, err
+}
+
+// clientBodyError is an error reading the request body from the client,
+// such as when the client aborts an upload.
+type clientBodyError struct {
+	err error
+}
+
+func (e *clientBodyError) Error() string { return "read request body: " + e.err.Error() }
+func (e *clientBodyError) Unwrap() error { return e.err }
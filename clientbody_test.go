@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestClientBodyError(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := captureLog(t)
+
+	// simulate a client that goes away partway through the body.
+	body := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(io.ErrUnexpectedEOF))
+	r := httptest.NewRequest("POST", "https://foo.com/upload", body)
+	r.ContentLength = 100
+	w := httptest.NewRecorder()
+	httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, r)
+
+	if w.Code != 400 {
+		t.Errorf("status code: want 400, got %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("want empty body, got %q", w.Body.String())
+	}
+	logged := buf.String()
+	if strings.Contains(logged, "proxy error") {
+		t.Errorf("want no proxy error logged, got %q", logged)
+	}
+	if !strings.Contains(logged, "client error for foo.com/upload") {
+		t.Errorf("want client error logged, got %q", logged)
+	}
+}
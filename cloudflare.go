@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	cloudflareAPI     = "https://api.cloudflare.com/client/v4"
+	cloudflareTimeout = 30 * time.Second // of each API request
+)
+
+// cloudflareDNS is a dnsProvider for DNS hosted by Cloudflare. The API
+// token needs the Zone:Read and DNS:Edit permissions.
+type cloudflareDNS struct {
+	token  string
+	api    string // base URL of the API
+	client *http.Client
+}
+
+func newCloudflareDNS(token string) *cloudflareDNS {
+	return &cloudflareDNS{token: token, api: cloudflareAPI, client: &http.Client{Timeout: cloudflareTimeout}}
+}
+
+// cloudflareResponse is the envelope of Cloudflare API responses.
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+// do makes an API request, decoding the result into result if non-nil.
+func (cf *cloudflareDNS) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var rb []byte
+	if body != nil {
+		var err error
+		rb, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cf.api+path, bytes.NewReader(rb))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cf.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rsp, err := cf.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	var r cloudflareResponse
+	if err := json.NewDecoder(rsp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("cloudflare: %s: %s", rsp.Status, err)
+	}
+	if !r.Success {
+		var msgs []string
+		for _, e := range r.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return fmt.Errorf("cloudflare: %s: %s", rsp.Status, strings.Join(msgs, "; "))
+	}
+	if result != nil {
+		return json.Unmarshal(r.Result, result)
+	}
+	return nil
+}
+
+// zoneID returns the ID of the zone with the record fqdn, the zone of the
+// longest parent domain of fqdn that is in the account.
+func (cf *cloudflareDNS) zoneID(ctx context.Context, fqdn string) (string, error) {
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	for i := 1; i < len(labels)-1; i++ {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		q := url.Values{"name": {strings.Join(labels[i:], ".")}}
+		if err := cf.do(ctx, "GET", "/zones?"+q.Encode(), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare: no zone for %s", fqdn)
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
+}
+
+func (cf *cloudflareDNS) present(ctx context.Context, fqdn, value string) error {
+	zone, err := cf.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	rec := cloudflareRecord{Type: "TXT", Name: fqdn, Content: value, TTL: 120}
+	return cf.do(ctx, "POST", "/zones/"+zone+"/dns_records", rec, nil)
+}
+
+func (cf *cloudflareDNS) cleanUp(ctx context.Context, fqdn, value string) error {
+	zone, err := cf.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	var recs []cloudflareRecord
+	q := url.Values{"type": {"TXT"}, "name": {fqdn}, "content": {value}}
+	if err := cf.do(ctx, "GET", "/zones/"+zone+"/dns_records?"+q.Encode(), nil, &recs); err != nil {
+		return err
+	}
+	if len(recs) == 0 {
+		return errors.New("cloudflare: record not found")
+	}
+	for _, r := range recs {
+		if err := cf.do(ctx, "DELETE", "/zones/"+zone+"/dns_records/"+r.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCloudflareDNS(t *testing.T) {
+	type record struct{ id, name, content string }
+	var records []record
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "errors": []map[string]string{{"message": "unauthorized"}}})
+			return
+		}
+		var result interface{}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/zones":
+			zones := []map[string]string{}
+			if r.URL.Query().Get("name") == "example.com" {
+				zones = append(zones, map[string]string{"id": "z1"})
+			}
+			result = zones
+		case r.Method == "POST" && r.URL.Path == "/zones/z1/dns_records":
+			var rec cloudflareRecord
+			json.NewDecoder(r.Body).Decode(&rec)
+			if rec.Type != "TXT" {
+				t.Errorf("record type: want TXT, got %s", rec.Type)
+			}
+			records = append(records, record{"r1", rec.Name, rec.Content})
+		case r.Method == "GET" && r.URL.Path == "/zones/z1/dns_records":
+			q := r.URL.Query()
+			var found []cloudflareRecord
+			for _, rec := range records {
+				if rec.name == q.Get("name") && rec.content == q.Get("content") {
+					found = append(found, cloudflareRecord{ID: rec.id, Type: "TXT", Name: rec.name, Content: rec.content})
+				}
+			}
+			result = found
+		case r.Method == "DELETE" && r.URL.Path == "/zones/z1/dns_records/r1":
+			records = nil
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": result})
+	}))
+	defer api.Close()
+
+	cf := newCloudflareDNS("token")
+	cf.api = api.URL
+	ctx := context.Background()
+	const fqdn = "_acme-challenge.example.com"
+	if err := cf.present(ctx, fqdn, "v"); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].name != fqdn {
+		t.Fatalf("want the record created, got %v", records)
+	}
+	if err := cf.cleanUp(ctx, fqdn, "v"); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Errorf("want the record removed, got %v", records)
+	}
+
+	if err := cf.cleanUp(ctx, fqdn, "v"); err == nil || !strings.Contains(err.Error(), "record not found") {
+		t.Errorf("removed record: want record not found, got %v", err)
+	}
+	if err := cf.present(ctx, "_acme-challenge.example.org", "v"); err == nil || !strings.Contains(err.Error(), "no zone") {
+		t.Errorf("other zone: want no zone, got %v", err)
+	}
+
+	cf.token = "bad"
+	if err := cf.present(ctx, fqdn, "v"); err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("bad token: want the API's error message, got %v", err)
+	}
+}
+
+func TestCloudflareDNSErrors(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/zones":
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "errors": []map[string]string{{"message": "a"}, {"message": "b"}}})
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			io.WriteString(w, "<html>bad gateway</html>")
+		}
+	}))
+	defer api.Close()
+
+	cf := newCloudflareDNS("token")
+	cf.api = api.URL
+	ctx := context.Background()
+	err := cf.present(ctx, "_acme-challenge.example.com", "v")
+	if want := "cloudflare: 403 Forbidden: a; b"; err == nil || err.Error() != want {
+		t.Errorf("want %q, got %v", want, err)
+	}
+	err = cf.do(ctx, "GET", "/other", nil, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "cloudflare: 502 Bad Gateway: ") {
+		t.Errorf("non-JSON response: want error with the status, got %v", err)
+	}
+
+	if cf.client.Timeout <= 0 {
+		t.Error("want the API client to time out")
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compression configures gzip compression of responses from destination
+// servers.
+type Compression struct {
+	// MinSize is the size of the smallest body that is compressed. Zero
+	// means 1024 bytes.
+	MinSize int64 `json:"minSize"`
+	// Level is the gzip compression level, from 1 (fastest) to 9 (best
+	// compression). Zero means gzip's default of 6.
+	Level int `json:"level"`
+}
+
+const defaultCompressionMinSize = 1024
+
+// compression is the ready-to-use form of a Compression.
+type compression struct {
+	minSize int64
+	level   int
+	writers sync.Pool // of *gzip.Writer with level
+}
+
+func newCompression(c *Compression) (*compression, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.MinSize < 0 {
+		return nil, errors.New("negative compression.minSize")
+	}
+	if c.Level < 0 || c.Level > gzip.BestCompression {
+		return nil, fmt.Errorf("compression.level must be between 1 and 9, got %d", c.Level)
+	}
+	z := &compression{minSize: c.MinSize, level: c.Level}
+	if z.level == 0 {
+		z.level = gzip.DefaultCompression
+	}
+	if z.minSize == 0 {
+		z.minSize = defaultCompressionMinSize
+	}
+	return z, nil
+}
+
+// incompressible reports whether bodies of mediaType are already
+// compressed, or, for event streams, must not be held up by compression.
+func incompressible(mediaType string) bool {
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "font/woff"):
+		return true
+	}
+	switch mediaType {
+	case "text/event-stream",
+		"application/zip", "application/gzip", "application/x-gzip",
+		"application/x-bzip2", "application/x-xz", "application/zstd",
+		"application/x-7z-compressed", "application/vnd.rar",
+		"application/x-rar-compressed", "application/pdf":
+		return true
+	}
+	return false
+}
+
+// acceptsGzip reports whether an Accept-Encoding header value allows gzip.
+func acceptsGzip(accept string) bool {
+	star := false
+	for _, v := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(v, ";")
+		coding = strings.TrimSpace(coding)
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		switch {
+		case strings.EqualFold(coding, "gzip"), strings.EqualFold(coding, "x-gzip"):
+			return q > 0
+		case coding == "*":
+			star = q > 0
+		}
+	}
+	return star
+}
+
+// normalizeAcceptEncoding returns "gzip" if the Accept-Encoding header
+// values accept gzip, and "identity" otherwise.
+func normalizeAcceptEncoding(values []string) string {
+	if acceptsGzip(strings.Join(values, ",")) {
+		return "gzip"
+	}
+	return "identity"
+}
+
+// compress gzips the body of rsp if the client accepts gzip. Responses
+// that are encoded, partial, or to range requests, and those whose type
+// is already compressed, are left unchanged, as are bodies smaller than
+// minSize. Responses to HEAD requests have no body to compress, but get
+// the same Vary header as responses to GET requests.
+func (z *compression) compress(rsp *http.Response) error {
+	req := rsp.Request
+	head := req.Method == http.MethodHead
+	switch {
+	case rsp.StatusCode < 200,
+		rsp.StatusCode == http.StatusNoContent,
+		rsp.StatusCode == http.StatusPartialContent,
+		rsp.StatusCode == http.StatusNotModified,
+		!head && (rsp.Body == nil || rsp.Body == http.NoBody):
+		return nil
+	}
+	if rsp.Header.Get("Content-Encoding") != "" || rsp.Header.Get("Content-Range") != "" {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(rsp.Header.Get("Content-Type"))
+	if incompressible(mediaType) {
+		return nil
+	}
+	for _, v := range rsp.Header.Values("Cache-Control") {
+		if strings.Contains(strings.ToLower(v), "no-transform") {
+			return nil
+		}
+	}
+
+	// the response depends on Accept-Encoding from here on.
+	if !varies(rsp.Header, "Accept-Encoding") {
+		rsp.Header.Add("Vary", "Accept-Encoding")
+	}
+	if head {
+		return nil
+	}
+	// a range of the compressed body would differ from the requested one.
+	if !acceptsGzip(req.Header.Get("Accept-Encoding")) || req.Header.Get("Range") != "" {
+		return nil
+	}
+	if rsp.ContentLength >= 0 && rsp.ContentLength < z.minSize {
+		return nil
+	}
+	if rsp.ContentLength < 0 {
+		head, err := io.ReadAll(io.LimitReader(rsp.Body, z.minSize))
+		if err != nil {
+			rsp.Body.Close()
+			return err
+		}
+		rest := rsp.Body
+		rsp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), rest), rest}
+		if int64(len(head)) < z.minSize {
+			return nil // the body has ended
+		}
+	}
+
+	rsp.Body = z.gzipBody(rsp.Body)
+	rsp.ContentLength = -1
+	rsp.Header.Del("Content-Length")
+	rsp.Header.Set("Content-Encoding", "gzip")
+	// the representation changed, like with minifyResponse.
+	if etag := rsp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		rsp.Header.Set("ETag", "W/"+etag)
+	}
+	rsp.Header.Del("Accept-Ranges")
+	return nil
+}
+
+// varies reports whether the Vary header h already names field.
+func varies(h http.Header, field string) bool {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.EqualFold(f, field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gzipBody returns the gzip-compressed form of body, which is compressed as
+// it is read. The compressed data is flushed after each read of body, so
+// that responses that are streamed stay streamed.
+func (z *compression) gzipBody(body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		zw, _ := z.writers.Get().(*gzip.Writer)
+		if zw == nil {
+			// the level has been validated.
+			zw, _ = gzip.NewWriterLevel(pw, z.level)
+		} else {
+			zw.Reset(pw)
+		}
+		defer z.writers.Put(zw)
+
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := body.Read(buf)
+			if n > 0 {
+				if _, werr := zw.Write(buf[:n]); werr != nil {
+					pw.CloseWithError(werr)
+					return
+				}
+				if err == nil {
+					if werr := zw.Flush(); werr != nil {
+						pw.CloseWithError(werr)
+						return
+					}
+				}
+			}
+			if err == io.EOF {
+				pw.CloseWithError(zw.Close())
+				return
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr
+}
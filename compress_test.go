@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	testcases := map[string]bool{
+		"":                   false,
+		"gzip":               true,
+		"br, GZIP":           true,
+		"gzip;q=0":           false,
+		"deflate, gzip;q=.5": true,
+		"*":                  true,
+		"*, gzip;q=0":        false,
+		"identity":           false,
+	}
+	for accept, want := range testcases {
+		if got := acceptsGzip(accept); got != want {
+			t.Errorf("%q: want %v, got %v", accept, want, got)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat("hello, world\n", 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		w.Header().Set("Content-Type", q.Get("type"))
+		if e := q.Get("encoding"); e != "" {
+			w.Header().Set("Content-Encoding", e)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Accept-Ranges", "bytes")
+		body := large
+		if q.Get("small") != "" {
+			body = "hello"
+		}
+		if q.Get("stream") != "" {
+			// no Content-Length
+			io.WriteString(w, body[:len(body)/2])
+			w.(http.Flusher).Flush()
+			io.WriteString(w, body[len(body)/2:])
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	defer backend.Close()
+
+	o, err := newOptions(Conf{Compression: &Compression{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(mustRoutes(map[string]string{"foo.com": backend.URL}), o)
+
+	testcases := []struct {
+		name   string
+		query  string
+		accept string
+		rng    string
+		want   bool
+	}{
+		{"html", "type=text/html", "gzip, br", "", true},
+		{"streamed", "type=text/html&stream=1", "gzip", "", true},
+		{"no accept", "type=text/html", "", "", false},
+		{"small", "type=text/html&small=1", "gzip", "", false},
+		{"small streamed", "type=text/html&small=1&stream=1", "gzip", "", false},
+		{"image", "type=image/png", "gzip", "", false},
+		{"svg", "type=image/svg%2Bxml", "gzip", "", true},
+		{"event stream", "type=text/event-stream&stream=1", "gzip", "", false},
+		{"encoded", "type=text/html&encoding=br", "gzip", "", false},
+		{"range", "type=text/html", "gzip", "bytes=0-9", false},
+	}
+	for _, tc := range testcases {
+		r := httptest.NewRequest("GET", "https://foo.com/?"+tc.query, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept-Encoding", tc.accept)
+		}
+		if tc.rng != "" {
+			r.Header.Set("Range", tc.rng)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		rsp := w.Result()
+
+		if got := rsp.Header.Get("Content-Encoding") == "gzip"; got != tc.want {
+			t.Errorf("%s: compressed: want %v, got %v", tc.name, tc.want, got)
+			continue
+		}
+		if !tc.want {
+			if tc.rng != "" && rsp.StatusCode != http.StatusPartialContent {
+				t.Errorf("%s: want 206, got %d", tc.name, rsp.StatusCode)
+			}
+			continue
+		}
+		if rsp.Header.Get("Content-Length") != "" || rsp.Header.Get("Accept-Ranges") != "" {
+			t.Errorf("%s: want no Content-Length or Accept-Ranges", tc.name)
+		}
+		if got := rsp.Header.Get("ETag"); got != `W/"v1"` {
+			t.Errorf("%s: ETag: want weak, got %s", tc.name, got)
+		}
+		if got := rsp.Header.Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("%s: Vary: want Accept-Encoding, got %q", tc.name, got)
+		}
+		zr, err := gzip.NewReader(rsp.Body)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if b, err := io.ReadAll(zr); err != nil || string(b) != large {
+			t.Errorf("%s: body: got %d bytes, %v", tc.name, len(b), err)
+		}
+	}
+
+	// whether the response is compressed depends on Accept-Encoding even
+	// if it isn't.
+	r := httptest.NewRequest("GET", "https://foo.com/?type=text/html", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("uncompressed: Vary: want Accept-Encoding, got %q", got)
+	}
+	if w.Body.String() != large {
+		t.Errorf("uncompressed: want unchanged body, got %d bytes", w.Body.Len())
+	}
+
+	// responses to HEAD requests have the same Vary header as to GET ones.
+	r = httptest.NewRequest("HEAD", "https://foo.com/?type=text/html", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("HEAD: Vary: want Accept-Encoding, got %q", got)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "" || w.Body.Len() != 0 {
+		t.Errorf("HEAD: want no Content-Encoding or body, got %q and %d bytes", got, w.Body.Len())
+	}
+
+	if _, err := newOptions(Conf{Compression: &Compression{MinSize: -1}}); err == nil {
+		t.Error("negative minSize: want error")
+	}
+}
+
+func TestNormalizeAcceptEncoding(t *testing.T) {
+	var got []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Accept-Encoding"))
+	}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{
+		"foo.com": {URL: backend.URL, NormalizeAcceptEncoding: true},
+		"bar.com": {URL: backend.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+	get := func(host string, accept ...string) {
+		r := httptest.NewRequest("GET", "https://"+host+"/", nil)
+		r.Header["Accept-Encoding"] = accept
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// the forms clients send collapse to two.
+	get("foo.com", "gzip, deflate, br")
+	get("foo.com", "br;q=1.0, gzip;q=0.8, *;q=0.1")
+	get("foo.com", "deflate", "gzip")
+	get("foo.com", "*")
+	get("foo.com")
+	get("foo.com", "br, gzip;q=0")
+	get("foo.com", "identity")
+	want := []string{"gzip", "gzip", "gzip", "gzip", "identity", "identity", "identity"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	got = nil
+	get("bar.com", "gzip, deflate, br")
+	if len(got) != 1 || got[0] != "gzip, deflate, br" {
+		t.Errorf("not normalized: want unchanged, got %q", got)
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	// text that compresses differently at different levels.
+	var b strings.Builder
+	rnd := rand.New(rand.NewSource(1))
+	words := strings.Fields("the quick brown fox jumps over a lazy dog while seven zebras quietly hum")
+	for b.Len() < 256<<10 {
+		b.WriteString(words[rnd.Intn(len(words))])
+		b.WriteString(" ")
+	}
+
+	size := func(level int) int {
+		z, err := newCompression(&Compression{Level: level})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(z.gzipBody(io.NopCloser(strings.NewReader(b.String()))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := io.ReadAll(zr); string(got) != b.String() {
+			t.Errorf("level %d: body not preserved", level)
+		}
+		return len(out)
+	}
+	fast, best := size(1), size(9)
+	if best >= fast {
+		t.Errorf("want level 9 output smaller than level 1, got %d and %d bytes", best, fast)
+	}
+	if def := size(0); def > fast || def < best {
+		t.Errorf("default level: want between %d and %d bytes, got %d", best, fast, def)
+	}
+
+	for _, level := range []int{-1, 10} {
+		if _, err := newCompression(&Compression{Level: level}); err == nil {
+			t.Errorf("level %d: want error", level)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// lifetimeConn is a connection to a destination server that is closed once
+// it is older than its maximum lifetime and no request is using it, so
+// that it isn't reused after that.
+type lifetimeConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	active  int // requests using the connection
+	expired bool
+}
+
+// limitConnLifetime returns dial with the connections it returns closed
+// once they are older than lifetime and idle. Requests must be sent with a
+// connLifetimeTracker to tell when a connection is idle.
+func limitConnLifetime(dial func(ctx context.Context, network, addr string) (net.Conn, error), lifetime time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c := &lifetimeConn{Conn: conn}
+		time.AfterFunc(lifetime, c.expire)
+		return c, nil
+	}
+}
+
+func (c *lifetimeConn) expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expired = true
+	if c.active == 0 {
+		c.Conn.Close()
+	}
+}
+
+func (c *lifetimeConn) acquire() {
+	c.mu.Lock()
+	c.active++
+	c.mu.Unlock()
+}
+
+func (c *lifetimeConn) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active--
+	if c.active == 0 && c.expired {
+		c.Conn.Close()
+	}
+}
+
+// asLifetimeConn returns the lifetimeConn that conn is, or that a TLS
+// connection conn is over, if any.
+func asLifetimeConn(conn net.Conn) *lifetimeConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	c, _ := conn.(*lifetimeConn)
+	return c
+}
+
+// connLifetimeTracker records which lifetimeConns are in use by requests,
+// from when the transport gets one for a request until the response body
+// is closed.
+type connLifetimeTracker struct {
+	transport http.RoundTripper
+}
+
+func (t *connLifetimeTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn *lifetimeConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			// the transport may retry the request on another
+			// connection.
+			if conn != nil {
+				conn.release()
+			}
+			conn = asLifetimeConn(info.Conn)
+			if conn != nil {
+				conn.acquire()
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	rsp, err := t.transport.RoundTrip(req)
+	if conn == nil {
+		return rsp, err
+	}
+	if err != nil {
+		conn.release()
+		return rsp, err
+	}
+	if rsp.StatusCode == http.StatusSwitchingProtocols {
+		// the connection now belongs to the upgraded protocol, and
+		// is never reused.
+		return rsp, nil
+	}
+	rsp.Body = &releasingBody{ReadCloser: rsp.Body, release: conn.release}
+	return rsp, nil
+}
+
+func (t *connLifetimeTracker) CloseIdleConnections() {
+	if c, ok := t.transport.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// releasingBody calls release once when it is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
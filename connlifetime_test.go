@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnMaxLifetime(t *testing.T) {
+	var conns atomic.Int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d, err := time.ParseDuration(r.URL.Query().Get("sleep")); err == nil {
+			time.Sleep(d)
+		}
+		io.WriteString(w, "ok")
+	}))
+	backend.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	for _, tc := range []struct {
+		lifetime Duration
+		want     int64
+	}{
+		{0, 1},
+		// the long request's connection expires while it is in
+		// use, and so does the next one while idle.
+		{Duration(50 * time.Millisecond), 3},
+	} {
+		conns.Store(0)
+		routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, ConnMaxLifetime: tc.lifetime}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := httpsHandler(newRouteTable(routes), options{})
+		get := func(query string) int {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/?"+query, nil))
+			return w.Code
+		}
+
+		// a request that outlives the connection's lifetime isn't cut off.
+		if code := get("sleep=100ms"); code != 200 {
+			t.Errorf("lifetime %s: long request: want 200, got %d", time.Duration(tc.lifetime), code)
+		}
+		get("")
+		time.Sleep(100 * time.Millisecond)
+		get("")
+		if n := conns.Load(); n != tc.want {
+			t.Errorf("lifetime %s: want %d connections, got %d", time.Duration(tc.lifetime), tc.want, n)
+		}
+	}
+}
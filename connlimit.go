@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+type connRequestsKey struct{}
+
+// limitConnRequests makes s close HTTP/1.x client connections after they
+// have served max requests, by setting "Connection: close" on the last
+// response. HTTP/2 connections aren't limited.
+func limitConnRequests(s *http.Server, max int) {
+	connContext := s.ConnContext
+	s.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		return context.WithValue(ctx, connRequestsKey{}, new(atomic.Int64))
+	}
+
+	h := s.Handler
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n, ok := r.Context().Value(connRequestsKey{}).(*atomic.Int64); ok && r.ProtoMajor == 1 {
+			if n.Add(1) >= int64(max) {
+				w.Header().Set("Connection", "close")
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLimitConnRequests(t *testing.T) {
+	const max = 3
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	limitConnRequests(ts.Config, max)
+	ts.Start()
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	for i := 1; i <= max+1; i++ {
+		if _, err := fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: foo.com\r\n\r\n"); err != nil {
+			if i == max+1 {
+				break // closed by the server
+			}
+			t.Fatalf("request %d: %s", i, err)
+		}
+		rsp, err := http.ReadResponse(br, nil)
+		if i == max+1 {
+			if err == nil {
+				t.Errorf("request %d: want connection closed, got response %s", i, rsp.Status)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("request %d: %s", i, err)
+		}
+		rsp.Body.Close()
+		if wantClose := i == max; rsp.Close != wantClose {
+			t.Errorf("request %d: close: want %t, got %t", i, wantClose, rsp.Close)
+		}
+	}
+}
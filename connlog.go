@@ -0,0 +1,23 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptrace"
+)
+
+// traceConnReuse returns req with a trace that logs whether the request to
+// the destination server reused an idle connection.
+func traceConnReuse(req *http.Request) *http.Request {
+	host, path := req.Host, req.URL.Path
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				log.Printf("upstream connection for %s%s: reused %s, idle %s", host, path, info.Conn.RemoteAddr(), info.IdleTime)
+				return
+			}
+			log.Printf("upstream connection for %s%s: new %s", host, path, info.Conn.RemoteAddr())
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogUpstreamConns(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := captureLog(t)
+	h := httpsHandler(newRouteTable(routes), options{logConns: true})
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/a", nil))
+		if w.Code != 200 {
+			t.Fatalf("status code: want 200, got %d", w.Code)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 log lines, got %q", lines)
+	}
+	addr := backend.Listener.Addr().String()
+	if want := "upstream connection for foo.com/a: new " + addr; !strings.HasSuffix(lines[0], want) {
+		t.Errorf("first request: want %q, got %q", want, lines[0])
+	}
+	if want := "upstream connection for foo.com/a: reused " + addr; !strings.Contains(lines[1], want) {
+		t.Errorf("second request: want %q, got %q", want, lines[1])
+	}
+}
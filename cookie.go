@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// cookieRewrite rewrites the Domain and Path attributes of Set-Cookie
+// headers from the destination server, so that cookies scoped to the
+// destination server apply to the public host.
+type cookieRewrite struct {
+	domain bool // replace Domain with the public host
+	paths  []pathRewrite
+}
+
+// pathRewrite replaces the prefix from of a cookie's Path with to.
+type pathRewrite struct {
+	from, to string
+}
+
+func newCookieRewrite(domain bool, paths map[string]string) *cookieRewrite {
+	if !domain && len(paths) == 0 {
+		return nil
+	}
+	c := &cookieRewrite{domain: domain}
+	for from, to := range paths {
+		c.paths = append(c.paths, pathRewrite{from, to})
+	}
+	// longest prefix first.
+	sort.Slice(c.paths, func(i, j int) bool {
+		if len(c.paths[i].from) != len(c.paths[j].from) {
+			return len(c.paths[i].from) > len(c.paths[j].from)
+		}
+		return c.paths[i].from < c.paths[j].from
+	})
+	return c
+}
+
+// apply rewrites each Set-Cookie header in h for the public host.
+func (c *cookieRewrite) apply(h http.Header, host string) {
+	cookies := h["Set-Cookie"]
+	for i, v := range cookies {
+		cookies[i] = c.rewrite(v, host)
+	}
+}
+
+// rewrite returns the Set-Cookie header value v with its attributes
+// rewritten. Other attributes are kept as is.
+func (c *cookieRewrite) rewrite(v, host string) string {
+	parts := strings.Split(v, ";")
+	for i := 1; i < len(parts); i++ {
+		name, value, _ := strings.Cut(parts[i], "=")
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+		switch {
+		case c.domain && strings.EqualFold(name, "Domain"):
+			parts[i] = " Domain=" + host
+		case strings.EqualFold(name, "Path"):
+			for _, p := range c.paths {
+				if strings.HasPrefix(value, p.from) {
+					rest := strings.TrimPrefix(value, p.from)
+					if strings.HasSuffix(p.to, "/") {
+						rest = strings.TrimPrefix(rest, "/")
+					}
+					parts[i] = " Path=" + p.to + rest
+					break
+				}
+			}
+		}
+	}
+	return strings.Join(parts, ";")
+}
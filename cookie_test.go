@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRewriteCookies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Domain=localhost; Path=/app/admin; HttpOnly")
+		w.Header().Add("Set-Cookie", "theme=dark; path=/app; domain=.localhost; SameSite=Lax")
+		w.Header().Add("Set-Cookie", "lang=en; Path=/app/settings")
+		w.Header().Add("Set-Cookie", "plain=1")
+	}))
+	defer backend.Close()
+
+	testcases := []struct {
+		name     string
+		upstream Upstream
+		want     []string
+	}{
+		{
+			"off",
+			Upstream{URL: backend.URL},
+			[]string{
+				"session=abc; Domain=localhost; Path=/app/admin; HttpOnly",
+				"theme=dark; path=/app; domain=.localhost; SameSite=Lax",
+				"lang=en; Path=/app/settings",
+				"plain=1",
+			},
+		},
+		{
+			"domain",
+			Upstream{URL: backend.URL, RewriteCookieDomain: true},
+			[]string{
+				"session=abc; Domain=foo.com; Path=/app/admin; HttpOnly",
+				"theme=dark; path=/app; Domain=foo.com; SameSite=Lax",
+				"lang=en; Path=/app/settings",
+				"plain=1",
+			},
+		},
+		{
+			"domain and path",
+			Upstream{
+				URL:                 backend.URL,
+				RewriteCookieDomain: true,
+				RewriteCookiePath:   map[string]string{"/app": "/", "/app/admin": "/admin"},
+			},
+			[]string{
+				"session=abc; Domain=foo.com; Path=/admin; HttpOnly",
+				"theme=dark; Path=/; Domain=foo.com; SameSite=Lax",
+				"lang=en; Path=/settings",
+				"plain=1",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			routes, err := newRoutes(map[string]Upstream{"foo.com": tc.upstream})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+			if got := w.Header().Values("Set-Cookie"); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Set-Cookie:\nwant %q\ngot  %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxDecompressedBody limits the size of a decompressed request body for
+// routes without maxBodyBytes, so that a small gzip bomb doesn't become an
+// unbounded stream to the destination server.
+const maxDecompressedBody = 64 << 20
+
+// decompressRequest replaces a gzip-encoded request body with the
+// decompressed body, which fails with an *http.MaxBytesError once it is
+// longer than max bytes. Bodies with other, or multiple, encodings are left
+// as is.
+func decompressRequest(req *http.Request, max int64) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	if !strings.EqualFold(strings.TrimSpace(req.Header.Get("Content-Encoding")), "gzip") {
+		return
+	}
+	req.Body = &gzipBody{body: req.Body, max: max}
+	req.ContentLength = -1
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+}
+
+// gzipBody is a request body that decompresses the underlying gzip-encoded
+// body. The gzip reader is created on the first Read, so that an invalid
+// gzip header is reported while the request is being sent.
+type gzipBody struct {
+	body io.ReadCloser
+	max  int64
+	n    int64 // decompressed bytes read
+	zr   *gzip.Reader
+	err  error
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.zr == nil && b.err == nil {
+		b.zr, b.err = gzip.NewReader(b.body)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	// read at most one byte past the limit to detect that it is exceeded.
+	if rem := b.max - b.n + 1; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+	n, err := b.zr.Read(p)
+	if b.n+int64(n) > b.max {
+		n = int(b.max - b.n)
+		b.n = b.max
+		b.err = &http.MaxBytesError{Limit: b.max}
+		return n, b.err
+	}
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *gzipBody) Close() error {
+	return b.body.Close()
+}
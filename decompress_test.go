@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecompressRequest(t *testing.T) {
+	type received struct {
+		body            string
+		contentEncoding string
+	}
+	got := make(chan received, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got <- received{string(b), r.Header.Get("Content-Encoding")}
+	}))
+	defer backend.Close()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"hello": "world"}`))
+	zw.Close()
+	gzipped := buf.String()
+
+	testcases := []struct {
+		decompress bool
+		want       received
+	}{
+		{true, received{`{"hello": "world"}`, ""}},
+		{false, received{gzipped, "gzip"}},
+	}
+	for _, tc := range testcases {
+		routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, DecompressRequest: tc.decompress}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "https://foo.com/", bytes.NewReader([]byte(gzipped)))
+		r.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Errorf("decompress %t: status code: want 200, got %d", tc.decompress, w.Code)
+			continue
+		}
+		if g := <-got; g != tc.want {
+			t.Errorf("decompress %t: want %+v, got %+v", tc.decompress, tc.want, g)
+		}
+	}
+}
+
+func TestDecompressRequestLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			return
+		}
+	}))
+	defer backend.Close()
+
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+	schema := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(schema, []byte(`{"type": "object", "required": ["hello"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		upstream Upstream
+		body     []byte
+		want     int
+	}{
+		{"limit", Upstream{MaxBodyBytes: 1000}, make([]byte, 1001), 413},
+		{"within limit", Upstream{MaxBodyBytes: 1000}, make([]byte, 1000), 200},
+		{"default limit", Upstream{}, make([]byte, maxDecompressedBody+1), 413},
+		{"schema", Upstream{JSONSchema: schema}, []byte(`{"hello": "world"}`), 200},
+		{"schema invalid", Upstream{JSONSchema: schema}, []byte(`{}`), 422},
+	} {
+		tc.upstream.URL = backend.URL
+		tc.upstream.DecompressRequest = true
+		routes, err := newRoutes(map[string]Upstream{"foo.com": tc.upstream})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "https://foo.com/", bytes.NewReader(gzipped(tc.body)))
+		r.Header.Set("Content-Encoding", "gzip")
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status code: want %d, got %d", tc.name, tc.want, w.Code)
+		}
+	}
+}
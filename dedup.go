@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// Dedup drops duplicate requests, such as webhook deliveries that are
+// retried, identified by a header.
+type Dedup struct {
+	// Header is the name of the request header with the ID of the
+	// request, such as X-Delivery-Id. Requests without it are not
+	// deduplicated.
+	Header string `json:"header"`
+	// Window is how long the ID of a request that got a 2xx response is
+	// remembered.
+	Window Duration `json:"window"`
+	// Mode is "drop" to respond to duplicates with an empty 200, or
+	// "replay" to respond with the response to the first request. The
+	// empty string is the same as "drop".
+	Mode string `json:"mode"`
+	// MaxEntries is the number of request IDs remembered within the
+	// window, beyond which the oldest are forgotten early. Zero means
+	// 10000.
+	MaxEntries int `json:"maxEntries"`
+}
+
+// maxReplayBody is the largest response body kept for replay. Duplicates
+// of requests with larger responses get an empty 200.
+const maxReplayBody = 1 << 20
+
+const defaultDedupMaxEntries = 10000
+
+// dedup is the ready-to-use form of a Dedup.
+type dedup struct {
+	header     string
+	window     time.Duration
+	replay     bool
+	maxEntries int // of expiry
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+	expiry  list.List // of *dedupEntry that succeeded, oldest first
+}
+
+// dedupEntry is the state of the first request with an ID.
+type dedupEntry struct {
+	key  string
+	done chan struct{} // closed once the response is known
+
+	// set before done is closed
+	ok      bool // the response was 2xx
+	expires time.Time
+	replay  bool // the response is kept for replay
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+func newDedup(c *Dedup) (*dedup, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if !httpguts.ValidHeaderFieldName(c.Header) {
+		return nil, fmt.Errorf("bad dedup.header %q", c.Header)
+	}
+	if c.Window <= 0 {
+		return nil, errors.New("require positive dedup.window")
+	}
+	if c.MaxEntries < 0 {
+		return nil, errors.New("dedup.maxEntries must not be negative")
+	}
+	d := &dedup{
+		header:     http.CanonicalHeaderKey(c.Header),
+		window:     time.Duration(c.Window),
+		maxEntries: c.MaxEntries,
+		entries:    make(map[string]*dedupEntry),
+	}
+	if d.maxEntries == 0 {
+		d.maxEntries = defaultDedupMaxEntries
+	}
+	switch c.Mode {
+	case "", "drop":
+	case "replay":
+		d.replay = true
+	default:
+		return nil, fmt.Errorf("unknown dedup.mode %q", c.Mode)
+	}
+	return d, nil
+}
+
+// begin returns the entry for key and whether the request is the first
+// with it, in which case finish must be called with its response.
+func (d *dedup) begin(key string, now time.Time) (*dedupEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for e := d.expiry.Front(); e != nil && !now.Before(e.Value.(*dedupEntry).expires); e = d.expiry.Front() {
+		d.expiry.Remove(e)
+		delete(d.entries, e.Value.(*dedupEntry).key)
+	}
+	if e, ok := d.entries[key]; ok {
+		return e, false
+	}
+	e := &dedupEntry{key: key, done: make(chan struct{})}
+	d.entries[key] = e
+	return e, true
+}
+
+// finish records the response to the first request with e's key. The key
+// is forgotten unless the response is 2xx and the handler returned, rather
+// than panicked, such as on a response cut short, so that a retry is let
+// through. Beyond maxEntries remembered keys, the oldest are forgotten.
+func (d *dedup) finish(e *dedupEntry, w *dedupWriter, returned bool, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// a status of zero means the request was aborted.
+	if status := w.status; status/100 == 2 && returned {
+		e.ok = true
+		e.expires = now.Add(d.window)
+		if d.replay && !w.overflow {
+			e.replay = true
+			e.status = w.status
+			e.header = w.header
+			e.body = w.body.Bytes()
+		}
+		d.expiry.PushBack(e)
+		for d.expiry.Len() > d.maxEntries {
+			delete(d.entries, d.expiry.Remove(d.expiry.Front()).(*dedupEntry).key)
+		}
+	} else {
+		delete(d.entries, e.key)
+	}
+	close(e.done)
+}
+
+// serve serves the request with h unless it is a duplicate.
+func (d *dedup) serve(w http.ResponseWriter, r *http.Request, h http.Handler, o options) {
+	key := r.Header.Get(d.header)
+	if key == "" {
+		h.ServeHTTP(w, r)
+		return
+	}
+	for {
+		e, first := d.begin(key, time.Now())
+		if first {
+			dw := &dedupWriter{ResponseWriter: w, keep: d.replay}
+			returned := false
+			defer func() { d.finish(e, dw, returned, time.Now()) }()
+			h.ServeHTTP(dw, r)
+			returned = true
+			return
+		}
+		select {
+		case <-e.done:
+		case <-r.Context().Done():
+			return
+		}
+		if e.ok {
+			e.serveDuplicate(w, r, o)
+			return
+		}
+		// the first request failed; this one may take its place.
+	}
+}
+
+// serveDuplicate responds to a duplicate of the first request with e's key.
+// A replayed response has the duplicate's request ID, if any, rather than
+// the first request's.
+func (e *dedupEntry) serveDuplicate(w http.ResponseWriter, r *http.Request, o options) {
+	if !e.replay {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = v
+	}
+	if o.requestIDHeader != "" {
+		h.Del(o.requestIDHeader)
+		o.echoRequestID(h, r.Context())
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// dedupWriter records the status code of a response and, if keep is true,
+// its header and body for replay.
+type dedupWriter struct {
+	http.ResponseWriter
+	keep bool
+
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool // body too large to keep
+}
+
+func (w *dedupWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+		if w.keep {
+			w.header = w.ResponseWriter.Header().Clone()
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *dedupWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.keep && !w.overflow {
+		if w.body.Len()+len(p) > maxReplayBody {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *dedupWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap supports http.ResponseController.
+func (w *dedupWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
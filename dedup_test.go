@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	var deliveries atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := deliveries.Add(1)
+		if r.Header.Get("Fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		time.Sleep(10 * time.Millisecond) // let concurrent duplicates arrive
+		w.Header().Set("Delivery", fmt.Sprint(n))
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "delivery %d", n)
+	}))
+	defer backend.Close()
+
+	for _, mode := range []string{"drop", "replay"} {
+		t.Run(mode, func(t *testing.T) {
+			deliveries.Store(0)
+			routes, err := newRoutes(map[string]Upstream{
+				"hooks.foo.com": {URL: backend.URL, Dedup: &Dedup{Header: "x-delivery-id", Window: Duration(time.Minute), Mode: mode}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := httpsHandler(newRouteTable(routes), options{})
+			deliver := func(id string, fail bool) *httptest.ResponseRecorder {
+				r := httptest.NewRequest("POST", "https://hooks.foo.com/", strings.NewReader("{}"))
+				if id != "" {
+					r.Header.Set("X-Delivery-Id", id)
+				}
+				if fail {
+					r.Header.Set("Fail", "1")
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				return w
+			}
+
+			// concurrent duplicates.
+			var wg sync.WaitGroup
+			rsps := make([]*httptest.ResponseRecorder, 3)
+			for i := range rsps {
+				i := i
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rsps[i] = deliver("a", false)
+				}()
+			}
+			wg.Wait()
+			if n := deliveries.Load(); n != 1 {
+				t.Errorf("concurrent duplicates: want 1 delivery, got %d", n)
+			}
+			var firsts int
+			for _, w := range rsps {
+				if w.Code == http.StatusAccepted && w.Body.String() == "delivery 1" {
+					firsts++
+					continue
+				}
+				switch mode {
+				case "drop":
+					if w.Code != 200 || w.Body.Len() != 0 {
+						t.Errorf("duplicate: want empty 200, got %d %q", w.Code, w.Body.String())
+					}
+				case "replay":
+					t.Errorf("duplicate: want replayed response, got %d %q", w.Code, w.Body.String())
+				}
+			}
+			if mode == "drop" && firsts != 1 || mode == "replay" && firsts != 3 {
+				t.Errorf("got %d first responses", firsts)
+			}
+			if w := deliver("a", false); mode == "replay" && w.Header().Get("Delivery") != "1" {
+				t.Errorf("replayed header: want 1, got %q", w.Header().Get("Delivery"))
+			}
+
+			// a failed delivery isn't remembered.
+			deliveries.Store(0)
+			if w := deliver("b", true); w.Code != 500 {
+				t.Errorf("failed delivery: want 500, got %d", w.Code)
+			}
+			if w := deliver("b", false); w.Code != http.StatusAccepted {
+				t.Errorf("retried delivery: want 202, got %d", w.Code)
+			}
+			// requests without the header aren't deduplicated.
+			deliver("", false)
+			deliver("", false)
+			if n := deliveries.Load(); n != 4 {
+				t.Errorf("want 4 deliveries, got %d", n)
+			}
+		})
+	}
+}
+
+func TestDedupExpiry(t *testing.T) {
+	d, err := newDedup(&Dedup{Header: "X-Id", Window: Duration(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	e, first := d.begin("a", now)
+	if !first {
+		t.Fatal("want first")
+	}
+	d.finish(e, &dedupWriter{status: 200}, true, now)
+	if _, first := d.begin("a", now.Add(59*time.Second)); first {
+		t.Error("within window: want duplicate")
+	}
+	if _, first := d.begin("b", now.Add(time.Minute)); !first || len(d.entries) != 1 {
+		t.Errorf("after window: want a forgotten, got %d entries", len(d.entries))
+	}
+
+	// beyond maxEntries, the oldest IDs are forgotten.
+	d, err = newDedup(&Dedup{Header: "X-Id", Window: Duration(time.Minute), MaxEntries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		e, _ := d.begin(k, now)
+		d.finish(e, &dedupWriter{status: 200}, true, now)
+	}
+	if len(d.entries) != 2 || d.expiry.Len() != 2 {
+		t.Errorf("want 2 entries, got %d", len(d.entries))
+	}
+	if _, first := d.begin("a", now); !first {
+		t.Error("oldest: want forgotten")
+	}
+	if _, first := d.begin("c", now); first {
+		t.Error("newest: want duplicate")
+	}
+
+	for _, c := range []Dedup{
+		{Header: "X-Id"},
+		{Window: Duration(time.Second)},
+		{Header: "X-Id", Window: Duration(time.Second), Mode: "other"},
+		{Header: "X-Id", Window: Duration(time.Second), MaxEntries: -1},
+	} {
+		if _, err := newDedup(&c); err == nil {
+			t.Errorf("%+v: want error", c)
+		}
+	}
+}
+
+func TestDedupReplayRequestID(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{
+		"hooks.foo.com": {URL: backend.URL, Dedup: &Dedup{Header: "X-Delivery-Id", Window: Duration(time.Minute), Mode: "replay"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := newOptions(Conf{RequestIDHeader: "X-Request-Id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), o)
+	for _, id := range []string{"first", "second"} {
+		r := httptest.NewRequest("POST", "https://hooks.foo.com/", strings.NewReader("{}"))
+		r.Header.Set("X-Delivery-Id", "a")
+		r.Header.Set("X-Request-Id", id)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Body.String() != "ok" {
+			t.Errorf("%s: unexpected response %d %q", id, w.Code, w.Body.String())
+		}
+		if got := w.Header().Values("X-Request-Id"); len(got) != 1 || got[0] != id {
+			t.Errorf("%s: want request ID %q, got %q", id, id, got)
+		}
+	}
+}
+
+func TestDedupPanic(t *testing.T) {
+	d, err := newDedup(&Dedup{Header: "X-Id", Window: Duration(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(h http.HandlerFunc) (panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		r := httptest.NewRequest("POST", "/", nil)
+		r.Header.Set("X-Id", "a")
+		d.serve(httptest.NewRecorder(), r, h, options{})
+		return false
+	}
+
+	// such as a response body cut short after a 200.
+	if !serve(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic(http.ErrAbortHandler)
+	}) {
+		t.Fatal("want panic")
+	}
+	var served bool
+	serve(func(w http.ResponseWriter, r *http.Request) { served = true })
+	if !served {
+		t.Error("after panic: want the retry served")
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DNSProvider configures the DNS provider used to obtain wildcard
+// certificates with the ACME DNS-01 challenge.
+type DNSProvider struct {
+	// Name is the name of the provider. Only "cloudflare" is supported.
+	Name string `json:"name"`
+	// TokenEnv is the name of the environment variable with the
+	// provider's API token. The empty string means CLOUDFLARE_API_TOKEN.
+	TokenEnv string `json:"tokenEnv"`
+	// PropagationDelay is how long to wait after creating a challenge
+	// record before asking the ACME server to check it. Zero means 30s.
+	PropagationDelay Duration `json:"propagationDelay"`
+}
+
+const (
+	defaultDNSTokenEnv         = "CLOUDFLARE_API_TOKEN"
+	defaultDNSPropagationDelay = 30 * time.Second
+	dnsCleanUpTimeout          = time.Minute // to remove a challenge record
+)
+
+// dnsProvider creates and removes the TXT records of DNS-01 challenges.
+type dnsProvider interface {
+	present(ctx context.Context, fqdn, value string) error
+	cleanUp(ctx context.Context, fqdn, value string) error
+}
+
+func newDNSProvider(c *DNSProvider) (dnsProvider, error) {
+	if c.PropagationDelay < 0 {
+		return nil, errors.New("certs.dnsProvider.propagationDelay must not be negative")
+	}
+	env := c.TokenEnv
+	if env == "" {
+		env = defaultDNSTokenEnv
+	}
+	switch c.Name {
+	case "cloudflare":
+		token := os.Getenv(env)
+		if token == "" {
+			return nil, fmt.Errorf("require the API token for certs.dnsProvider in $%s", env)
+		}
+		return newCloudflareDNS(token), nil
+	default:
+		return nil, fmt.Errorf("unknown certs.dnsProvider.name %q", c.Name)
+	}
+}
+
+// isWildcard reports whether domain is a wildcard domain, such as
+// "*.example.com".
+func isWildcard(domain string) bool {
+	return strings.HasPrefix(domain, "*.")
+}
+
+// checkWildcard returns an error if domain isn't a valid wildcard domain:
+// "*." followed by a domain with at least two labels and no wildcards.
+func checkWildcard(domain string) error {
+	base := strings.TrimPrefix(domain, "*.")
+	if base == domain || strings.Contains(base, "*") || !strings.Contains(base, ".") ||
+		strings.HasPrefix(base, ".") || strings.HasSuffix(base, ".") || strings.Contains(base, "..") {
+		return fmt.Errorf("bad wildcard domain %q; want the form *.example.com", domain)
+	}
+	return nil
+}
+
+// wildcardCovers reports whether the wildcard domain covers host, which
+// must be exactly one label under the wildcard's base domain.
+func wildcardCovers(wildcard, host string) bool {
+	base := strings.TrimPrefix(wildcard, "*")
+	label, ok := cutSuffixFold(host, base)
+	return ok && label != "" && !strings.Contains(label, ".")
+}
+
+func cutSuffixFold(s, suffix string) (string, bool) {
+	if len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix) {
+		return s[:len(s)-len(suffix)], true
+	}
+	return s, false
+}
+
+// wildcardCerts obtains and renews certificates for wildcard domains with
+// the DNS-01 challenge, which autocert doesn't support. Certificates are
+// stored in the certificate directory like autocert stores its own, under
+// the wildcard domain.
+type wildcardCerts struct {
+	domains  []string // wildcard domains
+	explicit map[string]bool
+	cache    autocert.DirCache
+	maxAge   time.Duration // zero means certificates are only renewed before expiry
+
+	// obtain obtains a certificate for a wildcard domain and stores it in
+	// the cache.
+	obtain func(ctx context.Context, domain string) (*tls.Certificate, error)
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate // by wildcard domain
+}
+
+// newWildcardCerts returns the wildcardCerts for the wildcard domains in
+// domains. The other domains are explicit; their certificates come from
+// autocert even if a wildcard domain covers them.
+func newWildcardCerts(domains []string, dir string, maxAge time.Duration) *wildcardCerts {
+	w := &wildcardCerts{
+		explicit: make(map[string]bool),
+		cache:    autocert.DirCache(dir),
+		maxAge:   maxAge,
+		certs:    make(map[string]*tls.Certificate),
+	}
+	for _, d := range domains {
+		if isWildcard(d) {
+			w.domains = append(w.domains, strings.ToLower(d))
+		} else {
+			w.explicit[certHost(d)] = true
+		}
+	}
+	return w
+}
+
+// covering returns the wildcard domain that covers host, if any.
+func (w *wildcardCerts) covering(host string) (string, bool) {
+	host = certHost(host)
+	if w.explicit[host] {
+		return "", false
+	}
+	for _, d := range w.domains {
+		if wildcardCovers(d, host) {
+			return d, true
+		}
+	}
+	return "", false
+}
+
+// GetCertificate returns the certificate of the wildcard domain that covers
+// the requested server name.
+func (w *wildcardCerts) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	d, ok := w.covering(hello.ServerName)
+	if !ok {
+		return nil, fmt.Errorf("no wildcard domain covers %q", hello.ServerName)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if c := w.certs[d]; c != nil {
+		return c, nil
+	}
+	return nil, fmt.Errorf("certificate for %s not obtained yet", d)
+}
+
+// ready reports whether there is a certificate for host, which a wildcard
+// domain must cover.
+func (w *wildcardCerts) ready(host string) bool {
+	d, _ := w.covering(host)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.certs[d] != nil
+}
+
+// load loads the cached certificates.
+func (w *wildcardCerts) load(ctx context.Context) {
+	for _, d := range w.domains {
+		b, err := w.cache.Get(ctx, d)
+		if err == autocert.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			log.Printf("load certificate %s: %s", d, err)
+			continue
+		}
+		c, err := parseCachedCert(b)
+		if err != nil {
+			log.Printf("load certificate %s: %s", d, err)
+			continue
+		}
+		w.mu.Lock()
+		w.certs[d] = c
+		w.mu.Unlock()
+	}
+}
+
+// parseCachedCert parses a certificate in the form autocert caches it: the
+// private key followed by the chain.
+func parseCachedCert(b []byte) (*tls.Certificate, error) {
+	c, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return nil, err
+	}
+	c.Leaf, err = x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// due reports whether the certificate for domain is missing, or is at now
+// due for renewal before expiry or because it is maxAge old.
+func (w *wildcardCerts) due(domain string, now time.Time) bool {
+	w.mu.Lock()
+	c := w.certs[domain]
+	w.mu.Unlock()
+	if c == nil {
+		return true
+	}
+	if !now.Before(c.Leaf.NotAfter.Add(-renewBefore)) {
+		return true
+	}
+	return w.maxAge > 0 && now.Sub(c.Leaf.NotBefore) >= w.maxAge
+}
+
+// renew obtains the certificates that are due at now.
+func (w *wildcardCerts) renew(ctx context.Context, now time.Time) {
+	for _, d := range w.domains {
+		if !w.due(d, now) {
+			continue
+		}
+		log.Printf("obtaining certificate %s with DNS-01", d)
+		c, err := w.obtain(ctx, d)
+		if err != nil {
+			log.Printf("obtain certificate %s: %s", d, err)
+			continue
+		}
+		w.mu.Lock()
+		w.certs[d] = c
+		w.mu.Unlock()
+	}
+}
+
+// run loads the cached certificates, then obtains those that are due every
+// certRotationCheckInterval until ctx is done.
+func (w *wildcardCerts) run(ctx context.Context) {
+	w.load(ctx)
+	t := time.NewTicker(certRotationCheckInterval)
+	defer t.Stop()
+	for {
+		w.renew(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// dns01Issuer obtains certificates from an ACME server with the DNS-01
+// challenge, using the ACME account of autocert in the same cache.
+type dns01Issuer struct {
+	directoryURL string
+	email        string
+	cache        autocert.DirCache
+	provider     dnsProvider
+	delay        time.Duration // for the challenge records to propagate
+}
+
+// newDNS01Issuer returns the issuer for c, which must be valid and have a
+// DNSProvider.
+func newDNS01Issuer(c Certs) (*dns01Issuer, error) {
+	provider, err := newDNSProvider(c.DNSProvider)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := acmeDirectoryURL(c.ACMEDirectory)
+	if err != nil {
+		return nil, err
+	}
+	delay := time.Duration(c.DNSProvider.PropagationDelay)
+	if delay == 0 {
+		delay = defaultDNSPropagationDelay
+	}
+	return &dns01Issuer{
+		directoryURL: dir,
+		email:        c.ACMEEmail,
+		cache:        autocert.DirCache(c.CertDir),
+		provider:     provider,
+		delay:        delay,
+	}, nil
+}
+
+// obtain obtains a certificate for domain and stores it in the cache.
+func (iss *dns01Issuer) obtain(ctx context.Context, domain string) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	client, err := iss.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range order.AuthzURLs {
+		if err := iss.authorize(ctx, client, u); err != nil {
+			return nil, err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, der := range chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	if err := iss.cache.Put(ctx, domain, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return parseCachedCert(buf.Bytes())
+}
+
+// authorize completes the DNS-01 challenge of the authorization at url, if
+// it isn't valid already.
+func (iss *dns01Issuer) authorize(ctx context.Context, client *acme.Client, url string) error {
+	z, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no dns-01 challenge for %s", z.Identifier.Value)
+	}
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+
+	// the identifier of a wildcard domain is its base domain.
+	fqdn := "_acme-challenge." + z.Identifier.Value
+	if err := iss.provider.present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("create challenge record %s: %s", fqdn, err)
+	}
+	defer func() {
+		// ctx may be done already.
+		ctx, cancel := context.WithTimeout(context.Background(), dnsCleanUpTimeout)
+		defer cancel()
+		if err := iss.provider.cleanUp(ctx, fqdn, value); err != nil {
+			log.Printf("remove challenge record %s: %s", fqdn, err)
+		}
+	}()
+
+	t := time.NewTimer(iss.delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+	}
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// client returns an ACME client with the account key that autocert keeps
+// in the cache, creating the key and registering the account if needed.
+func (iss *dns01Issuer) client(ctx context.Context) (*acme.Client, error) {
+	key, err := iss.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: iss.directoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+	acct := &acme.Account{}
+	if iss.email != "" {
+		acct.Contact = []string{"mailto:" + iss.email}
+	}
+	if _, err := client.Register(ctx, acct, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, err
+	}
+	return client, nil
+}
+
+// accountKeyName is the cache key of autocert's ACME account key.
+const accountKeyName = "acme_account+key"
+
+func (iss *dns01Issuer) accountKey(ctx context.Context) (crypto.Signer, error) {
+	b, err := iss.cache.Get(ctx, accountKeyName)
+	if err == autocert.ErrCacheMiss {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := iss.cache.Put(ctx, accountKeyName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p, _ := pem.Decode(b)
+	if p == nil {
+		return nil, errors.New("bad account key in cache")
+	}
+	if key, err := x509.ParseECPrivateKey(p.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(p.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(p.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse account key: %s", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("bad account key in cache")
+	}
+	return signer, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWildcardConf(t *testing.T) {
+	t.Setenv("CLOUDFLARE_API_TOKEN", "token")
+	conf := func(domains []string, p *DNSProvider) Conf {
+		return Conf{Domains: domains, Certs: Certs{Auto: true, CertDir: t.TempDir(), DNSProvider: p}}
+	}
+	cf := &DNSProvider{Name: "cloudflare"}
+
+	if err := checkConf(conf([]string{"*.example.com", "example.com"}, cf)); err != nil {
+		t.Errorf("want ok, got %s", err)
+	}
+	for _, c := range []Conf{
+		conf([]string{"*.example.com"}, nil),
+		conf([]string{"*.com"}, cf),
+		conf([]string{"a.*.example.com"}, cf),
+		conf([]string{"*.*.example.com"}, cf),
+		conf([]string{"*example.com"}, cf),
+		conf(nil, &DNSProvider{Name: "route53"}),
+		conf(nil, &DNSProvider{Name: "cloudflare", TokenEnv: "NO_SUCH_TOKEN_ENV"}),
+		conf(nil, &DNSProvider{Name: "cloudflare", PropagationDelay: -1}),
+		{Certs: Certs{CertFile: "a", KeyFile: "b", DNSProvider: cf}},
+	} {
+		if err := checkConf(c); err == nil {
+			t.Errorf("%v, %+v: want error", c.Domains, c.Certs.DNSProvider)
+		}
+	}
+
+	// autocert doesn't obtain certificates for wildcard domains.
+	if got := whitelistDomains([]string{"*.example.com", "example.com"}, true); !reflect.DeepEqual(got, []string{"example.com", "www.example.com"}) {
+		t.Errorf("whitelist: got %q", got)
+	}
+}
+
+func TestWildcardCovers(t *testing.T) {
+	testcases := []struct {
+		host string
+		want bool
+	}{
+		{"a.example.com", true},
+		{"A.Example.com", true},
+		{"example.com", false},
+		{"a.b.example.com", false},
+		{"aexample.com", false},
+		{"a.example.org", false},
+	}
+	for _, tc := range testcases {
+		if got := wildcardCovers("*.example.com", tc.host); got != tc.want {
+			t.Errorf("%s: want %v, got %v", tc.host, tc.want, got)
+		}
+	}
+}
+
+func TestWildcardCerts(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	dir := t.TempDir()
+	writeCachedCert(t, dir, "*.example.com", "*.example.com", now.Add(-10*day))
+
+	w := newWildcardCerts([]string{"*.example.com", "*.example.org", "www.example.com"}, dir, 0)
+	var obtained []string
+	w.obtain = func(ctx context.Context, domain string) (*tls.Certificate, error) {
+		obtained = append(obtained, domain)
+		w.mu.Lock()
+		c := w.certs["*.example.com"] // any certificate will do
+		w.mu.Unlock()
+		return c, nil
+	}
+	w.load(context.Background())
+
+	if _, err := w.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"}); err != nil {
+		t.Errorf("a.example.com: %s", err)
+	}
+	if !w.ready("a.example.com") || w.ready("a.example.org") {
+		t.Error("want a.example.com ready and a.example.org not")
+	}
+	// explicit domains are autocert's.
+	if _, ok := w.covering("www.example.com"); ok {
+		t.Error("www.example.com: want not covered")
+	}
+
+	// only the missing certificate is obtained.
+	w.renew(context.Background(), now)
+	if !reflect.DeepEqual(obtained, []string{"*.example.org"}) {
+		t.Errorf("want *.example.org obtained, got %q", obtained)
+	}
+	if _, err := w.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.org"}); err != nil {
+		t.Errorf("a.example.org: %s", err)
+	}
+
+	// renewed before expiry, or once maxAge old.
+	obtained = nil
+	w.renew(context.Background(), now.Add(80*day-renewBefore))
+	if len(obtained) != 2 {
+		t.Errorf("near expiry: want both renewed, got %q", obtained)
+	}
+	w.maxAge = 5 * day
+	if !w.due("*.example.com", now) {
+		t.Error("maxAge: want due")
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "net/http"
+
+// earlyHintsWriter discards 103 Early Hints responses. The reverse proxy
+// sets the hint headers before writing a 1xx response and clears them
+// after, so discarding the write is enough.
+type earlyHintsWriter struct {
+	http.ResponseWriter
+}
+
+func (w *earlyHintsWriter) WriteHeader(code int) {
+	if code == http.StatusEarlyHints {
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap supports http.ResponseController.
+func (w *earlyHintsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
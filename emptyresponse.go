@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+)
+
+// isEmptyResponse reports whether err is the result of the destination
+// server closing the connection without sending a response.
+func isEmptyResponse(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// emptyResponseRetrier retries requests with idempotent methods once when
+// the destination server closes the connection without a response.
+// http.Transport already does so for requests on reused connections, but
+// not on new ones.
+type emptyResponseRetrier struct {
+	transport http.RoundTripper
+}
+
+func (t *emptyResponseRetrier) RoundTrip(req *http.Request) (*http.Response, error) {
+	rsp, err := t.transport.RoundTrip(req)
+	if err == nil || !isEmptyResponse(err) || !canFailover(req) || req.Context().Err() != nil {
+		return rsp, err
+	}
+	log.Printf("upstream closed connection without response from %s for %s%s; retrying", req.URL.Host, req.Host, req.URL.Path)
+	if req.GetBody != nil {
+		body, gerr := req.GetBody()
+		if gerr != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	return t.transport.RoundTrip(req)
+}
+
+func (t *emptyResponseRetrier) CloseIdleConnections() {
+	if c, ok := t.transport.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// closingBackend returns the address of a server that reads a request on
+// each connection and, for the first close connections, closes it without
+// a response. Later connections get a 200.
+func closingBackend(t *testing.T, close int64) (string, *atomic.Int64) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var conns atomic.Int64
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			n := conns.Add(1)
+			go func() {
+				defer c.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+					return
+				}
+				if n > close {
+					c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"))
+				}
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String(), &conns
+}
+
+func TestEmptyResponse(t *testing.T) {
+	t.Run("logged", func(t *testing.T) {
+		url, _ := closingBackend(t, 1<<30)
+		logs := captureLog(t)
+		w := httptest.NewRecorder()
+		httpsHandler(mustRoutes(map[string]string{"foo.com": url}), options{}).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("want 502, got %d", w.Code)
+		}
+		if !strings.Contains(logs.String(), "upstream closed connection without response") {
+			t.Errorf("want the closed connection logged, got %q", logs.String())
+		}
+	})
+
+	for _, tc := range []struct {
+		method string
+		close  int64
+		want   int
+		conns  int64
+	}{
+		{"GET", 1, http.StatusOK, 2},
+		{"POST", 1, http.StatusBadGateway, 1},
+		{"GET", 2, http.StatusBadGateway, 2}, // retried once only
+	} {
+		url, conns := closingBackend(t, tc.close)
+		routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: url, RetryEmptyResponse: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, httptest.NewRequest(tc.method, "https://foo.com/", nil))
+		if w.Code != tc.want || conns.Load() != tc.conns {
+			t.Errorf("%s, %d closed: want %d after %d connections, got %d after %d", tc.method, tc.close, tc.want, tc.conns, w.Code, conns.Load())
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// errorPage is the body of error responses with a status code.
+type errorPage struct {
+	body        []byte
+	contentType string
+}
+
+// readErrorPages reads the pages of Conf.ErrorPages, keyed by status code.
+// The Content-Type of a page is from its file extension, or else sniffed.
+func readErrorPages(paths map[string]string) (map[int]errorPage, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	pages := make(map[int]errorPage)
+	for k, path := range paths {
+		code, err := strconv.Atoi(k)
+		if err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("errorPages key %q must be a 4xx or 5xx status code", k)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read error page for %d: %s", code, err)
+		}
+		ct := mime.TypeByExtension(filepath.Ext(path))
+		if ct == "" {
+			ct = http.DetectContentType(b)
+		}
+		pages[code] = errorPage{body: b, contentType: ct}
+	}
+	return pages, nil
+}
+
+// httpError responds with the error page for code, if there is one, or else
+// with the status text in Conf.ErrorFormat.
+func (o options) httpError(w http.ResponseWriter, r *http.Request, code int) {
+	o.httpErrorText(w, r, code, http.StatusText(code))
+}
+
+// httpErrorText is like httpError, but plain text responses have text
+// instead of the status text.
+func (o options) httpErrorText(w http.ResponseWriter, r *http.Request, code int, text string) {
+	o.echoRequestID(w.Header(), r.Context())
+	p, ok := o.errorPages[code]
+	if !ok {
+		if o.jsonErrors {
+			writeJSONError(w, r, code)
+			return
+		}
+		http.Error(w, text, code)
+		return
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", p.contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(p.body)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+)
+
+type attemptKey struct{}
+
+// withAttempt returns a copy of ctx that records the attempt number for a
+// request. Attempt 0 is sent to the route's target and attempt n to the
+// route's nth failover destination.
+func withAttempt(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, attemptKey{}, n)
+}
+
+func attemptFrom(ctx context.Context) int {
+	n, _ := ctx.Value(attemptKey{}).(int)
+	return n
+}
+
+// canFailover reports whether the request can safely be sent again to a
+// failover destination: its method must be idempotent and it must have no
+// body, since the body can only be read once, unless the body was buffered
+// by bufferRetryBody.
+func canFailover(r *http.Request) bool {
+	if !isIdempotent(r.Method) {
+		return false
+	}
+	return (r.ContentLength == 0 && len(r.TransferEncoding) == 0) || r.GetBody != nil
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// bufferRetryBody reads the body of a request with an idempotent method
+// into memory if it is at most max bytes, and sets the request's GetBody,
+// so that the request can be failed over. Larger bodies are left to be
+// streamed, and such requests aren't failed over.
+func bufferRetryBody(r *http.Request, max int64) error {
+	if !isIdempotent(r.Method) || r.Body == nil || r.Body == http.NoBody || r.ContentLength > max {
+		return nil
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) > max {
+		rest := r.Body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), rest), rest}
+		return nil
+	}
+	r.Body.Close()
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	r.Body, _ = r.GetBody()
+	r.ContentLength = int64(len(b))
+	r.TransferEncoding = nil
+	return nil
+}
+
+// serveFailover serves the request using revproxy, trying the route's
+// failover destinations in turn while the response is a failure.
+func serveFailover(w http.ResponseWriter, r *http.Request, rt *route, revproxy http.Handler) {
+	if rt.retryBudget != nil {
+		rt.retryBudget.deposit()
+	}
+	for n := 0; ; n++ {
+		req := r.WithContext(withAttempt(r.Context(), n))
+		if n > 0 && r.GetBody != nil {
+			req.Body, _ = r.GetBody()
+		}
+		if n == rt.maxRetries || !allowRetry(r, rt) {
+			revproxy.ServeHTTP(w, req)
+			return
+		}
+
+		fw := &failoverWriter{
+			ResponseWriter: w,
+			header:         make(http.Header),
+			retryOnStatus:  rt.retryOnStatus,
+		}
+		revproxy.ServeHTTP(fw, req)
+		if !fw.failed || r.Context().Err() != nil {
+			if fw.failed {
+				// the client went away; there is no one to fail over for.
+				w.WriteHeader(http.StatusBadGateway)
+			}
+			return
+		}
+		log.Printf("failing over %s%s to %s: %s", r.Host, r.URL.Path, rt.failover[n].Host, fw.reason)
+		if rt.retryBudget != nil {
+			rt.retryBudget.spend()
+		}
+	}
+}
+
+// allowRetry reports whether the route's retry budget, if any, allows
+// another failover attempt for the request.
+func allowRetry(r *http.Request, rt *route) bool {
+	if rt.retryBudget == nil {
+		return true
+	}
+	ok, exhausted := rt.retryBudget.allow()
+	if exhausted {
+		log.Printf("retry budget exhausted for %s; not failing over", r.Host)
+	}
+	return ok
+}
+
+// failoverWriter is the http.ResponseWriter for an attempt that may be
+// retried. A response with a status in retryOnStatus, or an upstream error
+// reported via upstreamError, is discarded instead of being written to the
+// underlying ResponseWriter.
+type failoverWriter struct {
+	http.ResponseWriter
+	header        http.Header // used until the status is known
+	retryOnStatus map[int]bool
+
+	wroteHeader bool
+	failed      bool   // response discarded
+	reason      string // why the response was discarded
+}
+
+func (w *failoverWriter) Header() http.Header {
+	if w.wroteHeader && !w.failed {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+// upstreamError marks the attempt as failed because of err. It must be
+// called before anything is written.
+func (w *failoverWriter) upstreamError(err error) {
+	w.wroteHeader = true
+	w.failed = true
+	w.reason = err.Error()
+}
+
+func (w *failoverWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	h := w.ResponseWriter.Header()
+	if code < 200 {
+		// informational responses pass through; they aren't the
+		// outcome of the attempt.
+		for k, v := range w.header {
+			h[k] = v
+		}
+		w.ResponseWriter.WriteHeader(code)
+		for k := range w.header {
+			delete(h, k)
+		}
+		return
+	}
+
+	w.wroteHeader = true
+	if w.retryOnStatus[code] {
+		w.failed = true
+		w.reason = http.StatusText(code)
+		return
+	}
+	for k, v := range w.header {
+		h[k] = v
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *failoverWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.failed {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *failoverWriter) Flush() {
+	if w.failed {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap supports http.ResponseController.
+func (w *failoverWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
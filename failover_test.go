@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFailover(t *testing.T) {
+	// backend returns a test server that responds with the status code and
+	// its name as the body.
+	backend := func(name string, code int) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend", name)
+			w.WriteHeader(code)
+			fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+
+	unavailable := backend("primary", 503)
+	broken := backend("broken", 500)
+	ok := backend("secondary", 200)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	serve := func(u Upstream, method string) *httptest.ResponseRecorder {
+		routes, err := newRoutes(map[string]Upstream{"foo.com": u})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		w := httptest.NewRecorder()
+		httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, httptest.NewRequest(method, "https://foo.com/path", nil))
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		upstream Upstream
+		method   string
+		wantCode int
+		wantBody string
+	}{
+		{
+			"retry on status",
+			Upstream{URL: unavailable.URL, Failover: []string{ok.URL}, RetryOnStatus: []int{503}},
+			"GET", 200, "secondary /path",
+		},
+		{
+			"retry on connection error",
+			Upstream{URL: down.URL, Failover: []string{ok.URL}},
+			"GET", 200, "secondary /path",
+		},
+		{
+			"status not listed",
+			Upstream{URL: broken.URL, Failover: []string{ok.URL}, RetryOnStatus: []int{503}},
+			"GET", 500, "broken /path",
+		},
+		{
+			"non-idempotent method",
+			Upstream{URL: unavailable.URL, Failover: []string{ok.URL}, RetryOnStatus: []int{503}},
+			"POST", 503, "primary /path",
+		},
+		{
+			"retries exhausted",
+			Upstream{URL: unavailable.URL, Failover: []string{down.URL, unavailable.URL}, RetryOnStatus: []int{503}},
+			"GET", 503, "primary /path",
+		},
+		{
+			"max retries",
+			Upstream{URL: unavailable.URL, Failover: []string{unavailable.URL, ok.URL}, RetryOnStatus: []int{503}, MaxRetries: 1},
+			"GET", 503, "primary /path",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(tt.upstream, tt.method)
+			if w.Code != tt.wantCode {
+				t.Errorf("status code: want %d, got %d", tt.wantCode, w.Code)
+			}
+			if got := w.Body.String(); got != tt.wantBody {
+				t.Errorf("body: want %q, got %q", tt.wantBody, got)
+			}
+			if got, want := w.Header().Get("X-Backend"), strings.Fields(tt.wantBody)[0]; got != want {
+				t.Errorf("X-Backend: want %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestFailoverRetryBuffer(t *testing.T) {
+	// both read the body, which must be sent in full to each.
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "primary")
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "secondary %s", b)
+	}))
+	defer secondary.Close()
+
+	tests := []struct {
+		name        string
+		bufferBytes int64
+		method      string
+		body        string
+		chunked     bool
+		want        string
+	}{
+		{"small body", 16, "PUT", "hello", false, "secondary hello"},
+		{"small chunked body", 16, "PUT", "hello", true, "secondary hello"},
+		{"body at limit", 5, "PUT", "hello", true, "secondary hello"},
+		{"large body", 4, "PUT", "hello", false, "primary"},
+		{"large chunked body", 4, "PUT", "hello", true, "primary"},
+		{"no buffering", 0, "PUT", "hello", false, "primary"},
+		{"non-idempotent method", 16, "POST", "hello", false, "primary"},
+	}
+	for _, tt := range tests {
+		routes, err := newRoutes(map[string]Upstream{"foo.com": {
+			URL:              primary.URL,
+			Failover:         []string{secondary.URL},
+			RetryOnStatus:    []int{503},
+			RetryBufferBytes: tt.bufferBytes,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body io.Reader = strings.NewReader(tt.body)
+		if tt.chunked {
+			body = io.MultiReader(body) // unknown length
+		}
+		r := httptest.NewRequest(tt.method, "https://foo.com/", body)
+		if tt.chunked {
+			r.ContentLength = -1
+			r.TransferEncoding = []string{"chunked"}
+		}
+		w := httptest.NewRecorder()
+		httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, r)
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s: want %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestFailoverConf(t *testing.T) {
+	for _, u := range []Upstream{
+		{URL: "http://a", RetryOnStatus: []int{503}},
+		{URL: "http://a", Failover: []string{"http://b"}, RetryOnStatus: []int{42}},
+		{URL: "http://a", Failover: []string{"http://b"}, MaxRetries: -1},
+		{URL: "http://a", Failover: []string{"%"}},
+		{URL: "http://a", RetryBufferBytes: 1024},
+		{URL: "http://a", Failover: []string{"http://b"}, RetryBufferBytes: -1},
+	} {
+		if _, err := newRoutes(map[string]Upstream{"foo.com": u}); err == nil {
+			t.Errorf("%+v: want error, got nil", u)
+		}
+	}
+}
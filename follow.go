@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// redirectFollower is a http.RoundTripper that follows redirect responses
+// from destination servers, up to max hops, and returns the final response.
+type redirectFollower struct {
+	transport http.RoundTripper
+	max       int
+}
+
+func (f *redirectFollower) RoundTrip(req *http.Request) (*http.Response, error) {
+	rsp, err := f.transport.RoundTrip(req)
+	for hops := 0; err == nil && hops < f.max; hops++ {
+		next := redirectRequest(req, rsp)
+		if next == nil {
+			break
+		}
+		// drain the body so that the connection can be reused.
+		io.Copy(io.Discard, io.LimitReader(rsp.Body, 1<<16))
+		rsp.Body.Close()
+
+		req = next
+		rsp, err = f.transport.RoundTrip(req)
+	}
+	return rsp, err
+}
+
+func (f *redirectFollower) CloseIdleConnections() {
+	if t, ok := f.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// redirectRequest returns the request to send to follow rsp, which is the
+// response to req, or nil if rsp is not a redirect that can be followed.
+// Like http.Client, it changes the method to GET for 301, 302, and 303
+// responses to requests other than GET and HEAD, and it doesn't follow 307
+// and 308 responses to requests whose body can't be sent again.
+func redirectRequest(req *http.Request, rsp *http.Response) *http.Request {
+	method := req.Method
+	keepBody := false
+	switch rsp.StatusCode {
+	case 301, 302, 303:
+		if method != "GET" && method != "HEAD" {
+			method = "GET"
+		}
+	case 307, 308:
+		keepBody = true
+		if req.Body != nil && req.Body != http.NoBody {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	location := rsp.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	loc, err := req.URL.Parse(location)
+	if err != nil {
+		return nil
+	}
+
+	next := req.Clone(req.Context())
+	next.Method = method
+	if !keepBody {
+		next.Body = nil
+		next.ContentLength = 0
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	}
+
+	switch {
+	case loc.Host == req.URL.Host:
+		// same destination server; keep the Host header.
+	case loc.Host == req.Host:
+		// The destination server redirected to the public URL of the
+		// host, which the destination server is itself behind.
+		loc.Scheme = req.URL.Scheme
+		loc.Host = req.URL.Host
+	default:
+		next.Host = ""
+		next.Header.Del("Authorization")
+		next.Header.Del("Cookie")
+	}
+	next.URL = loc
+	return next
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFollowRedirects(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			// redirect to the public URL, as a backend that uses the
+			// Host header would.
+			http.Redirect(w, r, "https://"+r.Host+"/c?q=1", http.StatusMovedPermanently)
+		case "/c":
+			fmt.Fprintf(w, "%s %s %s", r.Method, r.Host, r.URL.RequestURI())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer backend.Close()
+
+	serve := func(followRedirects int, method string) *httptest.ResponseRecorder {
+		routes, err := newRoutes(map[string]Upstream{
+			"foo.com": {URL: backend.URL, FollowRedirects: followRedirects},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, httptest.NewRequest(method, "https://foo.com/a", nil))
+		return w
+	}
+
+	tests := []struct {
+		name            string
+		followRedirects int
+		method          string
+		wantCode        int
+		wantLocation    string
+		wantBody        string
+	}{
+		{"off", 0, "GET", 302, "/b", ""},
+		{"limited", 1, "GET", 301, "https://foo.com/c?q=1", ""},
+		{"followed", 5, "GET", 200, "", "GET foo.com /c?q=1"},
+		{"post becomes get", 5, "POST", 200, "", "GET foo.com /c?q=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(tt.followRedirects, tt.method)
+			if w.Code != tt.wantCode {
+				t.Errorf("status code: want %d, got %d", tt.wantCode, w.Code)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("location: want %q, got %q", tt.wantLocation, got)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body: want %q, got %q", tt.wantBody, w.Body.String())
+			}
+		})
+	}
+}
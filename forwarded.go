@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// parseIPNets parses a list of IP addresses and CIDR ranges from the
+// config field name.
+func parseIPNets(name string, list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad %s entry %q", name, s)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s entry %q: %s", name, s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// isTrusted reports whether the request's immediate peer is a trusted
+// proxy.
+func (o options) isTrusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range o.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client: the request's immediate
+// peer, or for requests from a trusted proxy, the last address in the
+// X-Forwarded-For header, which is the one added by the proxy.
+func (o options) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if v := r.Header.Values("X-Forwarded-For"); len(v) > 0 && o.isTrusted(r) {
+		addrs := strings.Split(v[len(v)-1], ",")
+		if ip := net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1])); ip != nil {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+// isHTTPS reports whether the request arrived over HTTPS. For requests from
+// a trusted proxy this is according to the X-Forwarded-Proto header set by
+// the proxy, if any.
+func (o options) isHTTPS(r *http.Request) bool {
+	if v := r.Header.Values("X-Forwarded-Proto"); len(v) > 0 && o.isTrusted(r) {
+		// the last value is the one added by the trusted proxy.
+		protos := strings.Split(v[len(v)-1], ",")
+		return strings.EqualFold(strings.TrimSpace(protos[len(protos)-1]), "https")
+	}
+	return r.TLS != nil
+}
+
+// setXForwarded sets the X-Forwarded-For, X-Forwarded-Host, and
+// X-Forwarded-Proto headers of the outbound request. With
+// Conf.TrustForwardedHeaders, the client IP address is appended to the
+// inbound X-Forwarded-For chain and an inbound X-Forwarded-Proto is kept,
+// for requests from Conf.TrustedProxies if any are set. Otherwise inbound
+// values are replaced.
+func (o options) setXForwarded(pr *httputil.ProxyRequest) {
+	trust := o.trustForwarded && (len(o.trustedProxies) == 0 || o.isTrusted(pr.In))
+	if trust {
+		// SetXForwarded appends to an outbound X-Forwarded-For, which
+		// httputil.ReverseProxy removes before Rewrite.
+		if v := pr.In.Header.Values("X-Forwarded-For"); len(v) > 0 {
+			pr.Out.Header["X-Forwarded-For"] = append([]string(nil), v...)
+		}
+	}
+	pr.SetXForwarded()
+	if trust {
+		if v := pr.In.Header.Values("X-Forwarded-Proto"); len(v) > 0 {
+			pr.Out.Header["X-Forwarded-Proto"] = append([]string(nil), v...)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireHTTPS(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	c := Conf{
+		Proxy: map[string]Upstream{
+			"api.foo.com":      {URL: backend.URL, RequireHTTPS: true},
+			"internal.foo.com": {URL: backend.URL, RequireHTTPS: true},
+			"foo.com":          {URL: backend.URL},
+		},
+		HTTPOnlyHosts:  []string{"internal.foo.com"},
+		TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"},
+	}
+	o, err := newOptions(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := newRoutes(c.Proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := newRouteTable(routes)
+
+	testcases := []struct {
+		name       string
+		handler    http.Handler
+		url        string
+		remoteAddr string
+		proto      string // X-Forwarded-Proto
+		want       int
+	}{
+		{"https", httpsHandler(table, o), "https://api.foo.com/", "198.51.100.1:1234", "", 200},
+		{"plaintext is not redirected", httpHandler(table, o), "http://api.foo.com/", "198.51.100.1:1234", "", 400},
+		{"other hosts are redirected", httpHandler(table, o), "http://foo.com/", "198.51.100.1:1234", "", 302},
+		{"forwarded http from trusted proxy", httpsHandler(table, o), "https://api.foo.com/", "10.1.2.3:1234", "http", 400},
+		{"forwarded http from untrusted client", httpsHandler(table, o), "https://api.foo.com/", "198.51.100.1:1234", "http", 200},
+		{"forwarded https from trusted proxy", httpHandler(table, o), "http://internal.foo.com/", "192.0.2.1:1234", "https", 200},
+		{"forwarded http from trusted proxy over http", httpHandler(table, o), "http://internal.foo.com/", "192.0.2.1:1234", "http", 400},
+		{"forwarded https from untrusted client", httpHandler(table, o), "http://internal.foo.com/", "198.51.100.1:1234", "https", 400},
+	}
+	for _, tc := range testcases {
+		r := httptest.NewRequest("GET", tc.url, nil)
+		r.RemoteAddr = tc.remoteAddr
+		if tc.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		w := httptest.NewRecorder()
+		tc.handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status code: want %d, got %d", tc.name, tc.want, w.Code)
+		}
+	}
+
+	c.TrustedProxies = []string{"10.0.0.0/33"}
+	if _, err := newOptions(c); err == nil {
+		t.Errorf("want error for bad trustedProxies, got nil")
+	}
+}
+
+func TestTrustForwardedHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Got-For", strings.Join(r.Header.Values("X-Forwarded-For"), ", "))
+		w.Header().Set("Got-Proto", r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer backend.Close()
+	table := mustRoutes(map[string]string{"foo.com": backend.URL})
+
+	testcases := []struct {
+		name       string
+		conf       Conf
+		remoteAddr string
+		wantFor    string
+		wantProto  string
+	}{
+		{"not trusted", Conf{}, "198.51.100.1:1234", "198.51.100.1", "https"},
+		{"trusted", Conf{TrustForwardedHeaders: true}, "198.51.100.1:1234", "203.0.113.7, 192.0.2.9, 198.51.100.1", "http"},
+		{"trusted proxy", Conf{TrustForwardedHeaders: true, TrustedProxies: []string{"10.0.0.0/8"}}, "10.1.2.3:1234", "203.0.113.7, 192.0.2.9, 10.1.2.3", "http"},
+		{"untrusted client", Conf{TrustForwardedHeaders: true, TrustedProxies: []string{"10.0.0.0/8"}}, "198.51.100.1:1234", "198.51.100.1", "https"},
+	}
+	for _, tc := range testcases {
+		o, err := newOptions(tc.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "https://foo.com/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		r.Header.Add("X-Forwarded-For", "203.0.113.7")
+		r.Header.Add("X-Forwarded-For", "192.0.2.9")
+		r.Header.Set("X-Forwarded-Proto", "http")
+		w := httptest.NewRecorder()
+		httpsHandler(table, o).ServeHTTP(w, r)
+		if got := w.Header().Get("Got-For"); got != tc.wantFor {
+			t.Errorf("%s: X-Forwarded-For: want %q, got %q", tc.name, tc.wantFor, got)
+		}
+		if got := w.Header().Get("Got-Proto"); got != tc.wantProto {
+			t.Errorf("%s: X-Forwarded-Proto: want %q, got %q", tc.name, tc.wantProto, got)
+		}
+	}
+}
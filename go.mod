@@ -3,11 +3,14 @@ module github.com/littleroot/httpserver
 go 1.20
 
 require (
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	github.com/tdewolff/minify/v2 v2.12.4
 	golang.org/x/crypto v0.3.0
-	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4
+	golang.org/x/net v0.2.0
+	golang.org/x/time v0.3.0
 )
 
 require (
-	golang.org/x/net v0.2.0 // indirect
+	github.com/tdewolff/parse/v2 v2.6.4 // indirect
 	golang.org/x/text v0.4.0 // indirect
 )
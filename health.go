@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultHealthCheckInterval = 10 * time.Second
+
+// healthCheckTick is how often routes are checked for due health checks.
+const healthCheckTick = time.Second
+
+// backend is one of the destination servers of a route.
+type backend struct {
+	target  url.URL
+	healthy atomic.Bool
+}
+
+func newBackend(target url.URL) *backend {
+	b := &backend{target: target}
+	b.healthy.Store(true) // until a health check fails
+	return b
+}
+
+// pick returns the route's next healthy backend, round-robin, or nil if
+// none are healthy.
+func (rt *route) pick() *backend {
+	n := uint64(len(rt.backends))
+	start := rt.next.Add(1) - 1
+	for i := uint64(0); i < n; i++ {
+		if b := rt.backends[(start+i)%n]; b.healthy.Load() {
+			return b
+		}
+	}
+	return nil
+}
+
+// healthCheck periodically requests a path from each backend of a route.
+// A backend is healthy while the responses are 2xx or 3xx.
+type healthCheck struct {
+	path     string
+	interval time.Duration
+
+	mu       sync.Mutex
+	last     time.Time // start of the last check
+	checking bool
+}
+
+// due reports whether a check should start at now, and if so marks it as
+// started.
+func (h *healthCheck) due(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checking || now.Sub(h.last) < h.interval {
+		return false
+	}
+	h.checking = true
+	h.last = now
+	return true
+}
+
+func (h *healthCheck) done() {
+	h.mu.Lock()
+	h.checking = false
+	h.mu.Unlock()
+}
+
+// checkHealth checks the route's backends concurrently and updates their
+// health, logging changes.
+func (rt *route) checkHealth(host string) {
+	defer rt.health.done()
+
+	client := &http.Client{
+		Transport: rt.transport,
+		Timeout:   rt.health.interval,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var wg sync.WaitGroup
+	for _, b := range rt.backends {
+		b := b
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := probe(client, b.target.JoinPath(rt.health.path))
+			if healthy := err == nil; b.healthy.Swap(healthy) != healthy {
+				if healthy {
+					log.Printf("backend %s for %s is healthy", b.target.Host, host)
+				} else {
+					log.Printf("backend %s for %s is unhealthy: %s", b.target.Host, host, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func probe(client *http.Client, u *url.URL) error {
+	rsp, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(rsp.Body, 1<<20))
+	rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return fmt.Errorf("status %s", rsp.Status)
+	}
+	return nil
+}
+
+// runHealthChecks runs the due health checks of the routes in table until
+// ctx is done.
+func runHealthChecks(ctx context.Context, table *routeTable) {
+	t := time.NewTicker(healthCheckTick)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			for host, rt := range table.load() {
+				if rt.health != nil && rt.health.due(now) {
+					go rt.checkHealth(host)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRoundRobinHealthCheck(t *testing.T) {
+	// backend returns a test server that responds with its name, and
+	// whose health check path responds with 500 when sick is set.
+	backend := func(name string, sick *atomic.Bool) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" && sick.Load() {
+				w.WriteHeader(500)
+				return
+			}
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	var aSick, bSick atomic.Bool
+	a := backend("a", &aSick)
+	b := backend("b", &bSick)
+
+	var proxy map[string]Upstream
+	conf := `{"foo.com": ["` + a.URL + `", "` + b.URL + `"]}`
+	if err := json.Unmarshal([]byte(conf), &proxy); err != nil {
+		t.Fatal(err)
+	}
+	u := proxy["foo.com"]
+	u.HealthCheckPath = "/healthz"
+	proxy["foo.com"] = u
+	routes, err := newRoutes(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+	rt := routes["foo.com"]
+
+	get := func() (int, string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+		return w.Code, w.Body.String()
+	}
+	clock := time.Now()
+	check := func() {
+		clock = clock.Add(time.Hour)
+		if !rt.health.due(clock) {
+			t.Fatal("want health check due")
+		}
+		rt.checkHealth("foo.com")
+	}
+	want := func(bodies ...string) {
+		t.Helper()
+		for _, body := range bodies {
+			if code, got := get(); code != 200 || got != body {
+				t.Errorf("want 200 %q, got %d %q", body, code, got)
+			}
+		}
+	}
+
+	want("a", "b", "a", "b")
+
+	bSick.Store(true)
+	check()
+	want("a", "a", "a")
+
+	aSick.Store(true)
+	check()
+	if code, _ := get(); code != 503 {
+		t.Errorf("all unhealthy: status code: want 503, got %d", code)
+	}
+
+	aSick.Store(false)
+	bSick.Store(false)
+	check()
+	_, first := get()
+	_, second := get()
+	if first+second != "ab" && first+second != "ba" {
+		t.Errorf("after recovery: want both backends, got %q and %q", first, second)
+	}
+
+	for _, u := range []Upstream{
+		{URL: a.URL, URLs: []string{b.URL}},
+		{URLs: []string{a.URL, "%"}},
+		{URL: a.URL, HealthCheckPath: "/healthz", HealthCheckInterval: -1},
+	} {
+		if _, err := newRoutes(map[string]Upstream{"foo.com": u}); err == nil {
+			t.Errorf("%+v: want error", u)
+		}
+	}
+}
+
+func TestHealthCheckDue(t *testing.T) {
+	h := &healthCheck{interval: time.Minute}
+	now := time.Now()
+	if !h.due(now) {
+		t.Error("want first check due")
+	}
+	if h.due(now.Add(2 * time.Minute)) {
+		t.Error("want no check due while one is running")
+	}
+	h.done()
+	if h.due(now.Add(30 * time.Second)) {
+		t.Error("want no check due before the interval")
+	}
+	if !h.due(now.Add(time.Minute)) {
+		t.Error("want check due after the interval")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	var urls []string
+	hits := make([]atomic.Int64, 3)
+	for i := range hits {
+		i := i
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i].Add(1)
+		}))
+		defer s.Close()
+		urls = append(urls, s.URL)
+	}
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {URLs: urls}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+	for i := 0; i < 30; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+		if w.Code != 200 {
+			t.Fatalf("status code: want 200, got %d", w.Code)
+		}
+	}
+	for i := range hits {
+		if n := hits[i].Load(); n != 10 {
+			t.Errorf("backend %d: want 10 requests, got %d", i, n)
+		}
+	}
+
+	if _, err := newRoutes(map[string]Upstream{"foo.com": {URLs: []string{urls[0], ""}}}); err == nil {
+		t.Errorf("want error for empty URL in list")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxHTTP10BufferSize limits the size of a request body of unknown length
+// that is buffered to compute its Content-Length, which HTTP/1.0 requires.
+const maxHTTP10BufferSize = 10 << 20
+
+// http10Transport is a http.RoundTripper that sends HTTP/1.0 requests, each
+// over a new connection that is closed after the response.
+type http10Transport struct {
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// tlsConfig, if non-nil, is used for connections to https servers.
+	tlsConfig *tls.Config
+	// responseHeaderTimeout, if non-zero, bounds the time to wait for the
+	// response headers after the request is written.
+	responseHeaderTimeout time.Duration
+}
+
+func (t *http10Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, length, err := http10Body(req)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := t.connect(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Close the connection if the request is canceled before the response
+	// body is closed.
+	done := make(chan struct{})
+	var once sync.Once
+	closeConn := func() error {
+		once.Do(func() { close(done) })
+		return conn.Close()
+	}
+	go func() {
+		select {
+		case <-req.Context().Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := writeHTTP10Request(conn, req, body, length); err != nil {
+		closeConn()
+		return nil, err
+	}
+	if t.responseHeaderTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(t.responseHeaderTimeout))
+	}
+	rsp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		closeConn()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errResponseHeaderTimeout
+		}
+		return nil, err
+	}
+	if t.responseHeaderTimeout > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+	rsp.Body = &connClosingBody{ReadCloser: rsp.Body, close: closeConn}
+	return rsp, nil
+}
+
+func (t *http10Transport) connect(req *http.Request) (net.Conn, error) {
+	host := req.URL.Hostname()
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	conn, err := t.dial(req.Context(), "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "https" {
+		return conn, nil
+	}
+	config := &tls.Config{}
+	if t.tlsConfig != nil {
+		config = t.tlsConfig.Clone()
+	}
+	config.ServerName = host
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(req.Context()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// http10Body returns the body of the request and its length, buffering the
+// body if its length isn't known.
+func http10Body(req *http.Request) (io.Reader, int64, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, 0, nil
+	}
+	if req.ContentLength >= 0 {
+		return req.Body, req.ContentLength, nil
+	}
+	b, err := io.ReadAll(io.LimitReader(req.Body, maxHTTP10BufferSize+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(b) > maxHTTP10BufferSize {
+		return nil, 0, errors.New("request body too large to send over HTTP/1.0")
+	}
+	return bytes.NewReader(b), int64(len(b)), nil
+}
+
+// hopHeaders are headers that apply to a single HTTP/1.1 connection, or
+// that are written by writeHTTP10Request itself.
+var hopHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func writeHTTP10Request(w io.Writer, req *http.Request, body io.Reader, length int64) error {
+	bw := bufio.NewWriter(w)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(bw, "%s %s HTTP/1.0\r\n", req.Method, req.URL.RequestURI())
+	fmt.Fprintf(bw, "Host: %s\r\n", host)
+
+	h := req.Header.Clone()
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+	if h.Get("User-Agent") == "" {
+		h.Del("User-Agent") // set empty by httputil.ReverseProxy to suppress the default
+	}
+	if body != nil || req.Method == "POST" || req.Method == "PUT" {
+		h.Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	if err := h.Write(bw); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(bw, "\r\n"); err != nil {
+		return err
+	}
+	if body != nil {
+		if _, err := io.CopyN(bw, body, length); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// connClosingBody is a response body that closes the connection it is read
+// from when it is closed.
+type connClosingBody struct {
+	io.ReadCloser
+	close func() error
+}
+
+func (b *connClosingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.close()
+	return err
+}
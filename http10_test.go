@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTP10(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %d %q", r.Proto, r.Method, r.Host, r.ContentLength, b)
+	}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, HTTP10: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want string
+	}{
+		{
+			"get",
+			httptest.NewRequest("GET", "https://foo.com/", nil),
+			`HTTP/1.0 GET foo.com 0 ""`,
+		},
+		{
+			"post",
+			httptest.NewRequest("POST", "https://foo.com/", strings.NewReader("hello")),
+			`HTTP/1.0 POST foo.com 5 "hello"`,
+		},
+		{
+			"post of unknown length",
+			httptest.NewRequest("POST", "https://foo.com/", io.MultiReader(strings.NewReader("hello"))),
+			`HTTP/1.0 POST foo.com 5 "hello"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, tt.req)
+			if w.Code != 200 {
+				t.Errorf("status code: want 200, got %d", w.Code)
+			}
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("body: want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// configureHTTP2 configures HTTP/2 support on s with the settings in c.
+// It must be called before s starts serving.
+func configureHTTP2(s *http.Server, c HTTP2) error {
+	return http2.ConfigureServer(s, &http2.Server{
+		MaxConcurrentStreams: c.MaxConcurrentStreams,
+	})
+}
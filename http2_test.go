@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestConfigureHTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err := configureHTTP2(ts.Config, HTTP2{MaxConcurrentStreams: 7}); err != nil {
+		t.Fatal(err)
+	}
+	ts.TLS = ts.Config.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{http2.NextProtoTLS},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if p := conn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		t.Fatalf("negotiated protocol: want %q, got %q", http2.NextProtoTLS, p)
+	}
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server's first frame is its SETTINGS.
+	f, err := http2.NewFramer(conn, conn).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, ok := f.(*http2.SettingsFrame)
+	if !ok {
+		t.Fatalf("want SETTINGS frame, got %v", f)
+	}
+	v, ok := sf.Value(http2.SettingMaxConcurrentStreams)
+	if !ok || v != 7 {
+		t.Errorf("max concurrent streams: want 7, got %d (present: %t)", v, ok)
+	}
+}
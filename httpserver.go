@@ -3,19 +3,30 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"golang.org/x/crypto/acme/autocert"
-	"golang.org/x/sync/errgroup"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/proxy"
 )
 
 const renewBefore = 30 * 24 * time.Hour
@@ -36,6 +47,15 @@ func main() {
 }
 
 func parseConf(path string) (Conf, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return Conf{}, fmt.Errorf("config symlink %s is broken", path)
+		}
+	}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return Conf{}, fmt.Errorf("config path %s is a directory", path)
+	}
+
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return Conf{}, err
@@ -50,13 +70,131 @@ func checkConf(c Conf) error {
 	if c.Certs.Auto && c.Certs.CertDir == "" {
 		return errors.New("require certs.certDir when certs.auto == true")
 	}
-	if !c.Certs.Auto && c.Certs.CertFile == "" {
+	if !c.Certs.Auto && c.Certs.CertFile == "" && len(c.Certs.Pairs) == 0 {
 		return errors.New("require certs.certFile when certs.auto == false")
 	}
-	if !c.Certs.Auto && c.Certs.KeyFile == "" {
+	if !c.Certs.Auto && c.Certs.KeyFile == "" && len(c.Certs.Pairs) == 0 {
 		return errors.New("require certs.keyFile when certs.auto == false")
 	}
-	if _, err := toURLs(c.Proxy); err != nil {
+	if c.Certs.Auto && len(c.Certs.Pairs) > 0 {
+		return errors.New("require certs.auto == false for certs.pairs")
+	}
+	if !c.Certs.Auto {
+		if _, err := loadCertificates(c.Certs); err != nil {
+			return err
+		}
+	}
+	if c.Certs.MaxConcurrentIssuance < 0 {
+		return errors.New("certs.maxConcurrentIssuance must not be negative")
+	}
+	if c.Certs.MaxAge < 0 {
+		return errors.New("certs.maxAge must not be negative")
+	}
+	if c.Certs.MaxAge != 0 && !c.Certs.Auto {
+		return errors.New("require certs.auto == true for certs.maxAge")
+	}
+	if c.Certs.MaxAge != 0 && time.Duration(c.Certs.MaxAge) < minCertMaxAge {
+		return fmt.Errorf("certs.maxAge must be at least %s", minCertMaxAge)
+	}
+	if _, err := acmeDirectoryURL(c.Certs.ACMEDirectory); err != nil {
+		return err
+	}
+	for _, d := range c.Domains {
+		if !strings.Contains(d, "*") {
+			continue
+		}
+		if err := checkWildcard(d); err != nil {
+			return err
+		}
+		if !c.Certs.Auto || c.Certs.DNSProvider == nil {
+			return fmt.Errorf("require certs.auto == true and certs.dnsProvider for wildcard domain %s", d)
+		}
+	}
+	if c.Certs.DNSProvider != nil {
+		if !c.Certs.Auto {
+			return errors.New("require certs.auto == true for certs.dnsProvider")
+		}
+		if _, err := newDNSProvider(c.Certs.DNSProvider); err != nil {
+			return err
+		}
+	}
+	if _, err := newRoutes(c.Proxy); err != nil {
+		return err
+	}
+	if c.Certs.Auto {
+		if missing := missingDomains(c); len(missing) > 0 {
+			return fmt.Errorf("hosts in proxy must be in domains when certs.auto == true; missing: %s", strings.Join(missing, ", "))
+		}
+	}
+	if c.ConfigURL != "" {
+		u, err := url.Parse(c.ConfigURL)
+		if err != nil {
+			return fmt.Errorf("parse configURL: %s", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return errors.New("configURL must be a http or https URL")
+		}
+	}
+	for _, addr := range []string{c.HTTPAddr, c.HTTPSAddr} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("bad listen address %q: %s", addr, err)
+		}
+	}
+	if c.MaxHeaderCount < 0 {
+		return errors.New("maxHeaderCount must not be negative")
+	}
+	if c.Timeouts.Read < 0 || c.Timeouts.Write < 0 || c.Timeouts.Idle < 0 || c.Timeouts.ReadHeader < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if err := configureTLS(&tls.Config{}, c.TLS); err != nil {
+		return err
+	}
+	if c.HSTS.MaxAge < 0 {
+		return errors.New("hsts.maxAge must not be negative")
+	}
+	switch c.RedirectStatus {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("redirectStatus %d is not a redirect status code", c.RedirectStatus)
+	}
+	if c.MaxRequestsPerConn < 0 {
+		return errors.New("maxRequestsPerConn must not be negative")
+	}
+	if c.Log.Syslog != nil {
+		if err := checkSyslog(*c.Log.Syslog); err != nil {
+			return err
+		}
+	}
+	if c.Log.LatencyInterval < 0 {
+		return errors.New("log.latencyInterval must not be negative")
+	}
+	if c.Log.LatencyWindow != 0 {
+		interval, window := latencyWindow(c.Log)
+		if c.Log.LatencyWindow < 0 || time.Duration(c.Log.LatencyWindow)%interval != 0 || window < 1 || window > maxLatencyWindow {
+			return fmt.Errorf("log.latencyWindow must be a multiple of log.latencyInterval %s, up to %d times it", interval, maxLatencyWindow)
+		}
+	}
+	if c.ConfigInterval < 0 {
+		return errors.New("configInterval must not be negative")
+	}
+	switch c.AccessLog {
+	case "", "text", "json", "off":
+	default:
+		return fmt.Errorf("unknown accessLog %q", c.AccessLog)
+	}
+	if len(c.AccessLogHeaders) > 0 && c.AccessLog == "off" {
+		return errors.New("require accessLog != \"off\" for accessLogHeaders")
+	}
+	switch c.Log.TLSHandshakeErrors {
+	case "", "log", "off":
+	default:
+		return fmt.Errorf("unknown log.tlsHandshakeErrors %q", c.Log.TLSHandshakeErrors)
+	}
+	if _, err := newOptions(c); err != nil {
 		return err
 	}
 	return nil
@@ -64,151 +202,2223 @@ func checkConf(c Conf) error {
 
 // Conf is the configuration for the program.
 type Conf struct {
-	Domains       []string          `json:"domains"`
-	Proxy         map[string]string `json:"proxy"`
-	Certs         Certs             `json:"certs"`
-	AcmeChallenge string            `json:"acmeChallenge"`
+	// HTTPAddr and HTTPSAddr are the addresses the HTTP and HTTPS servers
+	// listen on. The defaults are ":80" and ":443".
+	HTTPAddr      string              `json:"httpAddr"`
+	HTTPSAddr     string              `json:"httpsAddr"`
+	Domains       []string            `json:"domains"`
+	Proxy         map[string]Upstream `json:"proxy"`
+	Certs         Certs               `json:"certs"`
+	AcmeChallenge string              `json:"acmeChallenge"`
+	Apex          Apex                `json:"apex"`
+	Canonical     Canonical           `json:"canonical"`
+	Log           Log                 `json:"log"`
+	// ConfigURL, if set, is the URL of a config to fetch periodically.
+	// Its proxy map replaces the current one. The rest of the fetched
+	// config is ignored.
+	ConfigURL string `json:"configURL"`
+	// ConfigInterval is the interval at which ConfigURL is fetched.
+	// Zero means the default of 1 minute.
+	ConfigInterval Duration `json:"configInterval"`
+	// HTTPOnlyHosts lists hosts in the proxy map that are proxied over
+	// http instead of being redirected to https. They aren't served over
+	// https, and must not be in Domains.
+	HTTPOnlyHosts []string `json:"httpOnlyHosts"`
+	// Via, if set, is a name for this server that is added to the Via
+	// header of outbound requests. Requests whose Via or Forwarded
+	// header already has the name are rejected as forwarding loops.
+	Via string `json:"via"`
+	// InstanceHeaders are headers, such as X-Edge-Region, set on every
+	// request sent to a destination server.
+	InstanceHeaders map[string]string `json:"instanceHeaders"`
+	// TrustedProxies lists the IP addresses and CIDR ranges of proxies,
+	// such as TLS-terminating load balancers, whose X-Forwarded-Proto
+	// header is trusted.
+	TrustedProxies []string `json:"trustedProxies"`
+	HTTP2          HTTP2    `json:"http2"`
+	HSTS           HSTS     `json:"hsts"`
+	Timeouts       Timeouts `json:"timeouts"`
+	TLS            TLS      `json:"tls"`
+	// TrustForwardedHeaders makes the inbound X-Forwarded-For and
+	// X-Forwarded-Proto headers be kept, with the client IP address
+	// appended to X-Forwarded-For, instead of replaced. If TrustedProxies
+	// is set, only headers of requests from them are kept.
+	TrustForwardedHeaders bool `json:"trustForwardedHeaders"`
+	// RedirectStatus is the status code of redirects from HTTP to HTTPS
+	// and of apex and canonical host redirects, 301, 302, 303, 307, or
+	// 308. Zero means 302 for redirects to HTTPS and 301 for the others.
+	// Requests other than GET and HEAD get the 307 or 308 equivalent.
+	RedirectStatus int `json:"redirectStatus"`
+	// MaxRedirects, if non-zero, is the number of times within 10 seconds
+	// that a client is redirected to the same URL, by the redirect to
+	// HTTPS or apex.redirect, before it gets a 400 instead. Redirects to
+	// the requested URL itself always get a 400.
+	MaxRedirects int `json:"maxRedirects"`
+	// HealthPath, if set, is a path such as "/healthz" for which GET and
+	// HEAD requests get a 200 with body "ok" on both servers, whatever the
+	// request host.
+	HealthPath string `json:"healthPath"`
+	// ReloadStatusPath, if set, is a path such as "/reloadz" for which GET
+	// and HEAD requests get the outcome of the last reload of the proxy
+	// map from the config file on SIGHUP and from ConfigURL as JSON, on
+	// both servers, whatever the request host. The status code is 500 if
+	// the last reload from either failed, and 200 otherwise.
+	ReloadStatusPath string `json:"reloadStatusPath"`
+	// MaxHeaderCount, if non-zero, is the maximum number of header fields
+	// in a request. Requests with more are rejected with 431.
+	MaxHeaderCount int `json:"maxHeaderCount"`
+	// FailFast makes the program exit when either the HTTP or the HTTPS
+	// server stops, such as when its port can't be bound. When false, the
+	// error is logged and the other server keeps serving. Nil means true.
+	FailFast *bool `json:"failFast"`
+	// BindHTTPSFirst makes the HTTPS server's address be bound before the
+	// HTTP server's, so that clients redirected from HTTP to HTTPS find
+	// it accepting connections. When false, HTTP is bound first. Nil
+	// means true.
+	BindHTTPSFirst *bool `json:"bindHTTPSFirst"`
+	// MaxRequestsPerConn, if non-zero, is the number of requests served
+	// over a HTTP/1.x client connection before it is closed.
+	MaxRequestsPerConn int `json:"maxRequestsPerConn"`
+	// AccessLog is the format of the line logged for each request, "text"
+	// or "json", or "off" to not log requests. The empty string is the
+	// same as "text".
+	AccessLog string `json:"accessLog"`
+	// AccessLogHeaders lists headers of destination servers' responses,
+	// such as "X-Trace-Id", whose values are included in the access log
+	// line of each request, to correlate it with the destination
+	// server's logs.
+	AccessLogHeaders []string `json:"accessLogHeaders"`
+	// ErrorPages maps status codes, such as "502", to the paths of files,
+	// such as branded HTML pages, served as the body of error responses
+	// with the status instead of the plain text status. They are read at
+	// startup.
+	ErrorPages map[string]string `json:"errorPages"`
+	// ErrorFormat is the format of error responses without an error
+	// page: "text" for the plain text status, or "json" for a JSON
+	// object with the status text and request ID. The empty string is
+	// the same as "text".
+	ErrorFormat string `json:"errorFormat"`
+	// RequestIDHeader, if set, is the name of a header, such as
+	// X-Request-Id, with an ID for each request. A valid ID sent by the
+	// client is kept; otherwise one is generated. The ID is sent to the
+	// destination server and echoed in the response.
+	RequestIDHeader string `json:"requestIDHeader"`
+	// RateLimit limits the rate of requests from each client to both
+	// servers.
+	RateLimit RateLimit `json:"rateLimit"`
+	// Allow and Deny are lists of IP addresses and CIDR ranges of clients
+	// that may and may not make requests to either server. Deny takes
+	// precedence; an empty Allow allows all clients. They are checked
+	// before those of each Upstream.
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	// Auth maps hosts in Proxy to the credentials, "user:bcrypt-hash",
+	// of the users that may make requests for the host, with HTTP Basic
+	// authentication.
+	Auth map[string][]string `json:"auth"`
+	// Compression, if set, gzips responses from destination servers for
+	// clients that accept it.
+	Compression *Compression `json:"compression"`
 }
 
-func toURLs(proxy map[string]string) (map[string]url.URL, error) {
-	m := make(map[string]url.URL)
-	for k, v := range proxy {
-		u, err := url.Parse(v)
-		if err != nil {
-			return nil, fmt.Errorf("parse %s: %s", v, err)
-		}
-		m[k] = *u
-	}
-	return m, nil
+// Log configures logging.
+type Log struct {
+	// TLSHandshakeErrors is "log" to log TLS handshake errors with the
+	// client address and requested server name, or "off" to not log them.
+	// The empty string is the same as "log".
+	TLSHandshakeErrors string `json:"tlsHandshakeErrors"`
+	// UpstreamConns logs, for each request to a destination server,
+	// whether it reused an idle connection or opened a new one.
+	UpstreamConns bool `json:"upstreamConns"`
+	// LatencyInterval is the interval at which the request latency and
+	// size percentiles of upstreams with LogLatency, LogSizes, and
+	// LogHeaderSizes are logged. Zero means the default of 1 minute.
+	LatencyInterval Duration `json:"latencyInterval"`
+	// LatencyWindow is the length of the sliding window over which the
+	// percentiles are computed, a multiple of LatencyInterval up to 60
+	// times it. Zero means 5 times LatencyInterval.
+	LatencyWindow Duration `json:"latencyWindow"`
+	// Syslog, if set, sends the log to syslog instead of stderr.
+	Syslog *Syslog `json:"syslog"`
 }
 
-type Certs struct {
-	Auto     bool   `json:"auto"`
-	CertDir  string `json:"certDir"`
-	CertFile string `json:"certFile"`
-	KeyFile  string `json:"keyFile"`
+// Syslog configures logging to syslog.
+type Syslog struct {
+	// Network and Address are the syslog server to log to, such as "udp"
+	// and "logs.example.com:514". If Network is empty, the local syslog
+	// server is used.
+	Network string `json:"network"`
+	Address string `json:"address"`
+	// Facility is the syslog facility name, such as "local0". The
+	// default is "daemon".
+	Facility string `json:"facility"`
+	// Tag is the tag of log messages. The default is "httpserver".
+	Tag string `json:"tag"`
 }
 
-func run(_ context.Context) error {
-	flag.Usage = printUsage
-	flag.Parse()
+// HTTP2 configures HTTP/2 support of the HTTPS server.
+type HTTP2 struct {
+	// MaxConcurrentStreams limits the number of streams a client may
+	// have open at the same time on a connection. Zero means the
+	// default of 250.
+	MaxConcurrentStreams uint32 `json:"maxConcurrentStreams"`
+	// DisablePush disables server push for all hosts, whatever their
+	// Upstream.Push.
+	DisablePush bool `json:"disablePush"`
+}
 
-	if flag.NArg() != 1 {
-		printUsage()
-		os.Exit(2)
+// Timeouts configures the timeouts of the HTTP and HTTPS servers' client
+// connections. Zero means the default: 10s for ReadHeader, 120s for Idle,
+// and no timeout for Read and Write.
+type Timeouts struct {
+	// Read bounds the time to read a request, including its body.
+	Read Duration `json:"read"`
+	// Write bounds the time from the end of reading the request headers
+	// to the end of writing the response. Hosts with streamed responses
+	// or WebSocket connections need it to be zero.
+	Write Duration `json:"write"`
+	// Idle bounds the time to wait for the next request on a keep-alive
+	// connection.
+	Idle Duration `json:"idle"`
+	// ReadHeader bounds the time to read request headers.
+	ReadHeader Duration `json:"readHeader"`
+}
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+// setTimeouts sets the timeouts of s.
+func setTimeouts(s *http.Server, t Timeouts) {
+	s.ReadTimeout = time.Duration(t.Read)
+	s.WriteTimeout = time.Duration(t.Write)
+	s.IdleTimeout = time.Duration(t.Idle)
+	if s.IdleTimeout == 0 {
+		s.IdleTimeout = defaultIdleTimeout
+	}
+	s.ReadHeaderTimeout = time.Duration(t.ReadHeader)
+	if s.ReadHeaderTimeout == 0 {
+		s.ReadHeaderTimeout = defaultReadHeaderTimeout
 	}
+}
 
-	c, err := parseConf(flag.Arg(0))
-	if err != nil {
-		return fmt.Errorf("parse conf: %s", err)
+// HSTS configures the Strict-Transport-Security header added to proxied
+// responses over HTTPS.
+type HSTS struct {
+	// MaxAge is the max-age directive in seconds. Zero means no header is
+	// added.
+	MaxAge            int  `json:"maxAge"`
+	IncludeSubdomains bool `json:"includeSubdomains"`
+	Preload           bool `json:"preload"`
+	// Override replaces a Strict-Transport-Security header set by the
+	// destination server instead of keeping it.
+	Override bool `json:"override"`
+}
+
+// header returns the Strict-Transport-Security header value, or the empty
+// string if no header is to be added.
+func (h HSTS) header() string {
+	if h.MaxAge == 0 {
+		return ""
 	}
-	if err := checkConf(c); err != nil {
-		return fmt.Errorf("check conf: %s", err)
+	v := "max-age=" + strconv.Itoa(h.MaxAge)
+	if h.IncludeSubdomains {
+		v += "; includeSubDomains"
+	}
+	if h.Preload {
+		v += "; preload"
+	}
+	return v
+}
+
+// Apex configures the response to requests for a host that isn't in the
+// proxy map but is the parent domain of a host that is, e.g. example.com
+// when only www.example.com and app.example.com are in the proxy map.
+type Apex struct {
+	// Action is "redirect", "page", or "". The empty string responds
+	// with a 502, as for any other unknown host.
+	Action string `json:"action"`
+	// Redirect is the subdomain, such as "www", to redirect to when
+	// Action is "redirect".
+	Redirect string `json:"redirect"`
+	// Page is the path to an HTML file to serve when Action is "page".
+	Page string `json:"page"`
+}
+
+// Upstream is the destination server for a proxied host. In JSON it is
+// either a string, which is the destination server base URL, an array of
+// strings, which are the base URLs of several destination servers, or an
+// object.
+type Upstream struct {
+	URL string `json:"url"`
+	// URLs, which is an alternative to URL, lists the base URLs of
+	// several destination servers, which requests are distributed
+	// between round-robin.
+	URLs []string `json:"urls"`
+	// HealthCheckPath, if set, is the path requested from each
+	// destination server every HealthCheckInterval (default 10s).
+	// Servers that don't respond with a 2xx or 3xx aren't sent requests
+	// until they do.
+	HealthCheckPath     string   `json:"healthCheckPath"`
+	HealthCheckInterval Duration `json:"healthCheckInterval"`
+	// DialTimeout bounds the time taken to connect to the destination
+	// server. Zero means the default.
+	DialTimeout Duration `json:"dialTimeout"`
+	// SOCKS5Proxy, if set, is the host:port address of a SOCKS5 proxy
+	// through which destination servers are connected to.
+	SOCKS5Proxy string `json:"socks5Proxy"`
+	// ResponseHeaderTimeout bounds the time to wait for the destination
+	// server's response headers after the request has been written. Zero
+	// means no timeout.
+	ResponseHeaderTimeout Duration `json:"responseHeaderTimeout"`
+	// IdleConnTimeout bounds the time an idle connection to the
+	// destination server is kept for reuse. Zero means the default of
+	// 90s.
+	IdleConnTimeout Duration `json:"idleConnTimeout"`
+	// ConnMaxLifetime, if non-zero, is the age at which a connection to
+	// the destination server is closed once no request is using it, even
+	// if it isn't idle for IdleConnTimeout. It has no effect with HTTP10.
+	ConnMaxLifetime Duration `json:"connMaxLifetime"`
+	// Failover lists base URLs of destination servers to try, in order,
+	// when the request to the previous destination server fails. Only
+	// requests with idempotent methods and no body, or a body buffered
+	// with RetryBufferBytes, are retried.
+	Failover []string `json:"failover"`
+	// RetryOnStatus lists response status codes, such as 503, that are
+	// treated as failures for Failover, in addition to connection errors.
+	RetryOnStatus []int `json:"retryOnStatus"`
+	// MaxRetries limits the number of failover attempts for a request.
+	// Zero means len(Failover).
+	MaxRetries int `json:"maxRetries"`
+	// RetryBudget, if set, limits failover attempts across requests.
+	RetryBudget *RetryBudget `json:"retryBudget"`
+	// RetryEmptyResponse makes requests with idempotent methods be sent
+	// again, once, when the destination server closes the connection
+	// without a response.
+	RetryEmptyResponse bool `json:"retryEmptyResponse"`
+	// RetryBufferBytes, if non-zero, is the size of the largest request
+	// body that is buffered so that requests with idempotent methods and
+	// a body can be retried with Failover.
+	RetryBufferBytes int64 `json:"retryBufferBytes"`
+	// DefaultCacheControl, if set, is the Cache-Control header added to
+	// successful responses that don't have one.
+	DefaultCacheControl string `json:"defaultCacheControl"`
+	// TimingAllowOrigin, if set, is the Timing-Allow-Origin header set on
+	// responses, allowing cross-origin pages to read Resource Timing data.
+	TimingAllowOrigin string `json:"timingAllowOrigin"`
+	// FollowRedirects is the maximum number of redirects from the
+	// destination server to follow before returning the response. Zero
+	// means redirects are returned to the client.
+	FollowRedirects int `json:"followRedirects"`
+	// Minify enables minification of HTML, CSS, and JavaScript responses.
+	Minify bool `json:"minify"`
+	// PrewarmConnections is the number of connections to open to each
+	// destination server in URL or URLs when the route is created, before
+	// any client requests, so that the first requests don't wait to
+	// connect.
+	PrewarmConnections int `json:"prewarmConnections"`
+	// HTTP10 makes requests to the destination server use HTTP/1.0, with
+	// a new connection for each request, for servers that don't support
+	// HTTP/1.1.
+	HTTP10 bool `json:"http10"`
+	// ServedBy, if set, adds an X-Served-By response header identifying
+	// the destination server that served the response. It is "url" for
+	// the destination server's URL, or "hash" for a stable ID derived
+	// from the URL that doesn't reveal it.
+	ServedBy string `json:"servedBy"`
+	// AllowContentTypes, if non-empty, lists the media types, such as
+	// "application/json", accepted for request bodies. Requests with a
+	// body of another type are rejected with 415.
+	AllowContentTypes []string `json:"allowContentTypes"`
+	// AllowPaths, if non-empty, lists the request paths that are
+	// proxied: exact paths, or prefixes if they end in "*", such as
+	// "/api/*". Requests for other paths are rejected with 404.
+	AllowPaths []string `json:"allowPaths"`
+	// DecompressRequest makes gzip-encoded request bodies be decompressed
+	// before they are sent to the destination server, and before
+	// MaxBodyBytes and JSONSchema are applied.
+	DecompressRequest bool `json:"decompressRequest"`
+	// NormalizeAcceptEncoding makes the Accept-Encoding header sent to the
+	// destination server be "gzip" if the client accepts gzip and
+	// "identity" otherwise, so that caches keyed on it aren't fragmented
+	// by the many forms clients send.
+	NormalizeAcceptEncoding bool `json:"normalizeAcceptEncoding"`
+	// TCPNoDelay, if set, sets TCP_NODELAY on connections to the
+	// destination server. Nil means Go's default, which is true.
+	TCPNoDelay *bool `json:"tcpNoDelay"`
+	// TCPReadBuffer and TCPWriteBuffer, if non-zero, are the sizes of the
+	// operating system's receive and send buffers for connections to the
+	// destination server.
+	TCPReadBuffer  int `json:"tcpReadBuffer"`
+	TCPWriteBuffer int `json:"tcpWriteBuffer"`
+	// RewriteCookieDomain makes the Domain attribute of Set-Cookie
+	// response headers be replaced with the public host.
+	RewriteCookieDomain bool `json:"rewriteCookieDomain"`
+	// RewriteCookiePath maps prefixes of the Path attribute of Set-Cookie
+	// response headers to their replacements, such as "/app/" to "/".
+	RewriteCookiePath map[string]string `json:"rewriteCookiePath"`
+	// JSONSchema, if set, is the path to a JSON Schema file that JSON
+	// request bodies must match. Requests that don't are rejected with
+	// 422.
+	JSONSchema string `json:"jsonSchema"`
+	// StatusFromHeader, if set, is a response header, such as X-Status,
+	// whose value replaces the status code of the destination server's
+	// response. The header is removed from the response.
+	StatusFromHeader string `json:"statusFromHeader"`
+	// RequireHTTPS rejects requests that didn't arrive over HTTPS with
+	// 400, instead of redirecting or proxying them. Requests from
+	// Conf.TrustedProxies are checked using their X-Forwarded-Proto.
+	RequireHTTPS bool `json:"requireHTTPS"`
+	// RequestTimeout, if non-zero, bounds the time to proxy a request,
+	// including reading the destination server's response. If it is
+	// exceeded before the response starts, the client gets a 504.
+	RequestTimeout Duration `json:"requestTimeout"`
+	// TimeoutPage, if set, is the path to a file served as the body of
+	// the 504 response when RequestTimeout is exceeded.
+	TimeoutPage string `json:"timeoutPage"`
+	// TimeoutContentType is the Content-Type of TimeoutPage. The default
+	// is "text/html; charset=utf-8".
+	TimeoutContentType string `json:"timeoutContentType"`
+	// StaticFallbackRoot, if set, is the path to a directory of files,
+	// such as a pre-rendered snapshot of the site, served for GET and
+	// HEAD requests when the destination servers can't be reached.
+	StaticFallbackRoot string `json:"staticFallbackRoot"`
+	// ResponseBuffer, if set, makes responses be read completely from the
+	// destination server before being sent to the client, with large
+	// bodies written to temporary files.
+	ResponseBuffer *ResponseBuffer `json:"responseBuffer"`
+	// UpstreamClientCert and UpstreamClientKey, if set, are the paths to
+	// the certificate and private key presented to the destination server
+	// when it requests a client certificate.
+	UpstreamClientCert string `json:"upstreamClientCert"`
+	UpstreamClientKey  string `json:"upstreamClientKey"`
+	// UpstreamCA, if set, is the path to the PEM-encoded certificates
+	// used to verify the destination server's certificate, instead of the
+	// system's.
+	UpstreamCA string `json:"upstreamCA"`
+	// LogLatency makes the 50th, 90th, and 99th percentile request
+	// latencies over Log.LatencyWindow be logged every
+	// Log.LatencyInterval.
+	LogLatency bool `json:"logLatency"`
+	// LogSizes makes the 50th, 90th, and 99th percentile request and
+	// response body sizes be logged every Log.LatencyInterval.
+	LogSizes bool `json:"logSizes"`
+	// LogHeaderSizes makes the 50th, 90th, and 99th percentile request
+	// and response header sizes be logged every Log.LatencyInterval.
+	LogHeaderSizes bool `json:"logHeaderSizes"`
+	// DropEarlyHints makes 103 Early Hints responses from the destination
+	// server not be forwarded to clients. Other 1xx responses still are.
+	DropEarlyHints bool `json:"dropEarlyHints"`
+	// Push makes the resources that responses preload with Link headers
+	// be pushed to HTTP/2 clients that allow it, unless HTTP2.DisablePush
+	// is set.
+	Push bool `json:"push"`
+	// Allow and Deny are lists of IP addresses and CIDR ranges of clients
+	// that may and may not make requests for the host. Deny takes
+	// precedence; an empty Allow allows all clients.
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	// Dedup, if set, drops duplicate requests, such as retried webhook
+	// deliveries, identified by a header.
+	Dedup *Dedup `json:"dedup"`
+	// ABTest, if set, splits clients between destination servers other
+	// than URL, which is then unused apart from failover.
+	ABTest *ABTest `json:"abTest"`
+	// Mirror, if set, is the base URL of a shadow destination server
+	// that gets a copy of each request. Its responses are discarded.
+	Mirror string `json:"mirror"`
+	// SignedURL, if set, rejects requests without a valid signature in
+	// their query with 403.
+	SignedURL *SignedURL `json:"signedURL"`
+	// RewriteMethod maps request methods to the methods used for the
+	// requests to the destination server, such as {"POST": "PUT"}.
+	RewriteMethod map[string]string `json:"rewriteMethod"`
+	// MaxBodyBytes, if non-zero, is the largest request body accepted.
+	// Requests with larger bodies are rejected with 413. Bodies of
+	// unknown length are buffered, in memory up to 1 MiB and in a
+	// temporary file beyond that.
+	MaxBodyBytes int64 `json:"maxBodyBytes"`
+}
+
+func (u *Upstream) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*u = Upstream{URL: s}
+		return nil
 	}
+	var urls []string
+	if err := json.Unmarshal(data, &urls); err == nil {
+		if len(urls) == 0 {
+			return errors.New("empty array of destination server URLs")
+		}
+		*u = Upstream{URLs: urls}
+		return nil
+	}
+	type upstream Upstream // avoid recursion
+	return json.Unmarshal(data, (*upstream)(u))
+}
+
+// Duration is a time.Duration represented in JSON as a string accepted by
+// time.ParseDuration, such as "1m30s".
+type Duration time.Duration
 
-	proxyURLs, err := toURLs(c.Proxy)
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %s", data)
+	}
+	v, err := time.ParseDuration(s)
 	if err != nil {
-		// should be nil; should have been handled earlier in checkConf.
-		panic(err)
+		return err
 	}
+	*d = Duration(v)
+	return nil
+}
 
-	var g errgroup.Group
+// route is the ready-to-use form of an Upstream.
+type route struct {
+	target    url.URL // of the first backend
+	transport http.RoundTripper
 
-	g.Go(func() error {
-		mux := http.NewServeMux()
-		mux.Handle("/", httpHandler(proxyURLs))
-		if c.AcmeChallenge != "" {
-			mux.Handle("/.well-known/acme-challenge/", http.StripPrefix("/.well-known/acme-challenge/", http.FileServer(http.Dir(c.AcmeChallenge))))
-		}
-		log.Printf("listening http on :80")
-		return http.ListenAndServe(":80", mux)
-	})
+	backends []*backend
+	next     atomic.Uint64 // for round-robin between backends
+	health   *healthCheck  // nil means no health checks
 
-	g.Go(func() error {
-		var cert, key string
-		var s *http.Server
+	failover      []url.URL
+	retryOnStatus map[int]bool
+	maxRetries    int
+	retryBudget   *retryBudget
+	retryBuffer   int64 // largest request body buffered for retries
 
-		if c.Certs.Auto {
-			m := &autocert.Manager{
-				Prompt:      autocert.AcceptTOS,
-				Cache:       autocert.DirCache(c.Certs.CertDir),
-				HostPolicy:  autocert.HostWhitelist(c.Domains...),
-				RenewBefore: renewBefore,
+	defaultCacheControl string
+	timingAllowOrigin   string
+	minify              bool
+	prewarmConns        int
+	servedBy            string
+	decompressRequest   bool
+	normalizeEncoding   bool           // of Accept-Encoding
+	cookies             *cookieRewrite // nil means no rewriting
+	schema              *jsonschema.Schema
+	statusFromHeader    string
+	requireHTTPS        bool
+	latency             *latencyTracker // nil means not tracked
+	sizes               *sizeTracker    // nil means not tracked
+	headerSizes         *sizeTracker    // nil means not tracked
+	abTest              *abTest
+	mirror              *mirror
+	signedURL           *signedURL
+	rewriteMethod       map[string]string
+	maxBodyBytes        int64
+	dropEarlyHints      bool
+	push                bool
+	dedup               *dedup          // nil means no deduplication
+	responseBuffer      *responseBuffer // nil means responses are streamed
+	ipFilter            *ipFilter       // nil means all clients are allowed
+
+	requestTimeout     time.Duration
+	timeoutPage        []byte // nil means the default body
+	timeoutContentType string
+
+	staticFallback http.Handler // nil means none
+
+	allowContentTypes map[string]bool // nil means all are allowed
+	allowPaths        *pathAllowlist  // nil means all are allowed
+}
+
+// newRoutes returns the routes for the proxy map, keyed by request host
+// or by request host and path prefix. IPv6 literal hosts are keyed in
+// canonical form.
+func newRoutes(proxy map[string]Upstream) (map[string]*route, error) {
+	m := make(map[string]*route)
+	for k, v := range proxy {
+		if err := checkRouteKey(k); err != nil {
+			return nil, err
+		}
+		urls := v.URLs
+		if len(urls) == 0 {
+			urls = []string{v.URL}
+		} else if v.URL != "" {
+			return nil, fmt.Errorf("require only one of url and urls for %s", k)
+		}
+		var backends []*backend
+		for _, s := range urls {
+			u, err := url.Parse(s)
+			if err != nil {
+				return nil, fmt.Errorf("parse %s: %s", s, err)
 			}
-			s = &http.Server{
-				Addr:      ":443",
-				Handler:   httpsHandler(proxyURLs),
-				TLSConfig: m.TLSConfig(),
+			if len(urls) > 1 && u.Host == "" {
+				return nil, fmt.Errorf("missing host in %q for %s", s, k)
 			}
-		} else {
-			s = &http.Server{
-				Addr:    ":443",
-				Handler: httpsHandler(proxyURLs),
+			backends = append(backends, newBackend(*u))
+		}
+		if v.SOCKS5Proxy != "" {
+			if _, _, err := net.SplitHostPort(v.SOCKS5Proxy); err != nil {
+				return nil, fmt.Errorf("bad socks5Proxy %q for %s: %s", v.SOCKS5Proxy, k, err)
 			}
-			cert = c.Certs.CertFile
-			key = c.Certs.KeyFile
+		}
+		if v.DialTimeout < 0 || v.ResponseHeaderTimeout < 0 || v.IdleConnTimeout < 0 || v.ConnMaxLifetime < 0 {
+			return nil, fmt.Errorf("negative timeout for %s", k)
+		}
+		tlsConfig, err := upstreamTLSConfig(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err)
+		}
+		r := &route{
+			target:              backends[0].target,
+			backends:            backends,
+			transport:           newTransport(v, tlsConfig),
+			maxRetries:          v.MaxRetries,
+			defaultCacheControl: v.DefaultCacheControl,
+			timingAllowOrigin:   v.TimingAllowOrigin,
+			minify:              v.Minify,
+			prewarmConns:        v.PrewarmConnections,
+			servedBy:            v.ServedBy,
+			decompressRequest:   v.DecompressRequest,
+			normalizeEncoding:   v.NormalizeAcceptEncoding,
+			cookies:             newCookieRewrite(v.RewriteCookieDomain, v.RewriteCookiePath),
+			statusFromHeader:    v.StatusFromHeader,
+			requireHTTPS:        v.RequireHTTPS,
+			requestTimeout:      time.Duration(v.RequestTimeout),
+			timeoutContentType:  v.TimeoutContentType,
 		}
 
-		log.Printf("listening https on %s", s.Addr)
-		return s.ListenAndServeTLS(cert, key)
-	})
+		for _, f := range v.Failover {
+			u, err := url.Parse(f)
+			if err != nil {
+				return nil, fmt.Errorf("parse %s: %s", f, err)
+			}
+			r.failover = append(r.failover, *u)
+		}
+		if len(v.RetryOnStatus) > 0 && len(v.Failover) == 0 {
+			return nil, fmt.Errorf("require failover for retryOnStatus for %s", k)
+		}
+		for _, code := range v.RetryOnStatus {
+			if code < 200 || code > 599 {
+				return nil, fmt.Errorf("bad retryOnStatus code %d for %s", code, k)
+			}
+			if r.retryOnStatus == nil {
+				r.retryOnStatus = make(map[int]bool)
+			}
+			r.retryOnStatus[code] = true
+		}
+		if v.MaxRetries < 0 {
+			return nil, fmt.Errorf("negative maxRetries for %s", k)
+		}
+		if v.FollowRedirects < 0 {
+			return nil, fmt.Errorf("negative followRedirects for %s", k)
+		}
+		for from, to := range v.RewriteCookiePath {
+			if !strings.HasPrefix(from, "/") || !strings.HasPrefix(to, "/") {
+				return nil, fmt.Errorf("rewriteCookiePath paths must start with / for %s", k)
+			}
+		}
+		if !httpguts.ValidHeaderFieldValue(v.TimingAllowOrigin) {
+			return nil, fmt.Errorf("bad timingAllowOrigin %q for %s", v.TimingAllowOrigin, k)
+		}
+		if v.StatusFromHeader != "" && !httpguts.ValidHeaderFieldName(v.StatusFromHeader) {
+			return nil, fmt.Errorf("bad statusFromHeader %q for %s", v.StatusFromHeader, k)
+		}
+		if v.RetryBudget != nil && len(v.Failover) == 0 {
+			return nil, fmt.Errorf("require failover for retryBudget for %s", k)
+		}
+		r.retryBudget, err = newRetryBudget(v.RetryBudget)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err)
+		}
+		if v.RetryBufferBytes < 0 {
+			return nil, fmt.Errorf("negative retryBufferBytes for %s", k)
+		}
+		if v.RetryBufferBytes > 0 && len(v.Failover) == 0 {
+			return nil, fmt.Errorf("require failover for retryBufferBytes for %s", k)
+		}
+		r.retryBuffer = v.RetryBufferBytes
+		if v.RetryEmptyResponse {
+			r.transport = &emptyResponseRetrier{transport: r.transport}
+		}
+		r.abTest, err = newABTest(v.ABTest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err)
+		}
+		if v.HealthCheckInterval < 0 {
+			return nil, fmt.Errorf("negative healthCheckInterval for %s", k)
+		}
+		if v.HealthCheckPath != "" {
+			r.health = &healthCheck{path: v.HealthCheckPath, interval: time.Duration(v.HealthCheckInterval)}
+			if r.health.interval == 0 {
+				r.health.interval = defaultHealthCheckInterval
+			}
+		}
+		r.signedURL, err = newSignedURL(v.SignedURL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err)
+		}
+		r.responseBuffer, err = newResponseBuffer(v.ResponseBuffer)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err)
+		}
+		r.ipFilter, err = newIPFilter(k+": ", v.Allow, v.Deny)
+		if err != nil {
+			return nil, err
+		}
+		r.dedup, err = newDedup(v.Dedup)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err)
+		}
+		r.allowPaths, err = newPathAllowlist(v.AllowPaths)
+		if err != nil {
+			return nil, fmt.Errorf("%s for %s", err, k)
+		}
+		for from, to := range v.RewriteMethod {
+			if !httpguts.ValidHeaderFieldName(from) || !httpguts.ValidHeaderFieldName(to) {
+				return nil, fmt.Errorf("bad rewriteMethod %q: %q for %s", from, to, k)
+			}
+		}
+		r.rewriteMethod = v.RewriteMethod
+		if v.MaxBodyBytes < 0 {
+			return nil, fmt.Errorf("negative maxBodyBytes for %s", k)
+		}
+		r.maxBodyBytes = v.MaxBodyBytes
+		if v.Mirror != "" {
+			mu, err := url.Parse(v.Mirror)
+			if err != nil {
+				return nil, fmt.Errorf("parse %s: %s", v.Mirror, err)
+			}
+			// the mirror is reached like the destination server.
+			r.mirror = newMirror(*mu, newTransport(v, tlsConfig))
+		}
+		if v.LogLatency {
+			r.latency = &latencyTracker{}
+		}
+		if v.LogSizes {
+			r.sizes = &sizeTracker{}
+		}
+		if v.LogHeaderSizes {
+			r.headerSizes = &sizeTracker{}
+		}
+		r.dropEarlyHints = v.DropEarlyHints
+		r.push = v.Push
+		if v.RequestTimeout < 0 {
+			return nil, fmt.Errorf("negative requestTimeout for %s", k)
+		}
+		if v.TimeoutPage != "" {
+			if v.RequestTimeout == 0 {
+				return nil, fmt.Errorf("require requestTimeout for timeoutPage for %s", k)
+			}
+			r.timeoutPage, err = os.ReadFile(v.TimeoutPage)
+			if err != nil {
+				return nil, fmt.Errorf("read timeoutPage for %s: %s", k, err)
+			}
+			if r.timeoutContentType == "" {
+				r.timeoutContentType = "text/html; charset=utf-8"
+			}
+		}
+		if v.StaticFallbackRoot != "" {
+			fi, err := os.Stat(v.StaticFallbackRoot)
+			if err != nil {
+				return nil, fmt.Errorf("staticFallbackRoot for %s: %s", k, err)
+			}
+			if !fi.IsDir() {
+				return nil, fmt.Errorf("staticFallbackRoot for %s is not a directory", k)
+			}
+			r.staticFallback = http.FileServer(http.Dir(v.StaticFallbackRoot))
+		}
+		if v.JSONSchema != "" {
+			r.schema, err = jsonschema.Compile(v.JSONSchema)
+			if err != nil {
+				return nil, fmt.Errorf("jsonSchema for %s: %s", k, err)
+			}
+		}
+		if v.TCPReadBuffer < 0 || v.TCPWriteBuffer < 0 {
+			return nil, fmt.Errorf("negative tcp buffer size for %s", k)
+		}
+		if v.PrewarmConnections < 0 {
+			return nil, fmt.Errorf("negative prewarmConnections for %s", k)
+		}
+		switch v.ServedBy {
+		case "", "url", "hash":
+		default:
+			return nil, fmt.Errorf("unknown servedBy %q for %s", v.ServedBy, k)
+		}
+		for _, ct := range v.AllowContentTypes {
+			mt, _, err := mime.ParseMediaType(ct)
+			if err != nil {
+				return nil, fmt.Errorf("bad allowContentTypes entry %q for %s: %s", ct, k, err)
+			}
+			if r.allowContentTypes == nil {
+				r.allowContentTypes = make(map[string]bool)
+			}
+			r.allowContentTypes[mt] = true
+		}
+		if v.HTTP10 && v.PrewarmConnections > 0 {
+			return nil, fmt.Errorf("prewarmConnections cannot be used with http10 for %s", k)
+		}
+		if v.MaxRetries == 0 || v.MaxRetries > len(r.failover) {
+			r.maxRetries = len(r.failover)
+		}
 
-	return g.Wait()
+		host, prefix := splitRouteKey(k)
+		key := canonicalHost(host) + prefix
+		if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("duplicate proxy key %s", k)
+		}
+		m[key] = r
+	}
+	return m, nil
 }
 
-func httpHandler(proxy map[string]url.URL) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// if no mapping exists reject with a 502.
-		if _, ok := proxy[r.Host]; !ok {
-			http.Error(w, http.StatusText(502), 502)
-			return
-		}
+// serveTimeout responds to a request that exceeded the route's request
+// timeout, with the route's timeout page or else that of o.
+func (rt *route) serveTimeout(w http.ResponseWriter, r *http.Request, o options) {
+	if rt.timeoutPage == nil {
+		o.httpError(w, r, http.StatusGatewayTimeout)
+		return
+	}
+	o.echoRequestID(w.Header(), r.Context())
+	w.Header().Set("Content-Type", rt.timeoutContentType)
+	w.WriteHeader(http.StatusGatewayTimeout)
+	w.Write(rt.timeoutPage)
+}
 
-		// redirect to https
-		u := *r.URL
-		u.Scheme = "https"
-		// explicitly set Host on the URL, otherwise only Path and
-		// RawQuery will be present.
-		u.Host = r.Host
-		http.Redirect(w, r, u.String(), http.StatusFound)
-	})
+// closeIdleConnections closes the idle connections to the route's
+// destination servers.
+func (rt *route) closeIdleConnections() {
+	if t, ok := rt.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
 }
 
-func httpsHandler(proxy map[string]url.URL) http.Handler {
-	revproxy := &httputil.ReverseProxy{
-		Rewrite: rewriter(proxy),
-		ErrorHandler: func(rw http.ResponseWriter, req *http.Request, err error) {
-			log.Printf("proxy error: %v", err)
-			http.Error(rw, http.StatusText(502), 502)
-		},
+// allowsContentType reports whether the request's body, if any, has an
+// allowed media type.
+func (rt *route) allowsContentType(r *http.Request) bool {
+	if rt.allowContentTypes == nil || r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
 	}
+	return rt.allowContentTypes[mt]
+}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// if no mapping exists reject with a 502.
-		if _, ok := proxy[r.Host]; !ok {
-			http.Error(w, http.StatusText(502), 502)
-			return
-		}
-		revproxy.ServeHTTP(w, r)
-	})
+// options holds the handler settings other than the routes. The zero value
+// is the default behavior.
+type options struct {
+	apex      Apex
+	apexPage  []byte
+	canonical map[string]string // non-canonical host to canonical host
+	via       string
+
+	instanceHeaders map[string]string
+	httpOnly        map[string]bool // hosts proxied over http
+	trustedProxies  []*net.IPNet
+	trustForwarded  bool             // keep inbound X-Forwarded-For and -Proto
+	httpsPort       string           // port of the HTTPS server, if not 443
+	redirectStatus  int              // zero means the default of each redirect
+	redirects       *redirectCounter // nil means redirects aren't counted
+	healthPath      string           // empty means no health check endpoint
+	reloadPath      string           // empty means no reload status endpoint
+	maxHeaderCount  int
+	logConns        bool   // log upstream connection reuse
+	hsts            string // Strict-Transport-Security value; empty means none
+	hstsOverride    bool
+	errorPages      map[int]errorPage // nil means plain text errors
+	jsonErrors      bool
+	requestIDHeader string                // empty means no request IDs
+	rateLimiter     *clientLimiter        // nil means no limit
+	ipFilter        *ipFilter             // nil means all clients are allowed
+	auth            map[string]*basicAuth // by canonical host
+	compression     *compression          // nil means no compression
+	disablePush     bool
+	logHeaders      []string // canonical names of headers in the access log
+
+	// certReady, if non-nil, reports whether the HTTPS server has a
+	// certificate for a host.
+	certReady func(host string) bool
+	// reloads, if non-nil, is the running config whose reload outcomes
+	// are served at reloadPath.
+	reloads *runningConf
 }
 
-// rewriter returns a function that is suitable for use as the
-// Rewriter field of httputil.ReverseProxy. The proxy parameter is a map from
-// known request hosts to destination server base URLs. The returned function
-// modifies the request such that a request to a known host is redirected to
-// the appropriate destination server base URL, based on the proxy map.
-//
-// The returned function must be used only with a request whose Host exists in
-// the proxy map. Otherwise the returned function panics.
-func rewriter(proxy map[string]url.URL) func(*httputil.ProxyRequest) {
-	return func(pr *httputil.ProxyRequest) {
-		dest, ok := proxy[pr.In.Host]
-		if !ok {
-			panic("unknown host " + pr.In.Host)
+func newOptions(c Conf) (options, error) {
+	o := options{
+		apex:            c.Apex,
+		via:             c.Via,
+		instanceHeaders: c.InstanceHeaders,
+		logConns:        c.Log.UpstreamConns,
+		maxHeaderCount:  c.MaxHeaderCount,
+		redirectStatus:  c.RedirectStatus,
+		healthPath:      c.HealthPath,
+		reloadPath:      c.ReloadStatusPath,
+		hsts:            c.HSTS.header(),
+		hstsOverride:    c.HSTS.Override,
+		trustForwarded:  c.TrustForwardedHeaders,
+		jsonErrors:      c.ErrorFormat == "json",
+		requestIDHeader: http.CanonicalHeaderKey(c.RequestIDHeader),
+		disablePush:     c.HTTP2.DisablePush,
+	}
+
+	if strings.ContainsAny(c.Via, " \t,;=\"()") {
+		return options{}, fmt.Errorf("via %q must not contain whitespace or separators", c.Via)
+	}
+	for k, v := range c.InstanceHeaders {
+		if !httpguts.ValidHeaderFieldName(k) || !httpguts.ValidHeaderFieldValue(v) {
+			return options{}, fmt.Errorf("bad instance header %q: %q", k, v)
 		}
-		pr.SetURL(&dest)
-		pr.Out.Host = pr.In.Host
-		pr.SetXForwarded()
 	}
+
+	if c.HealthPath != "" && !strings.HasPrefix(c.HealthPath, "/") {
+		return options{}, fmt.Errorf("healthPath %q must start with /", c.HealthPath)
+	}
+	if c.ReloadStatusPath != "" && !strings.HasPrefix(c.ReloadStatusPath, "/") {
+		return options{}, fmt.Errorf("reloadStatusPath %q must start with /", c.ReloadStatusPath)
+	}
+	if c.ReloadStatusPath != "" && c.ReloadStatusPath == c.HealthPath {
+		return options{}, errors.New("reloadStatusPath must differ from healthPath")
+	}
+
+	if c.HTTPSAddr != "" {
+		_, port, err := net.SplitHostPort(c.HTTPSAddr)
+		if err != nil {
+			return options{}, fmt.Errorf("bad httpsAddr %q: %s", c.HTTPSAddr, err)
+		}
+		if port != "443" {
+			o.httpsPort = port
+		}
+	}
+
+	trusted, err := parseIPNets("trustedProxies", c.TrustedProxies)
+	if err != nil {
+		return options{}, err
+	}
+	o.trustedProxies = trusted
+
+	for _, h := range c.HTTPOnlyHosts {
+		if _, ok := c.Proxy[h]; !ok {
+			return options{}, fmt.Errorf("httpOnlyHosts entry %s is not in proxy", h)
+		}
+		for _, d := range c.Domains {
+			if strings.EqualFold(hostname(h), d) || (isWildcard(d) && wildcardCovers(d, hostname(h))) {
+				return options{}, fmt.Errorf("httpOnlyHosts entry %s must not be in domains", h)
+			}
+		}
+		if o.httpOnly == nil {
+			o.httpOnly = make(map[string]bool)
+		}
+		o.httpOnly[canonicalHost(h)] = true
+	}
+
+	switch c.Apex.Action {
+	case "":
+	case "redirect":
+		if c.Apex.Redirect == "" {
+			return options{}, errors.New("require apex.redirect when apex.action == \"redirect\"")
+		}
+	case "page":
+		if c.Apex.Page == "" {
+			return options{}, errors.New("require apex.page when apex.action == \"page\"")
+		}
+		b, err := os.ReadFile(c.Apex.Page)
+		if err != nil {
+			return options{}, fmt.Errorf("read apex page: %s", err)
+		}
+		o.apexPage = b
+	default:
+		return options{}, fmt.Errorf("unknown apex.action %q", c.Apex.Action)
+	}
+
+	for _, k := range c.AccessLogHeaders {
+		if !httpguts.ValidHeaderFieldName(k) {
+			return options{}, fmt.Errorf("bad accessLogHeaders entry %q", k)
+		}
+		o.logHeaders = append(o.logHeaders, http.CanonicalHeaderKey(k))
+	}
+
+	canonical, err := newCanonicalHosts(c.Canonical)
+	if err != nil {
+		return options{}, err
+	}
+	o.canonical = canonical
+
+	if c.ErrorFormat != "" && c.ErrorFormat != "text" && c.ErrorFormat != "json" {
+		return options{}, fmt.Errorf("unknown errorFormat %q", c.ErrorFormat)
+	}
+	if c.RequestIDHeader != "" && !httpguts.ValidHeaderFieldName(c.RequestIDHeader) {
+		return options{}, fmt.Errorf("bad requestIDHeader %q", c.RequestIDHeader)
+	}
+
+	o.ipFilter, err = newIPFilter("", c.Allow, c.Deny)
+	if err != nil {
+		return options{}, err
+	}
+
+	for h := range c.Auth {
+		if !hasHost(c.Proxy, h) {
+			return options{}, fmt.Errorf("auth host %s is not in proxy", h)
+		}
+	}
+	o.auth, err = parseAuth(c.Auth)
+	if err != nil {
+		return options{}, err
+	}
+
+	limiter, err := newClientLimiter(c.RateLimit)
+	if err != nil {
+		return options{}, err
+	}
+	o.rateLimiter = limiter
+
+	o.compression, err = newCompression(c.Compression)
+	if err != nil {
+		return options{}, err
+	}
+
+	o.redirects, err = newRedirectCounter(c.MaxRedirects)
+	if err != nil {
+		return options{}, err
+	}
+
+	pages, err := readErrorPages(c.ErrorPages)
+	if err != nil {
+		return options{}, err
+	}
+	o.errorPages = pages
+
+	return o, nil
+}
+
+// dialContext dials destination servers. It is a variable so that tests
+// can simulate slow connections.
+var dialContext = (&net.Dialer{KeepAlive: 30 * time.Second}).DialContext
+
+const defaultDialTimeout = 30 * time.Second
+
+// newTransport returns the transport used to talk to the destination
+// server of the upstream. tlsConfig, if non-nil, is used for TLS
+// connections.
+func newTransport(u Upstream, tlsConfig *tls.Config) http.RoundTripper {
+	if u.HTTP10 {
+		t := &http10Transport{
+			dial:                  newDialer(u),
+			tlsConfig:             tlsConfig,
+			responseHeaderTimeout: time.Duration(u.ResponseHeaderTimeout),
+		}
+		if u.FollowRedirects > 0 {
+			return &redirectFollower{transport: t, max: u.FollowRedirects}
+		}
+		return t
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = newDialer(u)
+	t.TLSClientConfig = tlsConfig
+	t.ResponseHeaderTimeout = time.Duration(u.ResponseHeaderTimeout)
+	if u.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = time.Duration(u.IdleConnTimeout)
+	}
+	if u.PrewarmConnections > http.DefaultMaxIdleConnsPerHost {
+		// keep the prewarmed connections in the pool.
+		t.MaxIdleConnsPerHost = u.PrewarmConnections
+	}
+
+	var rt http.RoundTripper = t
+	if u.ConnMaxLifetime > 0 {
+		t.DialContext = limitConnLifetime(t.DialContext, time.Duration(u.ConnMaxLifetime))
+		rt = &connLifetimeTracker{transport: t}
+	}
+	if u.FollowRedirects > 0 {
+		return &redirectFollower{transport: rt, max: u.FollowRedirects}
+	}
+	return rt
+}
+
+// errResponseHeaderTimeout is returned by transports that implement
+// Upstream.ResponseHeaderTimeout themselves.
+var errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// isResponseHeaderTimeout reports whether err is the result of the
+// destination server not sending response headers within
+// Upstream.ResponseHeaderTimeout.
+func isResponseHeaderTimeout(err error) bool {
+	if errors.Is(err, errResponseHeaderTimeout) {
+		return true
+	}
+	// net/http doesn't export the error.
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout() &&
+		strings.Contains(err.Error(), "timeout awaiting response headers")
+}
+
+// isDialError reports whether err is the result of failing to connect to
+// the destination server.
+func isDialError(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
+
+// newDialer returns the function used to connect to the destination server
+// of the upstream.
+func newDialer(u Upstream) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialTimeout := defaultDialTimeout
+	if u.DialTimeout > 0 {
+		dialTimeout = time.Duration(u.DialTimeout)
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialContext(ctx, network, addr)
+	}
+	if u.SOCKS5Proxy != "" {
+		d, err := proxy.SOCKS5("tcp", u.SOCKS5Proxy, nil, dialerFunc(dial))
+		if err != nil {
+			panic(err) // only fails for unknown dialer types
+		}
+		dial = d.(proxy.ContextDialer).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := tuneConn(conn, u); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// dialerFunc adapts a dial function to proxy.Dialer and proxy.ContextDialer.
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// tuneConn applies the upstream's socket options to conn.
+func tuneConn(conn net.Conn, u Upstream) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if u.TCPNoDelay != nil {
+		if err := tc.SetNoDelay(*u.TCPNoDelay); err != nil {
+			return err
+		}
+	}
+	if u.TCPReadBuffer > 0 {
+		if err := tc.SetReadBuffer(u.TCPReadBuffer); err != nil {
+			return err
+		}
+	}
+	if u.TCPWriteBuffer > 0 {
+		if err := tc.SetWriteBuffer(u.TCPWriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routeTransport is a http.RoundTripper that sends each request using the
+// transport of the route in the request's context.
+type routeTransport struct{}
+
+func (routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := routeFrom(req.Context())
+	if r == nil {
+		return nil, fmt.Errorf("no route for host %s", req.Host)
+	}
+	return r.transport.RoundTrip(req)
+}
+
+// routeTable holds the routes, keyed by request host. The routes can be
+// replaced while the handlers are using them.
+type routeTable struct {
+	p atomic.Pointer[map[string]*route]
+}
+
+func newRouteTable(routes map[string]*route) *routeTable {
+	t := &routeTable{}
+	t.store(routes)
+	return t
+}
+
+func (t *routeTable) load() map[string]*route {
+	return *t.p.Load()
+}
+
+func (t *routeTable) store(routes map[string]*route) {
+	t.p.Store(&routes)
+}
+
+// replace stores routes in place of the current routes, whose idle
+// connections are then closed since their transports are no longer used
+// for new requests. Requests in flight keep their connections.
+func (t *routeTable) replace(routes map[string]*route) {
+	old := t.load()
+	t.store(routes)
+	prewarmAll(routes)
+	for _, r := range old {
+		r.closeIdleConnections()
+	}
+}
+
+type routeKey struct{}
+
+// withRoute returns a copy of ctx that carries the route chosen for a
+// request, so that every stage of proxying the request uses the same route
+// even if the route table changes meanwhile.
+func withRoute(ctx context.Context, r *route) context.Context {
+	return context.WithValue(ctx, routeKey{}, r)
+}
+
+func routeFrom(ctx context.Context) *route {
+	r, _ := ctx.Value(routeKey{}).(*route)
+	return r
+}
+
+type Certs struct {
+	Auto     bool   `json:"auto"`
+	CertDir  string `json:"certDir"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// Pairs lists more certificate and key files, when Auto is false,
+	// for hosts that the certificate of CertFile doesn't cover. The
+	// certificate for a connection is selected by the server name that
+	// the client asks for.
+	Pairs []CertPair `json:"pairs"`
+	// MaxConcurrentIssuance limits the number of certificates obtained
+	// concurrently when Auto is true. Zero means no limit.
+	MaxConcurrentIssuance int `json:"maxConcurrentIssuance"`
+	// PendingNotice, when Auto is true, makes the HTTP server respond with
+	// a notice to retry, instead of redirecting to HTTPS, for hosts whose
+	// certificate hasn't been obtained yet.
+	PendingNotice bool `json:"pendingNotice"`
+	// MaxAge, if non-zero, is the age at which a certificate obtained
+	// when Auto is true is replaced, even if it isn't near expiry. It must
+	// be at least 24 hours.
+	MaxAge Duration `json:"maxAge"`
+	// AutoIncludeWWW makes certificates also be obtained, when Auto is
+	// true, for the "www." counterpart of each of Domains, or the apex
+	// counterpart of a "www." domain.
+	AutoIncludeWWW bool `json:"autoIncludeWWW"`
+	// ACMEDirectory, if set, is the directory URL of the ACME server that
+	// certificates are obtained from when Auto is true, or "staging" for
+	// that of Let's Encrypt's staging environment. The empty string means
+	// Let's Encrypt's production environment.
+	ACMEDirectory string `json:"acmeDirectory"`
+	// ACMEEmail, if set, is the contact email address of the ACME account,
+	// for notices such as of certificates about to expire.
+	ACMEEmail string `json:"acmeEmail"`
+	// DNSProvider, if set, is the DNS provider used to obtain certificates
+	// for wildcard domains, such as "*.example.com", in Domains with the
+	// DNS-01 challenge, when Auto is true.
+	DNSProvider *DNSProvider `json:"dnsProvider"`
+}
+
+func run(ctx context.Context) error {
+	flag.Usage = printUsage
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	c, err := parseConf(flag.Arg(0))
+	if err != nil {
+		return fmt.Errorf("parse conf: %s", err)
+	}
+	if err := checkConf(c); err != nil {
+		return fmt.Errorf("check conf: %s", err)
+	}
+	if c.Log.Syslog != nil {
+		w, err := openSyslog(*c.Log.Syslog)
+		if err != nil {
+			log.Printf("warning: logging to stderr: open syslog: %s", err)
+		} else {
+			log.SetOutput(w)
+		}
+	}
+
+	routes, err := newRoutes(c.Proxy)
+	if err != nil {
+		// should be nil; should have been handled earlier in checkConf.
+		panic(err)
+	}
+	table := newRouteTable(routes)
+	prewarmAll(routes)
+
+	rc := newRunningConf(c, table)
+	if c.ConfigURL != "" {
+		interval := time.Duration(c.ConfigInterval)
+		if interval == 0 {
+			interval = defaultConfigInterval
+		}
+		p := &configPoller{url: c.ConfigURL, conf: rc}
+		go p.run(ctx, interval)
+	}
+	go reloadOnHangup(ctx, flag.Arg(0), rc)
+	go runHealthChecks(ctx, table)
+	statsInterval, statsWindow := latencyWindow(c.Log)
+	go reportStats(ctx, table, statsInterval, statsWindow)
+	opts, err := newOptions(c)
+	if err != nil {
+		// should be nil; should have been handled earlier in checkConf.
+		panic(err)
+	}
+	opts.reloads = rc
+
+	var limiter *issuanceLimiter
+	var manager *autocert.Manager
+	var getTLSCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	if c.Certs.Auto {
+		manager = newAutocertManager(c)
+		limiter = newIssuanceLimiter(manager.GetCertificate, c.Certs.MaxConcurrentIssuance)
+		if c.Certs.PendingNotice {
+			opts.certReady = limiter.Prepare
+		}
+		getTLSCertificate = limiter.GetCertificate
+	}
+	if c.Certs.DNSProvider != nil {
+		iss, err := newDNS01Issuer(c.Certs)
+		if err != nil {
+			// should be nil; should have been handled earlier in checkConf.
+			panic(err)
+		}
+		wildcards := newWildcardCerts(c.Domains, c.Certs.CertDir, time.Duration(c.Certs.MaxAge))
+		wildcards.obtain = iss.obtain
+		go wildcards.run(ctx)
+		getTLSCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if _, ok := wildcards.covering(hello.ServerName); ok {
+				return wildcards.GetCertificate(hello)
+			}
+			return limiter.GetCertificate(hello)
+		}
+		if c.Certs.PendingNotice {
+			opts.certReady = func(host string) bool {
+				if _, ok := wildcards.covering(host); ok {
+					return wildcards.ready(host)
+				}
+				return limiter.Prepare(host)
+			}
+		}
+	}
+
+	withAccessLog := func(h http.Handler) http.Handler {
+		if c.AccessLog == "off" {
+			return h
+		}
+		// the request ID is set outside accessLog, so that the line
+		// has it.
+		return opts.requestIDHandler(accessLog(h, c.AccessLog, log.Writer()))
+	}
+
+	httpAddr := c.HTTPAddr
+	if httpAddr == "" {
+		httpAddr = ":80"
+	}
+	httpsAddr := c.HTTPSAddr
+	if httpsAddr == "" {
+		httpsAddr = ":443"
+	}
+	httpL, httpsL, httpErr, httpsErr := bindServers(c.BindHTTPSFirst == nil || *c.BindHTTPSFirst, httpAddr, httpsAddr)
+
+	serveHTTP := func() error {
+		if httpErr != nil {
+			return httpErr
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/", httpHandler(table, opts))
+		if c.AcmeChallenge != "" {
+			mux.Handle("/.well-known/acme-challenge/", http.StripPrefix("/.well-known/acme-challenge/", http.FileServer(http.Dir(c.AcmeChallenge))))
+		}
+		s := &http.Server{Addr: httpAddr, Handler: withAccessLog(mux)}
+		setTimeouts(s, c.Timeouts)
+		if c.MaxRequestsPerConn > 0 {
+			limitConnRequests(s, c.MaxRequestsPerConn)
+		}
+		log.Printf("listening http on %s", s.Addr)
+		return s.Serve(httpL)
+	}
+
+	serveHTTPS := func() error {
+		if httpsErr != nil {
+			return httpsErr
+		}
+		var s *http.Server
+
+		if c.Certs.Auto {
+			tlsConfig := manager.TLSConfig()
+			tlsConfig.GetCertificate = getTLSCertificate
+			s = &http.Server{
+				Addr:      httpsAddr,
+				Handler:   withAccessLog(httpsHandler(table, opts)),
+				TLSConfig: tlsConfig,
+			}
+		} else {
+			// the files may have changed since checkConf.
+			certs, err := loadCertificates(c.Certs)
+			if err != nil {
+				httpsL.Close()
+				return err
+			}
+			s = &http.Server{
+				Addr:      httpsAddr,
+				Handler:   withAccessLog(httpsHandler(table, opts)),
+				TLSConfig: &tls.Config{Certificates: certs},
+			}
+		}
+
+		if err := configureTLS(s.TLSConfig, c.TLS); err != nil {
+			// should be nil; should have been handled earlier in checkConf.
+			panic(err)
+		}
+		hl := &handshakeLogger{off: c.Log.TLSHandshakeErrors == "off"}
+		hl.install(s)
+		if err := configureHTTP2(s, c.HTTP2); err != nil {
+			httpsL.Close()
+			return err
+		}
+		setTimeouts(s, c.Timeouts)
+		if c.MaxRequestsPerConn > 0 {
+			limitConnRequests(s, c.MaxRequestsPerConn)
+		}
+
+		log.Printf("listening https on %s", s.Addr)
+		return s.ServeTLS(httpsL, "", "")
+	}
+
+	return serveAll(c.FailFast == nil || *c.FailFast, serveHTTP, serveHTTPS)
+}
+
+// listen listens for the servers' connections. It is a variable so that
+// tests can observe the order in which addresses are bound.
+var listen = net.Listen
+
+// bindServers binds the HTTP and HTTPS servers' addresses, that of HTTPS
+// first if httpsFirst is true. Connections are accepted, pending Serve,
+// as soon as an address is bound.
+func bindServers(httpsFirst bool, httpAddr, httpsAddr string) (httpL, httpsL net.Listener, httpErr, httpsErr error) {
+	if httpsFirst {
+		httpsL, httpsErr = listen("tcp", httpsAddr)
+		httpL, httpErr = listen("tcp", httpAddr)
+	} else {
+		httpL, httpErr = listen("tcp", httpAddr)
+		httpsL, httpsErr = listen("tcp", httpsAddr)
+	}
+	return httpL, httpsL, httpErr, httpsErr
+}
+
+// serveAll runs the servers concurrently. If failFast is true, it returns
+// the error of the first server to stop. Otherwise a server that stops is
+// logged while the others keep serving, and serveAll returns the last
+// error once all have stopped.
+func serveAll(failFast bool, servers ...func() error) error {
+	errc := make(chan error, len(servers))
+	for _, serve := range servers {
+		serve := serve
+		go func() { errc <- serve() }()
+	}
+	var err error
+	for range servers {
+		err = <-errc
+		if failFast {
+			return err
+		}
+		log.Printf("server stopped: %s", err)
+	}
+	return err
+}
+
+func httpHandler(table *routeTable, o options) http.Handler {
+	// HSTS is only for responses over HTTPS.
+	po := o
+	po.hsts = ""
+	proxyHandler := newProxyHandler(table, po)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if o.serveHealth(w, r) || o.serveReloadStatus(w, r) {
+			return
+		}
+		r = o.setRequestID(r)
+		if o.rejectIP(w, r, o.ipFilter) {
+			return
+		}
+		if o.limitRate(w, r) {
+			return
+		}
+		if o.rejectRequest(w, r) {
+			return
+		}
+		r = withNormalizedHost(r, o.defaultPort(r))
+		if o.serveCanonical(w, r) {
+			return
+		}
+		proxy := table.load()
+
+		// if no mapping exists reject with a 502.
+		rt, ok := lookupRoute(proxy, r.Host, r.URL.Path)
+		if !ok {
+			if o.serveApex(w, r, proxy) {
+				return
+			}
+			o.httpError(w, r, http.StatusBadGateway)
+			return
+		}
+
+		if rt.requireHTTPS && !o.isHTTPS(r) {
+			o.rejectPlaintext(w, r)
+			return
+		}
+		if o.httpOnly[canonicalHost(r.Host)] {
+			proxyHandler.ServeHTTP(w, r)
+			return
+		}
+
+		// a redirect would fail the TLS handshake if the certificate
+		// isn't ready yet.
+		if o.certReady != nil && !o.certReady(hostname(r.Host)) {
+			w.Header().Set("Retry-After", "5")
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, pendingNoticePage)
+			return
+		}
+
+		// redirect to https
+		u := *r.URL
+		u.Scheme = "https"
+		// explicitly set Host on the URL, otherwise only Path and
+		// RawQuery will be present.
+		u.Host = o.httpsHost(hostname(r.Host))
+		o.redirect(w, r, u.String(), o.redirectCode(r.Method))
+	})
+}
+
+// serveHealth responds with 200 and "ok" to a GET or HEAD request for the
+// health check path, whatever its host, so that load balancers can probe
+// the server. It reports whether it responded.
+func (o options) serveHealth(w http.ResponseWriter, r *http.Request) bool {
+	if o.healthPath == "" || r.URL.Path != o.healthPath || (r.Method != "GET" && r.Method != "HEAD") {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "ok")
+	return true
+}
+
+// rejectRequest responds to requests that are rejected whatever their host,
+// and reports whether it did.
+func (o options) rejectRequest(w http.ResponseWriter, r *http.Request) bool {
+	switch {
+	case r.Method == http.MethodConnect:
+		o.rejectConnect(w, r)
+	case hasConflictingHost(r):
+		o.httpErrorText(w, r, http.StatusBadRequest, "conflicting host")
+	case o.maxHeaderCount > 0 && headerCount(r.Header) > o.maxHeaderCount:
+		o.httpError(w, r, http.StatusRequestHeaderFieldsTooLarge)
+	default:
+		return false
+	}
+	return true
+}
+
+// headerCount returns the number of header fields in h, counting repeated
+// fields.
+func headerCount(h http.Header) int {
+	n := 0
+	for _, v := range h {
+		n += len(v)
+	}
+	return n
+}
+
+// hasConflictingHost reports whether the request has a Host header that
+// disagrees with r.Host. net/http rejects HTTP/1 requests with more than one
+// Host header, and for HTTP/1 requests in absolute form r.Host is the host
+// of the request target, whose Host header must be ignored (RFC 9112
+// section 3.2.2). HTTP/2 requests, however, keep a Host header alongside
+// the :authority pseudo-header that r.Host is taken from.
+func hasConflictingHost(r *http.Request) bool {
+	for _, h := range r.Header.Values("Host") {
+		if !strings.EqualFold(h, r.Host) {
+			return true
+		}
+	}
+	return len(r.Header.Values("Host")) > 1
+}
+
+// allowedMethods is the Allow header value for rejected CONNECT requests.
+const allowedMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// rejectConnect responds to a CONNECT request. Tunneling isn't supported,
+// and r.Host of a CONNECT request is the tunnel's destination rather than a
+// host in the proxy map, so such requests would otherwise be handled
+// confusingly.
+func (o options) rejectConnect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", allowedMethods)
+	o.httpError(w, r, http.StatusMethodNotAllowed)
+}
+
+// rejectPlaintext responds to a request that didn't arrive over HTTPS for a
+// host that requires it.
+func (o options) rejectPlaintext(w http.ResponseWriter, r *http.Request) {
+	o.httpErrorText(w, r, http.StatusBadRequest, "HTTPS required")
+}
+
+func httpsHandler(table *routeTable, o options) http.Handler {
+	proxyHandler := newProxyHandler(table, o)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if o.serveHealth(w, r) || o.serveReloadStatus(w, r) {
+			return
+		}
+		r = o.setRequestID(r)
+		if o.rejectIP(w, r, o.ipFilter) {
+			return
+		}
+		if o.limitRate(w, r) {
+			return
+		}
+		// hosts served over http only have no presence over https.
+		if o.httpOnly[normalizeHost(r.Host, o.defaultPort(r))] {
+			o.httpError(w, r, http.StatusNotFound)
+			return
+		}
+		proxyHandler.ServeHTTP(w, r)
+	})
+}
+
+// newProxyHandler returns the handler that forwards requests to the
+// destination servers.
+func newProxyHandler(table *routeTable, o options) http.Handler {
+	revproxy := &httputil.ReverseProxy{
+		Rewrite:   rewriter(o),
+		Transport: routeTransport{},
+		ModifyResponse: func(rsp *http.Response) error {
+			// as sent by the destination server.
+			captureHeaders(rsp, o.logHeaders)
+			if err := modifyResponse(rsp, o.compression); err != nil {
+				return err
+			}
+			if o.hsts != "" && (o.hstsOverride || rsp.Header.Get("Strict-Transport-Security") == "") {
+				rsp.Header.Set("Strict-Transport-Security", o.hsts)
+			}
+			o.echoRequestID(rsp.Header, rsp.Request.Context())
+			return nil
+		},
+		ErrorHandler: func(rw http.ResponseWriter, req *http.Request, err error) {
+			if fw, ok := rw.(*failoverWriter); ok {
+				fw.upstreamError(err)
+				return
+			}
+			var mbe *http.MaxBytesError
+			if errors.As(err, &mbe) {
+				log.Printf("request body over %d bytes for %s%s%s", mbe.Limit, req.Host, req.URL.Path, logRequestID(req.Context()))
+				o.tooLarge(rw, req)
+				return
+			}
+			var cbe *clientBodyError
+			if errors.As(err, &cbe) {
+				// the client, not the destination server, failed;
+				// it has most likely gone away, so the response is
+				// only a formality.
+				log.Printf("client error for %s%s: %v", req.Host, req.URL.Path, cbe)
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if req.Context().Err() == context.Canceled {
+				// the client went away; the request to the
+				// destination server was canceled with it.
+				log.Printf("client disconnected for %s%s", req.Host, req.URL.Path)
+				rw.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			rt := routeFrom(req.Context())
+			if rt.requestTimeout > 0 && req.Context().Err() == context.DeadlineExceeded {
+				log.Printf("request timeout for %s%s%s", req.Host, req.URL.Path, logRequestID(req.Context()))
+				rt.serveTimeout(rw, req, o)
+				return
+			}
+			dest := destination(req.Context(), rt)
+			switch {
+			case isDialError(err):
+				log.Printf("connect error to %s for %s%s%s: %v", dest.Host, req.Host, req.URL.Path, logRequestID(req.Context()), err)
+			case isResponseHeaderTimeout(err):
+				log.Printf("response header timeout from %s for %s%s%s", dest.Host, req.Host, req.URL.Path, logRequestID(req.Context()))
+			case isEmptyResponse(err):
+				log.Printf("upstream closed connection without response from %s for %s%s%s", dest.Host, req.Host, req.URL.Path, logRequestID(req.Context()))
+			default:
+				log.Printf("proxy error%s: %v", logRequestID(req.Context()), err)
+			}
+			if rt.staticFallback != nil && (req.Method == "GET" || req.Method == "HEAD") {
+				log.Printf("serving static fallback for %s%s", req.Host, req.URL.Path)
+				rt.staticFallback.ServeHTTP(rw, req)
+				return
+			}
+			if isResponseHeaderTimeout(err) {
+				o.httpError(rw, req, http.StatusGatewayTimeout)
+				return
+			}
+			o.httpError(rw, req, http.StatusBadGateway)
+		},
+	}
+
+	// forward sends the request to a destination server of rt.
+	forward := func(w http.ResponseWriter, r *http.Request, rt *route) {
+		var target *url.URL
+		if rt.abTest != nil {
+			target = &rt.abTest.bucket(w, r).target
+		} else if b := rt.pick(); b != nil {
+			target = &b.target
+		} else {
+			log.Printf("no healthy backend for %s%s", r.Host, r.URL.Path)
+			o.httpError(w, r, http.StatusServiceUnavailable)
+			return
+		}
+
+		if rt.headerSizes != nil {
+			rt.headerSizes.recordRequest(headerSize(r.Header))
+		}
+		if rt.sizes != nil {
+			var body *countingBody
+			if r.Body != nil && r.Body != http.NoBody {
+				body = &countingBody{ReadCloser: r.Body}
+				r.Body = body
+			}
+			sw := &statusWriter{ResponseWriter: w}
+			w = sw
+			defer func() {
+				var n int64
+				if body != nil {
+					n = body.n.Load()
+				}
+				rt.sizes.record(n, sw.n)
+			}()
+		}
+		if rt.dropEarlyHints {
+			w = &earlyHintsWriter{w}
+		}
+		if rt.push && !o.disablePush {
+			w = newPushWriter(w, r)
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = clientBody{r.Body}
+		}
+		if rt.mirror != nil {
+			rt.mirror.send(r)
+		}
+		ctx := withRoute(r.Context(), rt)
+		ctx = withTarget(ctx, target)
+		if rt.requestTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, rt.requestTimeout)
+			defer cancel()
+		}
+		r = r.WithContext(ctx)
+		if rt.latency != nil {
+			start := time.Now()
+			defer func() { rt.latency.record(time.Since(start)) }()
+		}
+		if len(rt.failover) > 0 && rt.retryBuffer > 0 {
+			if err := bufferRetryBody(r, rt.retryBuffer); err != nil {
+				log.Printf("client error for %s%s: %v", r.Host, r.URL.Path, err)
+				o.httpError(w, r, http.StatusBadRequest)
+				return
+			}
+		}
+		if len(rt.failover) > 0 && canFailover(r) {
+			serveFailover(w, r, rt, revproxy)
+			return
+		}
+		revproxy.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = o.setRequestID(r)
+		if o.rejectRequest(w, r) {
+			return
+		}
+		r = withNormalizedHost(r, o.defaultPort(r))
+		if o.serveCanonical(w, r) {
+			return
+		}
+		proxy := table.load()
+
+		// if no mapping exists reject with a 502.
+		rt, ok := lookupRoute(proxy, r.Host, r.URL.Path)
+		if !ok {
+			if o.serveApex(w, r, proxy) {
+				return
+			}
+			o.httpError(w, r, http.StatusBadGateway)
+			return
+		}
+		if o.via != "" && isLoop(r, o.via) {
+			log.Printf("forwarding loop detected for %s%s", r.Host, r.URL.Path)
+			o.httpError(w, r, http.StatusLoopDetected)
+			return
+		}
+		if o.rejectIP(w, r, rt.ipFilter) {
+			return
+		}
+		if rt.requireHTTPS && !o.isHTTPS(r) {
+			o.rejectPlaintext(w, r)
+			return
+		}
+		if rt.allowPaths != nil && !rt.allowPaths.allows(r.URL.Path) {
+			o.httpError(w, r, http.StatusNotFound)
+			return
+		}
+		if o.requireAuth(w, r) {
+			return
+		}
+		if rt.signedURL != nil && !rt.signedURL.valid(r.URL, time.Now()) {
+			o.rejectUnsigned(w, r)
+			return
+		}
+
+		if !rt.allowsContentType(r) {
+			o.httpError(w, r, http.StatusUnsupportedMediaType)
+			return
+		}
+		if rt.decompressRequest {
+			// before the body is limited or validated, so that they
+			// apply to the decompressed body.
+			max := rt.maxBodyBytes
+			if max <= 0 {
+				max = maxDecompressedBody
+			}
+			decompressRequest(r, max)
+		}
+		if rt.maxBodyBytes > 0 {
+			if !o.limitBody(w, r, rt.maxBodyBytes) {
+				return
+			}
+			// the server closes only the body it read from the client,
+			// so this removes a body buffered in a temporary file if it
+			// isn't forwarded.
+			defer r.Body.Close()
+		}
+		if rt.schema != nil && !o.validateBody(w, r, rt.schema) {
+			return
+		}
+
+		if rt.dedup != nil {
+			rt.dedup.serve(w, r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forward(w, r, rt)
+			}), o)
+			return
+		}
+		forward(w, r, rt)
+	})
+}
+
+const pendingNoticePage = `<!DOCTYPE html>
+<meta http-equiv="refresh" content="5">
+<title>Setting up HTTPS</title>
+<p>HTTPS is being set up for this site. Please retry in a few seconds.</p>
+`
+
+// hostname returns host without any port, and without the brackets of an
+// IPv6 literal.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// canonicalHost returns host, which may have a port, in lower case and
+// without a trailing dot, with a bracketed IPv6 literal in canonical form,
+// so that e.g. "Example.com." matches "example.com" and "[2001:DB8:0::1]"
+// matches "[2001:db8::1]".
+func canonicalHost(host string) string {
+	host = strings.ToLower(host)
+	if !strings.HasPrefix(host, "[") {
+		h, port, err := net.SplitHostPort(host)
+		if err != nil {
+			return strings.TrimSuffix(host, ".")
+		}
+		return net.JoinHostPort(strings.TrimSuffix(h, "."), port)
+	}
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h = hostname(host)
+	}
+	ip := net.ParseIP(h)
+	if ip == nil {
+		return host
+	}
+	if port == "" {
+		return "[" + ip.String() + "]"
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
+
+// normalizeHost returns canonicalHost(host) without its port if that is
+// defaultPort, the default port of the request's scheme, so that e.g.
+// "example.com:443" matches "example.com" over HTTPS.
+func normalizeHost(host, defaultPort string) string {
+	host = canonicalHost(host)
+	h, port, err := net.SplitHostPort(host)
+	if err != nil || port != defaultPort {
+		return host
+	}
+	if strings.Contains(h, ":") {
+		return "[" + h + "]"
+	}
+	return h
+}
+
+// withNormalizedHost returns r, or a copy of it if the host needs it, with
+// its host normalized by normalizeHost.
+func withNormalizedHost(r *http.Request, defaultPort string) *http.Request {
+	h := normalizeHost(r.Host, defaultPort)
+	if h == r.Host {
+		return r
+	}
+	r = r.WithContext(r.Context())
+	r.Host = h
+	return r
+}
+
+// defaultPort returns the default port of the scheme of the request.
+func (o options) defaultPort(r *http.Request) string {
+	if o.isHTTPS(r) {
+		return "443"
+	}
+	return "80"
+}
+
+// serveApex responds to the request according to the apex settings if the
+// request host, which must not be in the proxy map, is the parent domain of
+// a host in the proxy map. It reports whether it responded.
+func (o options) serveApex(w http.ResponseWriter, r *http.Request, proxy map[string]*route) bool {
+	if o.apex.Action == "" || !isApex(r.Host, proxy) {
+		return false
+	}
+
+	switch o.apex.Action {
+	case "redirect":
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = o.httpsHost(o.apex.Redirect + "." + hostname(r.Host))
+		o.redirect(w, r, u.String(), o.hostRedirectCode(r.Method))
+	case "page":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(o.apexPage)
+	default:
+		panic("unknown apex action " + o.apex.Action)
+	}
+	return true
+}
+
+// redirectCode returns the status code for a redirect to HTTPS of a
+// request with the method. Requests other than GET and HEAD get a 307 or
+// 308 instead, so that clients don't change them to a GET.
+func (o options) redirectCode(method string) int {
+	return o.redirectCodeOr(method, http.StatusFound)
+}
+
+// hostRedirectCode returns the status code for a redirect of a request
+// with the method to another host, such as the canonical one. It is like
+// redirectCode, but defaults to a 301.
+func (o options) hostRedirectCode(method string) int {
+	return o.redirectCodeOr(method, http.StatusMovedPermanently)
+}
+
+// redirectCodeOr returns the status code for a redirect of a request with
+// the method: redirectStatus, or code if it is zero, or the 307 or 308
+// equivalent for methods other than GET and HEAD.
+func (o options) redirectCodeOr(method string, code int) int {
+	if o.redirectStatus != 0 {
+		code = o.redirectStatus
+	}
+	if method == "GET" || method == "HEAD" {
+		return code
+	}
+	switch code {
+	case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+		return http.StatusPermanentRedirect
+	default:
+		return http.StatusTemporaryRedirect
+	}
+}
+
+// httpsHost returns the host, with the HTTPS server's port if it isn't the
+// default, for a https URL to host, which has no port. IPv6 literals are
+// bracketed.
+func (o options) httpsHost(host string) string {
+	if o.httpsPort == "" {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, o.httpsPort)
+}
+
+// isApex reports whether host is the parent domain of a host in the proxy
+// map.
+func isApex(host string, proxy map[string]*route) bool {
+	for k := range proxy {
+		if h, _ := splitRouteKey(k); strings.HasSuffix(h, "."+host) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitRouteKey splits a proxy map key into its host and path prefix. The
+// prefix is empty for a bare host.
+func splitRouteKey(k string) (host, prefix string) {
+	if i := strings.Index(k, "/"); i >= 0 {
+		return k[:i], k[i:]
+	}
+	return k, ""
+}
+
+// hasHost reports whether the proxy map has a key for host, with or
+// without a path prefix.
+func hasHost(proxy map[string]Upstream, host string) bool {
+	for k := range proxy {
+		if h, _ := splitRouteKey(k); canonicalHost(h) == canonicalHost(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRouteKey returns an error if k is not a valid proxy map key: a host,
+// with any IPv6 literal in brackets, optionally followed by a path prefix
+// such as "/v1" that has no trailing slash, query, or fragment.
+func checkRouteKey(k string) error {
+	host, prefix := splitRouteKey(k)
+	if host == "" {
+		return fmt.Errorf("missing host in proxy key %s", k)
+	}
+	if strings.HasPrefix(host, "[") {
+		if net.ParseIP(hostname(host)) == nil {
+			return fmt.Errorf("bad IPv6 literal in proxy key %s", k)
+		}
+	} else if strings.Count(host, ":") > 1 {
+		return fmt.Errorf("IPv6 literal must be in brackets in proxy key %s", k)
+	}
+	if prefix == "" {
+		return nil
+	}
+	if strings.HasSuffix(prefix, "/") || strings.Contains(prefix, "//") || strings.ContainsAny(prefix, "?#") {
+		return fmt.Errorf("invalid path prefix in proxy key %s", k)
+	}
+	return nil
+}
+
+// lookupRoute returns the route for a request to host and path. A key with
+// a path prefix takes precedence over the bare host; the longest prefix that
+// matches whole path segments wins, so "/v1" matches "/v1" and "/v1/users"
+// but not "/v10".
+func lookupRoute(proxy map[string]*route, host, path string) (*route, bool) {
+	host = canonicalHost(host)
+	for p := path; p != ""; {
+		if p != "/" {
+			if rt, ok := proxy[host+p]; ok {
+				return rt, true
+			}
+		}
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+	}
+	rt, ok := proxy[host]
+	return rt, ok
+}
+
+// rewriter returns a function that is suitable for use as the Rewrite field
+// of httputil.ReverseProxy. The returned function modifies the request such
+// that it is sent to the destination server base URL of the route in the
+// request's context. The registered request modifiers are then applied to
+// the outbound request.
+//
+// The returned function must be used only with a request whose context has
+// a route. Otherwise the returned function panics.
+func rewriter(o options) func(*httputil.ProxyRequest) {
+	return func(pr *httputil.ProxyRequest) {
+		r := routeFrom(pr.In.Context())
+		if r == nil {
+			panic("no route for host " + pr.In.Host)
+		}
+		dest := destination(pr.In.Context(), r)
+		pr.SetURL(&dest)
+		pr.Out.Host = normalizeHost(pr.In.Host, o.defaultPort(pr.In))
+		o.setXForwarded(pr)
+		if m, ok := r.rewriteMethod[pr.In.Method]; ok {
+			pr.Out.Method = m
+		}
+		if o.via != "" {
+			pr.Out.Header.Add("Via", viaProto(pr.In)+" "+o.via)
+		}
+		for k, v := range o.instanceHeaders {
+			pr.Out.Header.Set(k, v)
+		}
+		if id := requestIDFrom(pr.In.Context()); id != "" {
+			pr.Out.Header.Set(o.requestIDHeader, id)
+		}
+		if r.normalizeEncoding {
+			pr.Out.Header.Set("Accept-Encoding", normalizeAcceptEncoding(pr.In.Header.Values("Accept-Encoding")))
+		}
+		for _, m := range requestModifiers {
+			m(pr.Out)
+		}
+		if o.logConns {
+			pr.Out = traceConnReuse(pr.Out)
+		}
+	}
+}
+
+// destination returns the base URL of the destination server for the
+// request with ctx: the route's target, unless another was chosen for the
+// request or it is a failover attempt.
+func destination(ctx context.Context, r *route) url.URL {
+	dest := r.target
+	if t := targetFrom(ctx); t != nil {
+		dest = *t
+	}
+	if n := attemptFrom(ctx); n > 0 {
+		dest = r.failover[n-1]
+	}
+	return dest
+}
+
+// viaProto returns the protocol version of the request in the form used in
+// the Via header.
+func viaProto(r *http.Request) string {
+	if r.ProtoMajor >= 2 {
+		return strconv.Itoa(r.ProtoMajor)
+	}
+	return fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)
+}
+
+// isLoop reports whether the request has already passed through the proxy
+// named via, according to the request's Via and Forwarded headers.
+func isLoop(r *http.Request, via string) bool {
+	for _, v := range r.Header.Values("Via") {
+		for _, entry := range strings.Split(v, ",") {
+			// entry is: received-protocol received-by [ comment ]
+			f := strings.Fields(entry)
+			if len(f) >= 2 && strings.EqualFold(f[1], via) {
+				return true
+			}
+		}
+	}
+	for _, v := range r.Header.Values("Forwarded") {
+		for _, entry := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(entry, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(k, "by") && strings.EqualFold(strings.Trim(v, `"`), via) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// modifyResponse is the ModifyResponse function of httputil.ReverseProxy. It
+// applies the settings of the route in the request's context to the
+// response from the destination server, and compresses it with z if
+// non-nil.
+func modifyResponse(rsp *http.Response, z *compression) error {
+	r := routeFrom(rsp.Request.Context())
+	if r == nil {
+		panic("no route for host " + rsp.Request.Host)
+	}
+
+	if r.headerSizes != nil {
+		// as sent by the destination server.
+		r.headerSizes.recordResponse(headerSize(rsp.Header))
+	}
+	if r.statusFromHeader != "" {
+		remapStatus(rsp, r.statusFromHeader)
+	}
+	if r.defaultCacheControl != "" && rsp.StatusCode/100 == 2 && rsp.Header.Get("Cache-Control") == "" {
+		rsp.Header.Set("Cache-Control", r.defaultCacheControl)
+	}
+	if r.timingAllowOrigin != "" {
+		rsp.Header.Set("Timing-Allow-Origin", r.timingAllowOrigin)
+	}
+	if r.cookies != nil {
+		r.cookies.apply(rsp.Header, hostname(rsp.Request.Host))
+	}
+	if r.servedBy != "" {
+		rsp.Header.Set("X-Served-By", servedBy(r.servedBy, rsp.Request.URL))
+	}
+	if r.minify {
+		if err := minifyResponse(rsp); err != nil {
+			return err
+		}
+	}
+	if z != nil {
+		if err := z.compress(rsp); err != nil {
+			return err
+		}
+	}
+	if r.responseBuffer != nil {
+		if err := r.responseBuffer.buffer(rsp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remapStatus sets the status code of rsp to the value of its header
+// named header, if the header has a valid status code. The header is
+// removed.
+func remapStatus(rsp *http.Response, header string) {
+	v := rsp.Header.Get(header)
+	if v == "" {
+		return
+	}
+	rsp.Header.Del(header)
+	code, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || code < 200 || code > 599 {
+		log.Printf("ignoring bad %s %q from %s", header, v, rsp.Request.URL.Host)
+		return
+	}
+	rsp.StatusCode = code
+	rsp.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+}
+
+// servedBy returns the X-Served-By header value for the destination server
+// at u.
+func servedBy(mode string, u *url.URL) string {
+	id := u.Scheme + "://" + u.Host
+	if mode == "hash" {
+		sum := sha256.Sum256([]byte(id))
+		return hex.EncodeToString(sum[:6])
+	}
+	return id
+}
+
+// requestModifiers are applied, in order, to each outbound request after its
+// destination has been set. They are similar to the Director field of
+// httputil.ReverseProxy.
+var requestModifiers []func(*http.Request)
+
+// registerRequestModifier adds f to the request modifiers. It lets a file
+// added to this package transform outbound requests without changes to the
+// rest of the program, typically by calling registerRequestModifier in an
+// init function. It must not be called after the servers have started.
+func registerRequestModifier(f func(*http.Request)) {
+	requestModifiers = append(requestModifiers, f)
 }
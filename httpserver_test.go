@@ -1,29 +1,43 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
+	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
 )
 
 var noFollowRedirect = func(_ *http.Request, _ []*http.Request) error {
 	return http.ErrUseLastResponse
 }
 
-func mustToURLs(proxy map[string]string) map[string]url.URL {
-	m, err := toURLs(proxy)
+func mustRoutes(proxy map[string]string) *routeTable {
+	m := make(map[string]Upstream)
+	for k, v := range proxy {
+		m[k] = Upstream{URL: v}
+	}
+	routes, err := newRoutes(m)
 	if err != nil {
 		panic(err)
 	}
-	return m
+	return newRouteTable(routes)
 }
 
 func TestHandler(t *testing.T) {
@@ -79,8 +93,8 @@ func TestHandler(t *testing.T) {
 		defer ts.Close()
 	}
 
-	h80 := httpHandler(mustToURLs(proxy))
-	h443 := httpsHandler(mustToURLs(proxy))
+	h80 := httpHandler(mustRoutes(proxy), options{})
+	h443 := httpsHandler(mustRoutes(proxy), options{})
 
 	// load certificate for hosts used in the test
 	cert, err := tls.LoadX509KeyPair(filepath.Join("testdata", "cert.pem"), filepath.Join("testdata", "key.pem"))
@@ -146,7 +160,11 @@ func TestHandler(t *testing.T) {
 			}()
 
 			req, _ := http.NewRequest("GET", "http://littleroot.org", nil)
-			rsp, _ := s443Client.Do(req)
+			rsp, err := s443Client.Do(req)
+			if err != nil {
+				t.Errorf("want nil error, got %v", err)
+				return
+			}
 			defer rsp.Body.Close()
 
 			want := "https://littleroot.org/"
@@ -169,7 +187,11 @@ func TestHandler(t *testing.T) {
 			}()
 
 			req, _ := http.NewRequest("GET", "http://sub.foo.com/path/?key=val", nil)
-			rsp, _ := s443Client.Do(req)
+			rsp, err := s443Client.Do(req)
+			if err != nil {
+				t.Errorf("want nil error, got %v", err)
+				return
+			}
 			defer rsp.Body.Close()
 
 			want := "https://sub.foo.com/path/?key=val"
@@ -187,7 +209,8 @@ func TestHandler(t *testing.T) {
 	})
 
 	t.Run("happy path", func(t *testing.T) {
-		for host, baseURL := range mustToURLs(proxy) {
+		for host, r := range mustRoutes(proxy).load() {
+			baseURL := r.target
 			t.Run(host, func(t *testing.T) {
 				// NOTE: http.Get follows redirects.
 				reqPath := "/path/?key=val"
@@ -236,3 +259,1952 @@ func getFreePort() (port string) {
 
 	return portString
 }
+
+func TestUpstreamUnmarshalJSON(t *testing.T) {
+	var proxy map[string]Upstream
+	data := `{"a.org": "http://localhost:8000", "b.org": {"url": "http://localhost:9000", "dialTimeout": "2s", "responseHeaderTimeout": "1m"}, "c.org": ["http://localhost:8001", "http://localhost:8002"]}`
+	if err := json.Unmarshal([]byte(data), &proxy); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := map[string]Upstream{
+		"a.org": {URL: "http://localhost:8000"},
+		"b.org": {
+			URL:                   "http://localhost:9000",
+			DialTimeout:           Duration(2 * time.Second),
+			ResponseHeaderTimeout: Duration(time.Minute),
+		},
+		"c.org": {URLs: []string{"http://localhost:8001", "http://localhost:8002"}},
+	}
+	if !reflect.DeepEqual(want, proxy) {
+		t.Errorf("want %+v, got %+v", want, proxy)
+	}
+
+	if err := json.Unmarshal([]byte(`{"dialTimeout": "2 seconds"}`), new(Upstream)); err == nil {
+		t.Errorf("want error for bad duration, got nil")
+	}
+	if err := json.Unmarshal([]byte(`[]`), new(Upstream)); err == nil {
+		t.Errorf("want error for empty array, got nil")
+	}
+}
+
+func TestUpstreamTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	slowResponse := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(200 * time.Millisecond):
+		}
+		w.Write([]byte("slow"))
+	}))
+	defer slowResponse.Close()
+	defer close(release) // unblock handlers before closing the server
+
+	serve := func(u Upstream) *httptest.ResponseRecorder {
+		routes, err := newRoutes(map[string]Upstream{"slow.org": u})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "https://slow.org/", nil)
+		httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("slow to respond", func(t *testing.T) {
+		w := serve(Upstream{
+			URL:                   slowResponse.URL,
+			ResponseHeaderTimeout: Duration(20 * time.Millisecond),
+		})
+		if w.Code != 504 {
+			t.Errorf("status code: want 504, got %d", w.Code)
+		}
+	})
+
+	t.Run("slow to respond over HTTP/1.0", func(t *testing.T) {
+		w := serve(Upstream{
+			URL:                   slowResponse.URL,
+			ResponseHeaderTimeout: Duration(20 * time.Millisecond),
+			HTTP10:                true,
+		})
+		if w.Code != 504 {
+			t.Errorf("status code: want 504, got %d", w.Code)
+		}
+	})
+
+	t.Run("slow to respond with only dial timeout", func(t *testing.T) {
+		w := serve(Upstream{
+			URL:         slowResponse.URL,
+			DialTimeout: Duration(20 * time.Millisecond),
+		})
+		if w.Code != 200 {
+			t.Errorf("status code: want 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("slow to connect", func(t *testing.T) {
+		orig := dialContext
+		defer func() {
+			dialContext = orig // undo
+		}()
+		dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// simulate a destination server that never completes the
+			// connection.
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		start := time.Now()
+		w := serve(Upstream{
+			URL:                   slowResponse.URL,
+			DialTimeout:           Duration(20 * time.Millisecond),
+			ResponseHeaderTimeout: Duration(time.Minute),
+		})
+		if w.Code != 502 {
+			t.Errorf("status code: want 502, got %d", w.Code)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("want dial to time out quickly, took %s", d)
+		}
+	})
+}
+
+func TestApex(t *testing.T) {
+	routes := mustRoutes(map[string]string{
+		"www.example.com": "http://localhost:8000",
+		"app.example.com": "http://localhost:9000",
+	})
+
+	page := filepath.Join(t.TempDir(), "apex.html")
+	if err := os.WriteFile(page, []byte("<p>hello</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		o, err := newOptions(Conf{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		httpHandler(routes, o).ServeHTTP(w, r)
+		if w.Code != 502 {
+			t.Errorf("status code: want 502, got %d", w.Code)
+		}
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		o, err := newOptions(Conf{Apex: Apex{Action: "redirect", Redirect: "www"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for name, h := range map[string]http.Handler{
+			"http":  httpHandler(routes, o),
+			"https": httpsHandler(routes, o),
+		} {
+			t.Run(name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest("GET", "http://example.com/path/?key=val", nil)
+				h.ServeHTTP(w, r)
+				if w.Code != http.StatusMovedPermanently {
+					t.Errorf("status code: want %d, got %d", http.StatusMovedPermanently, w.Code)
+				}
+				want := "https://www.example.com/path/?key=val"
+				if got := w.Header().Get("Location"); got != want {
+					t.Errorf("location: want %q, got %q", want, got)
+				}
+			})
+		}
+	})
+
+	t.Run("redirect status", func(t *testing.T) {
+		o, err := newOptions(Conf{Apex: Apex{Action: "redirect", Redirect: "www"}, RedirectStatus: http.StatusFound})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for method, want := range map[string]int{"GET": http.StatusFound, "POST": http.StatusTemporaryRedirect} {
+			w := httptest.NewRecorder()
+			httpsHandler(routes, o).ServeHTTP(w, httptest.NewRequest(method, "https://example.com/", nil))
+			if w.Code != want {
+				t.Errorf("%s: status code: want %d, got %d", method, want, w.Code)
+			}
+		}
+
+		o, err = newOptions(Conf{Apex: Apex{Action: "redirect", Redirect: "www"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		w := httptest.NewRecorder()
+		httpsHandler(routes, o).ServeHTTP(w, httptest.NewRequest("POST", "https://example.com/", nil))
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("POST: status code: want %d, got %d", http.StatusPermanentRedirect, w.Code)
+		}
+	})
+
+	t.Run("page", func(t *testing.T) {
+		o, err := newOptions(Conf{Apex: Apex{Action: "page", Page: page}})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		httpHandler(routes, o).ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Errorf("status code: want 200, got %d", w.Code)
+		}
+		if got := w.Body.String(); got != "<p>hello</p>" {
+			t.Errorf("body: want %q, got %q", "<p>hello</p>", got)
+		}
+	})
+
+	t.Run("not an apex", func(t *testing.T) {
+		o, err := newOptions(Conf{Apex: Apex{Action: "redirect", Redirect: "www"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://unknown.org/", nil)
+		httpHandler(routes, o).ServeHTTP(w, r)
+		if w.Code != 502 {
+			t.Errorf("status code: want 502, got %d", w.Code)
+		}
+	})
+
+	t.Run("bad conf", func(t *testing.T) {
+		for _, a := range []Apex{
+			{Action: "redirect"},
+			{Action: "page"},
+			{Action: "page", Page: filepath.Join(t.TempDir(), "missing.html")},
+			{Action: "teapot"},
+		} {
+			if _, err := newOptions(Conf{Apex: a}); err == nil {
+				t.Errorf("%+v: want error, got nil", a)
+			}
+		}
+	})
+}
+
+func TestPendingNotice(t *testing.T) {
+	routes := mustRoutes(map[string]string{"foo.com": "http://localhost:8000"})
+	ready := false
+	o := options{certReady: func(host string) bool {
+		if host != "foo.com" {
+			t.Errorf("host: want %q, got %q", "foo.com", host)
+		}
+		return ready
+	}}
+	h := httpHandler(routes, o)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.com/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code: want %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("want Retry-After header")
+	}
+
+	ready = true
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.com/", nil))
+	if w.Code != http.StatusFound {
+		t.Errorf("status code: want %d, got %d", http.StatusFound, w.Code)
+	}
+}
+
+func TestRequestModifiers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Header.Get("X-Plugin"), r.URL.Path)
+	}))
+	defer backend.Close()
+
+	orig := requestModifiers
+	defer func() {
+		requestModifiers = orig // undo
+	}()
+	registerRequestModifier(func(r *http.Request) {
+		r.Header.Set("X-Plugin", "yes")
+	})
+	registerRequestModifier(func(r *http.Request) {
+		r.URL.Path = strings.ToUpper(r.URL.Path)
+	})
+
+	routes := mustRoutes(map[string]string{"foo.com": backend.URL})
+	w := httptest.NewRecorder()
+	httpsHandler(routes, options{}).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/path", nil))
+
+	if got, want := w.Body.String(), "yes /PATH"; got != want {
+		t.Errorf("body: want %q, got %q", want, got)
+	}
+}
+
+// TestConflictingFraming checks that a message with both Content-Length and
+// Transfer-Encoding is never forwarded with ambiguous framing. net/http
+// removes the Content-Length before handlers see the message, as RFC 9112
+// requires of intermediaries, so the forwarded message is framed by the
+// chunked encoding alone.
+func TestConflictingFraming(t *testing.T) {
+	t.Run("request", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%q %q", r.Header.Get("Content-Length"), b)
+		}))
+		defer backend.Close()
+
+		s := httptest.NewServer(httpsHandler(mustRoutes(map[string]string{"foo.com": backend.URL}), options{}))
+		defer s.Close()
+
+		rsp := rawRoundTrip(t, s.Listener.Addr().String(), "POST / HTTP/1.1\r\n"+
+			"Host: foo.com\r\n"+
+			"Content-Length: 100\r\n"+
+			"Transfer-Encoding: chunked\r\n"+
+			"Connection: close\r\n"+
+			"\r\n"+
+			"3\r\nabc\r\n0\r\n\r\n")
+		defer rsp.Body.Close()
+
+		b, _ := io.ReadAll(rsp.Body)
+		if got, want := string(b), `"" "abc"`; got != want {
+			t.Errorf("backend saw: want %s, got %s", want, got)
+		}
+	})
+
+	t.Run("request with conflicting content lengths", func(t *testing.T) {
+		s := httptest.NewServer(httpsHandler(mustRoutes(map[string]string{"foo.com": "http://localhost:8000"}), options{}))
+		defer s.Close()
+
+		rsp := rawRoundTrip(t, s.Listener.Addr().String(), "POST / HTTP/1.1\r\n"+
+			"Host: foo.com\r\n"+
+			"Content-Length: 3\r\n"+
+			"Content-Length: 4\r\n"+
+			"Connection: close\r\n"+
+			"\r\n"+
+			"abcd")
+		defer rsp.Body.Close()
+
+		if rsp.StatusCode != 400 {
+			t.Errorf("status code: want 400, got %d", rsp.StatusCode)
+		}
+	})
+
+	t.Run("response", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			http.ReadRequest(bufio.NewReader(conn))
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\n"+
+				"Content-Length: 100\r\n"+
+				"Transfer-Encoding: chunked\r\n"+
+				"\r\n"+
+				"3\r\nabc\r\n0\r\n\r\n")
+		}()
+
+		routes := mustRoutes(map[string]string{"foo.com": "http://" + l.Addr().String()})
+		w := httptest.NewRecorder()
+		httpsHandler(routes, options{}).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+
+		if w.Code != 200 {
+			t.Errorf("status code: want 200, got %d", w.Code)
+		}
+		if got := w.Header().Get("Content-Length"); got != "" {
+			t.Errorf("want Content-Length removed, got %q", got)
+		}
+		if got := w.Body.String(); got != "abc" {
+			t.Errorf("body: want %q, got %q", "abc", got)
+		}
+	})
+
+	t.Run("response with conflicting content lengths", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			http.ReadRequest(bufio.NewReader(conn))
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\n"+
+				"Content-Length: 3\r\n"+
+				"Content-Length: 4\r\n"+
+				"\r\n"+
+				"abcd")
+		}()
+
+		routes := mustRoutes(map[string]string{"foo.com": "http://" + l.Addr().String()})
+		w := httptest.NewRecorder()
+		httpsHandler(routes, options{}).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+
+		if w.Code != 502 {
+			t.Errorf("status code: want 502, got %d", w.Code)
+		}
+		if strings.Contains(w.Body.String(), "abc") {
+			t.Errorf("want body not forwarded, got %q", w.Body.String())
+		}
+	})
+}
+
+// rawRoundTrip writes the raw request to addr and reads the response.
+func rawRoundTrip(t *testing.T, addr string, req string) *http.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsp
+}
+
+func TestDefaultCacheControl(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cc := r.URL.Query().Get("cc"); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(404)
+		}
+	}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{
+		"static.org": {URL: backend.URL, DefaultCacheControl: "public, max-age=3600"},
+		"other.org":  {URL: backend.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://static.org/", "public, max-age=3600"},
+		{"https://static.org/?cc=no-store", "no-store"},
+		{"https://static.org/missing", ""},
+		{"https://other.org/", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		if got := w.Header().Get("Cache-Control"); got != tt.want {
+			t.Errorf("%s: Cache-Control: want %q, got %q", tt.url, tt.want, got)
+		}
+	}
+}
+
+func TestLoopDetection(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Join(r.Header.Values("Via"), ", ")))
+	}))
+	defer backend.Close()
+
+	o, err := newOptions(Conf{Via: "edge-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(mustRoutes(map[string]string{"foo.com": backend.URL}), o)
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		wantCode int
+		wantBody string
+	}{
+		{"no via", nil, 200, "1.1 edge-1"},
+		{"other proxy", http.Header{"Via": {"1.0 fred, 1.1 p.example.net"}}, 200, "1.0 fred, 1.1 p.example.net, 1.1 edge-1"},
+		{"via loop", http.Header{"Via": {"1.0 fred, 1.1 Edge-1 (httpserver)"}}, 508, ""},
+		{"forwarded loop", http.Header{"Forwarded": {`for=192.0.2.60;proto=http;by="edge-1"`}}, 508, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://foo.com/", nil)
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("status code: want %d, got %d", tt.wantCode, w.Code)
+			}
+			if tt.wantCode == 200 && w.Body.String() != tt.wantBody {
+				t.Errorf("backend saw Via: want %q, got %q", tt.wantBody, w.Body.String())
+			}
+		})
+	}
+
+	if _, err := newOptions(Conf{Via: "edge 1"}); err == nil {
+		t.Errorf("want error for via with whitespace, got nil")
+	}
+}
+
+func TestInstanceHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Edge-Region")))
+	}))
+	defer backend.Close()
+
+	o, err := newOptions(Conf{InstanceHeaders: map[string]string{"X-Edge-Region": "us-east"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(mustRoutes(map[string]string{"foo.com": backend.URL}), o)
+
+	r := httptest.NewRequest("GET", "https://foo.com/", nil)
+	r.Header.Set("X-Edge-Region", "spoofed")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Body.String(); got != "us-east" {
+		t.Errorf("backend saw X-Edge-Region: want %q, got %q", "us-east", got)
+	}
+
+	if _, err := newOptions(Conf{InstanceHeaders: map[string]string{"Bad Name": "x"}}); err == nil {
+		t.Errorf("want error for bad header name, got nil")
+	}
+}
+
+func TestParseConf(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "conf.json")
+	if err := os.WriteFile(good, []byte(`{"domains": ["foo.com"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.json")
+	if err := os.Symlink(good, link); err != nil {
+		t.Fatal(err)
+	}
+	broken := filepath.Join(dir, "broken.json")
+	if err := os.Symlink(filepath.Join(dir, "missing.json"), broken); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{good, link} {
+		c, err := parseConf(path)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", path, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.Domains, []string{"foo.com"}) {
+			t.Errorf("%s: domains: want [foo.com], got %v", path, c.Domains)
+		}
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{dir, "is a directory"},
+		{broken, "symlink " + broken + " is broken"},
+	}
+	for _, tt := range tests {
+		_, err := parseConf(tt.path)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: want error containing %q, got %v", tt.path, tt.want, err)
+		}
+	}
+}
+
+func TestServedBy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	serve := func(mode string) string {
+		routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL + "/base", ServedBy: mode}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+		return w.Header().Get("X-Served-By")
+	}
+
+	if got := serve(""); got != "" {
+		t.Errorf("off: want no header, got %q", got)
+	}
+	if got := serve("url"); got != backend.URL {
+		t.Errorf("url: want %q, got %q", backend.URL, got)
+	}
+	got := serve("hash")
+	if len(got) != 12 || strings.Contains(got, "127.0.0.1") {
+		t.Errorf("hash: want 12 character ID, got %q", got)
+	}
+	if again := serve("hash"); again != got {
+		t.Errorf("hash: want stable ID %q, got %q", got, again)
+	}
+
+	if _, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, ServedBy: "name"}}); err == nil {
+		t.Errorf("want error for unknown mode, got nil")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	table := mustRoutes(map[string]string{"foo.com": "http://localhost:8000"})
+
+	for name, h := range map[string]http.Handler{
+		"http":  httpHandler(table, options{}),
+		"https": httpsHandler(table, options{}),
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("CONNECT", "foo.com:443", nil))
+		if w.Code != 405 {
+			t.Errorf("%s: status code: want 405, got %d", name, w.Code)
+		}
+		if got := w.Header().Get("Allow"); got != allowedMethods {
+			t.Errorf("%s: Allow: want %q, got %q", name, allowedMethods, got)
+		}
+	}
+}
+
+func TestAllowContentTypes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{
+		"api.foo.com": {URL: backend.URL, AllowContentTypes: []string{"application/json"}},
+		"foo.com":     {URL: backend.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+
+	testcases := []struct {
+		host        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"api.foo.com", "application/json", `{}`, 200},
+		{"api.foo.com", "Application/JSON; charset=utf-8", `{}`, 200},
+		{"api.foo.com", "text/plain", "hello", 415},
+		{"api.foo.com", "", "hello", 415},
+		{"api.foo.com", "", "", 200}, // no body
+		{"foo.com", "text/plain", "hello", 200},
+	}
+	for _, tc := range testcases {
+		r := httptest.NewRequest("POST", "https://"+tc.host+"/", strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			r.Header.Set("Content-Type", tc.contentType)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s %q: status code: want %d, got %d", tc.host, tc.contentType, tc.want, w.Code)
+		}
+	}
+
+	if _, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, AllowContentTypes: []string{"json/"}}}); err == nil {
+		t.Errorf("want error for bad media type, got nil")
+	}
+}
+
+func TestHTTPOnlyHosts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+
+	c := Conf{
+		Domains: []string{"foo.com"},
+		Proxy: map[string]Upstream{
+			"foo.com":        {URL: backend.URL},
+			"tools.internal": {URL: backend.URL},
+		},
+		HTTPOnlyHosts: []string{"tools.internal"},
+	}
+	o, err := newOptions(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := newRoutes(c.Proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := newRouteTable(routes)
+
+	t.Run("http", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		httpHandler(table, o).ServeHTTP(w, httptest.NewRequest("GET", "http://tools.internal/", nil))
+		if w.Code != 200 {
+			t.Errorf("status code: want 200, got %d", w.Code)
+		}
+		if w.Body.String() != "backend" {
+			t.Errorf("body: want %q, got %q", "backend", w.Body.String())
+		}
+
+		// other hosts are still redirected.
+		w = httptest.NewRecorder()
+		httpHandler(table, o).ServeHTTP(w, httptest.NewRequest("GET", "http://foo.com/", nil))
+		if w.Code != 302 {
+			t.Errorf("status code: want 302, got %d", w.Code)
+		}
+	})
+
+	t.Run("https", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		httpsHandler(table, o).ServeHTTP(w, httptest.NewRequest("GET", "https://tools.internal/", nil))
+		if w.Code != 404 {
+			t.Errorf("status code: want 404, got %d", w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		httpsHandler(table, o).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+		if w.Code != 200 {
+			t.Errorf("status code: want 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, hosts := range [][]string{{"foo.com"}, {"bar.com"}} {
+			c := c
+			c.HTTPOnlyHosts = hosts
+			if _, err := newOptions(c); err == nil {
+				t.Errorf("%v: want error, got nil", hosts)
+			}
+		}
+	})
+}
+
+func TestStatusFromHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := r.URL.Query().Get("status"); s != "" {
+			w.Header().Set("X-Status", s)
+		}
+		io.WriteString(w, "body")
+	}))
+	defer backend.Close()
+
+	serve := func(u Upstream, path string) *httptest.ResponseRecorder {
+		routes, err := newRoutes(map[string]Upstream{"foo.com": u})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com"+path, nil))
+		return w
+	}
+
+	testcases := []struct {
+		upstream Upstream
+		path     string
+		want     int
+	}{
+		{Upstream{URL: backend.URL, StatusFromHeader: "X-Status"}, "/?status=503", 503},
+		{Upstream{URL: backend.URL, StatusFromHeader: "X-Status"}, "/", 200},
+		{Upstream{URL: backend.URL, StatusFromHeader: "X-Status"}, "/?status=oops", 200},
+		{Upstream{URL: backend.URL}, "/?status=503", 200},
+	}
+	for _, tc := range testcases {
+		w := serve(tc.upstream, tc.path)
+		if w.Code != tc.want {
+			t.Errorf("%s (statusFromHeader %q): status code: want %d, got %d", tc.path, tc.upstream.StatusFromHeader, tc.want, w.Code)
+		}
+		if tc.upstream.StatusFromHeader != "" && w.Header().Get("X-Status") != "" {
+			t.Errorf("%s: want X-Status removed, got %q", tc.path, w.Header().Get("X-Status"))
+		}
+		if w.Body.String() != "body" {
+			t.Errorf("%s: body: want %q, got %q", tc.path, "body", w.Body.String())
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		io.WriteString(w, "fast")
+	}))
+	defer backend.Close()
+	defer close(release) // unblock handlers before closing the server
+
+	page := filepath.Join(t.TempDir(), "timeout.html")
+	if err := os.WriteFile(page, []byte("<p>taking too long</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(u Upstream, path string) *httptest.ResponseRecorder {
+		routes, err := newRoutes(map[string]Upstream{"foo.com": u})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com"+path, nil))
+		return w
+	}
+
+	t.Run("custom page", func(t *testing.T) {
+		w := serve(Upstream{URL: backend.URL, RequestTimeout: Duration(20 * time.Millisecond), TimeoutPage: page}, "/slow")
+		if w.Code != 504 {
+			t.Errorf("status code: want 504, got %d", w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+			t.Errorf("Content-Type: want %q, got %q", "text/html; charset=utf-8", got)
+		}
+		if got := w.Body.String(); got != "<p>taking too long</p>" {
+			t.Errorf("body: want custom page, got %q", got)
+		}
+	})
+
+	t.Run("default body", func(t *testing.T) {
+		w := serve(Upstream{URL: backend.URL, RequestTimeout: Duration(20 * time.Millisecond)}, "/slow")
+		if w.Code != 504 {
+			t.Errorf("status code: want 504, got %d", w.Code)
+		}
+	})
+
+	t.Run("within timeout", func(t *testing.T) {
+		w := serve(Upstream{URL: backend.URL, RequestTimeout: Duration(time.Minute), TimeoutPage: page}, "/")
+		if w.Code != 200 || w.Body.String() != "fast" {
+			t.Errorf("want 200 %q, got %d %q", "fast", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("page requires timeout", func(t *testing.T) {
+		if _, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, TimeoutPage: page}}); err == nil {
+			t.Errorf("want error, got nil")
+		}
+	})
+}
+
+func TestClientDisconnectCancelsUpstream(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	proxy := httptest.NewServer(httpsHandler(mustRoutes(map[string]string{"foo.com": backend.URL}), options{}))
+	defer proxy.Close()
+	buf := captureLog(t)
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(conn, "GET /expensive HTTP/1.1\r\nHost: foo.com\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request didn't reach the backend")
+	}
+	conn.Close() // client goes away mid-request
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("want backend request canceled after client disconnect")
+	}
+	proxy.Close() // wait for the handler to finish
+	if logged := buf.String(); strings.Contains(logged, "proxy error") {
+		t.Errorf("want client disconnect not logged as a proxy error, got %q", logged)
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	content := strings.Repeat("a { color: red; }\n", 50)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		http.ServeContent(w, r, "site.css", time.Time{}, strings.NewReader(content))
+	}))
+	defer backend.Close()
+
+	for _, minify := range []bool{false, true} {
+		routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, Minify: minify}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "https://foo.com/site.css", nil)
+		r.Header.Set("Range", "bytes=18-35") // the second rule
+		w := httptest.NewRecorder()
+		httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, r)
+
+		if w.Code != 206 {
+			t.Errorf("minify %t: status code: want 206, got %d", minify, w.Code)
+		}
+		if got := w.Header().Get("Content-Range"); got != "bytes 18-35/900" {
+			t.Errorf("minify %t: Content-Range: want %q, got %q", minify, "bytes 18-35/900", got)
+		}
+		if got := w.Body.String(); got != "a { color: red; }\n" {
+			t.Errorf("minify %t: body: want %q, got %q", minify, "a { color: red; }\n", got)
+		}
+	}
+}
+
+func TestConflictingHost(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	defer backend.Close()
+	table := mustRoutes(map[string]string{"foo.com": backend.URL, "bar.com": backend.URL})
+
+	t.Run("HTTP/2 Host header", func(t *testing.T) {
+		for name, h := range map[string]http.Handler{
+			"http":  httpHandler(table, options{}),
+			"https": httpsHandler(table, options{}),
+		} {
+			// as received over HTTP/2 with :authority foo.com.
+			r := httptest.NewRequest("GET", "https://foo.com/", nil)
+			r.ProtoMajor, r.ProtoMinor = 2, 0
+			r.Header["Host"] = []string{"bar.com"}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != 400 {
+				t.Errorf("%s: status code: want 400, got %d", name, w.Code)
+			}
+
+			r.Header["Host"] = []string{"foo.com", "foo.com"}
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != 400 {
+				t.Errorf("%s: duplicate: status code: want 400, got %d", name, w.Code)
+			}
+		}
+
+		r := httptest.NewRequest("GET", "https://foo.com/", nil)
+		r.Header["Host"] = []string{"FOO.com"}
+		w := httptest.NewRecorder()
+		httpsHandler(table, options{}).ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Errorf("matching: status code: want 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("HTTP/1", func(t *testing.T) {
+		proxy := httptest.NewServer(httpsHandler(table, options{}))
+		defer proxy.Close()
+
+		for _, tt := range []struct {
+			request  string
+			wantCode int
+			wantHost string
+		}{
+			{"GET / HTTP/1.1\r\nHost: foo.com\r\nHost: bar.com\r\n\r\n", 400, ""},
+			// the Host header of an absolute-form request is ignored.
+			{"GET http://foo.com/ HTTP/1.1\r\nHost: bar.com\r\n\r\n", 200, "foo.com"},
+		} {
+			conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(conn, tt.request)
+			rsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(rsp.Body)
+			conn.Close()
+			if rsp.StatusCode != tt.wantCode {
+				t.Errorf("%q: status code: want %d, got %d", tt.request, tt.wantCode, rsp.StatusCode)
+			}
+			if tt.wantCode == 200 && string(body) != tt.wantHost {
+				t.Errorf("%q: host: want %q, got %q", tt.request, tt.wantHost, body)
+			}
+		}
+	})
+}
+
+func TestListenAddrs(t *testing.T) {
+	table := mustRoutes(map[string]string{"foo.com": "http://localhost:8000"})
+
+	for _, tt := range []struct {
+		httpsAddr string
+		want      string
+	}{
+		{"", "https://foo.com/a?b=c"},
+		{":443", "https://foo.com/a?b=c"},
+		{":8443", "https://foo.com:8443/a?b=c"},
+	} {
+		o, err := newOptions(Conf{HTTPSAddr: tt.httpsAddr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		httpHandler(table, o).ServeHTTP(w, httptest.NewRequest("GET", "http://foo.com/a?b=c", nil))
+		if got := w.Header().Get("Location"); got != tt.want {
+			t.Errorf("httpsAddr %q: Location: want %q, got %q", tt.httpsAddr, tt.want, got)
+		}
+	}
+
+	for _, c := range []Conf{
+		{HTTPAddr: "8080"},
+		{HTTPSAddr: "localhost"},
+	} {
+		c.Certs = Certs{CertFile: "cert.pem", KeyFile: "key.pem"}
+		if err := checkConf(c); err == nil {
+			t.Errorf("%q %q: want error, got nil", c.HTTPAddr, c.HTTPSAddr)
+		}
+	}
+}
+
+func TestMaxHeaderCount(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	table := mustRoutes(map[string]string{"foo.com": backend.URL})
+	o := options{maxHeaderCount: 10}
+
+	request := func(n int) *http.Request {
+		r := httptest.NewRequest("GET", "https://foo.com/", nil)
+		for i := 0; i < n; i++ {
+			r.Header.Add(fmt.Sprintf("X-Header-%d", i%5), "v")
+		}
+		return r
+	}
+
+	for _, tt := range []struct {
+		headers int
+		want    int
+	}{
+		{10, 200},
+		{11, 431}, // repeated fields are counted
+		{1000, 431},
+	} {
+		w := httptest.NewRecorder()
+		httpsHandler(table, o).ServeHTTP(w, request(tt.headers))
+		if w.Code != tt.want {
+			t.Errorf("%d headers: status code: want %d, got %d", tt.headers, tt.want, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	httpHandler(table, o).ServeHTTP(w, request(11))
+	if w.Code != 431 {
+		t.Errorf("http: status code: want 431, got %d", w.Code)
+	}
+}
+
+func TestPathPrefixRoutes(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.Path)
+		}))
+	}
+	root, v1, v1users := newBackend("root"), newBackend("v1"), newBackend("v1users")
+	defer root.Close()
+	defer v1.Close()
+	defer v1users.Close()
+
+	routes, err := newRoutes(map[string]Upstream{
+		"foo.com":             {URL: root.URL},
+		"foo.com/v1":          {URL: v1.URL},
+		"foo.com/v1/users":    {URL: v1users.URL},
+		"api.bar.com/v1":      {URL: v1.URL},
+		"api.bar.com/v1/jobs": {URL: v1users.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := newRouteTable(routes)
+	o := options{}
+
+	for _, tt := range []struct {
+		url  string
+		code int
+		body string
+	}{
+		{"https://foo.com/", 200, "root /"},
+		{"https://foo.com/v10", 200, "root /v10"},
+		{"https://foo.com/v1", 200, "v1 /v1"},
+		{"https://foo.com/v1/", 200, "v1 /v1/"},
+		{"https://foo.com/v1/jobs", 200, "v1 /v1/jobs"},
+		{"https://foo.com/v1/users", 200, "v1users /v1/users"},
+		{"https://foo.com/v1/users/5", 200, "v1users /v1/users/5"},
+		{"https://api.bar.com/v1/x", 200, "v1 /v1/x"},
+		{"https://api.bar.com/v1/jobs/1", 200, "v1users /v1/jobs/1"},
+		{"https://api.bar.com/v2", 502, ""},
+		{"https://api.bar.com/", 502, ""},
+	} {
+		w := httptest.NewRecorder()
+		httpsHandler(table, o).ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: status code: want %d, got %d", tt.url, tt.code, w.Code)
+			continue
+		}
+		if tt.code == 200 && w.Body.String() != tt.body {
+			t.Errorf("%s: body: want %q, got %q", tt.url, tt.body, w.Body.String())
+		}
+	}
+
+	// the http handler redirects hosts that only have prefixed keys.
+	w := httptest.NewRecorder()
+	httpHandler(table, o).ServeHTTP(w, httptest.NewRequest("GET", "http://api.bar.com/v1/x", nil))
+	if w.Code != 302 {
+		t.Errorf("status code: want 302, got %d", w.Code)
+	}
+
+	if !isApex("bar.com", routes) {
+		t.Errorf("isApex: want bar.com to be an apex")
+	}
+
+	for _, k := range []string{"/v1", "foo.com/", "foo.com/v1/", "foo.com//v1", "foo.com/v1?x"} {
+		if _, err := newRoutes(map[string]Upstream{k: {URL: root.URL}}); err == nil {
+			t.Errorf("%q: want error", k)
+		}
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	for _, tt := range []struct {
+		host, defaultPort, want string
+	}{
+		{"example.com", "443", "example.com"},
+		{"Example.COM", "443", "example.com"},
+		{"example.com.", "443", "example.com"},
+		{"example.com:443", "443", "example.com"},
+		{"Example.com.:443", "443", "example.com"},
+		{"example.com:80", "80", "example.com"},
+		{"example.com:80", "443", "example.com:80"},
+		{"example.com:443", "80", "example.com:443"},
+		{"example.com.:8443", "443", "example.com:8443"},
+		{"[2001:DB8::1]", "443", "[2001:db8::1]"},
+		{"[2001:db8::1]:443", "443", "[2001:db8::1]"},
+		{"[2001:DB8:0::1]:80", "80", "[2001:db8::1]"},
+		{"[2001:db8::1]:8080", "80", "[2001:db8::1]:8080"},
+		{"[2001:db8::1]:443", "80", "[2001:db8::1]:443"},
+	} {
+		if got := normalizeHost(tt.host, tt.defaultPort); got != tt.want {
+			t.Errorf("normalizeHost(%q, %q): want %q, got %q", tt.host, tt.defaultPort, tt.want, got)
+		}
+	}
+}
+
+func TestNormalizedHostRouting(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	defer backend.Close()
+
+	table := mustRoutes(map[string]string{
+		"example.com":       backend.URL,
+		"Mixed.example.com": backend.URL,
+		"[2001:db8::1]":     backend.URL,
+		"plain.com":         backend.URL,
+	})
+	o, err := newOptions(Conf{Proxy: map[string]Upstream{"plain.com": {URL: backend.URL}}, HTTPOnlyHosts: []string{"plain.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		https    bool
+		host     string
+		wantCode int
+		wantHost string // as forwarded
+	}{
+		{true, "example.com.", 200, "example.com"},
+		{true, "EXAMPLE.com", 200, "example.com"},
+		{true, "example.com:443", 200, "example.com"},
+		{true, "Example.com.:443", 200, "example.com"},
+		{true, "mixed.example.com", 200, "mixed.example.com"},
+		{true, "[2001:db8::1]:443", 200, "[2001:db8::1]"},
+		{true, "[2001:DB8::1]", 200, "[2001:db8::1]"},
+		{true, "example.com:80", 502, ""},
+		{true, "example.com:8443", 502, ""},
+		{true, "plain.com:443", 404, ""},
+		{false, "plain.com:80", 200, "plain.com"},
+		{false, "Plain.com.", 200, "plain.com"},
+		{false, "[2001:db8::1]:80", 302, ""},
+	} {
+		scheme, h := "https", httpsHandler(table, o)
+		if !tt.https {
+			scheme, h = "http", httpHandler(table, o)
+		}
+		r := httptest.NewRequest("GET", scheme+"://foo.com/", nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s %s: status code: want %d, got %d", scheme, tt.host, tt.wantCode, w.Code)
+			continue
+		}
+		if tt.wantCode == 200 && w.Body.String() != tt.wantHost {
+			t.Errorf("%s %s: forwarded host: want %q, got %q", scheme, tt.host, tt.wantHost, w.Body.String())
+		}
+	}
+
+	// keys that differ only by case or a trailing dot are duplicates.
+	if _, err := newRoutes(map[string]Upstream{
+		"example.com":  {URL: backend.URL},
+		"Example.com.": {URL: backend.URL},
+	}); err == nil {
+		t.Errorf("want error for duplicate keys")
+	}
+}
+
+func TestIPv6Hosts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{
+		"[2001:db8::1]":      {URL: backend.URL},
+		"[2001:DB8::2]:8080": {URL: backend.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := newRouteTable(routes)
+
+	for _, host := range []string{"[2001:db8::1]", "[2001:DB8:0:0::1]", "[2001:db8::2]:8080"} {
+		r := httptest.NewRequest("GET", "https://foo.com/", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		httpsHandler(table, options{}).ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Errorf("%s: status code: want 200, got %d", host, w.Code)
+		}
+	}
+	r := httptest.NewRequest("GET", "https://foo.com/", nil)
+	r.Host = "[2001:db8::2]"
+	w := httptest.NewRecorder()
+	httpsHandler(table, options{}).ServeHTTP(w, r)
+	if w.Code != 502 {
+		t.Errorf("status code: want 502, got %d", w.Code)
+	}
+
+	for _, tt := range []struct {
+		httpsAddr string
+		want      string
+	}{
+		{"", "https://[2001:db8::1]/a?b=c"},
+		{":8443", "https://[2001:db8::1]:8443/a?b=c"},
+	} {
+		o, err := newOptions(Conf{HTTPSAddr: tt.httpsAddr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "http://foo.com/a?b=c", nil)
+		r.Host = "[2001:db8::1]"
+		w := httptest.NewRecorder()
+		httpHandler(table, o).ServeHTTP(w, r)
+		if got := w.Header().Get("Location"); got != tt.want {
+			t.Errorf("httpsAddr %q: Location: want %q, got %q", tt.httpsAddr, tt.want, got)
+		}
+	}
+
+	for _, k := range []string{"2001:db8::1", "[foo]", "[2001:db8::1"} {
+		if _, err := newRoutes(map[string]Upstream{k: {URL: backend.URL}}); err == nil {
+			t.Errorf("%q: want error", k)
+		}
+	}
+	if _, err := newRoutes(map[string]Upstream{
+		"[2001:db8::1]":  {URL: backend.URL},
+		"[2001:0db8::1]": {URL: backend.URL},
+	}); err == nil {
+		t.Errorf("want error for duplicate keys")
+	}
+}
+
+func TestTimingAllowOrigin(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Timing-Allow-Origin", "https://backend.org")
+	}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{
+		"static.org": {URL: backend.URL, TimingAllowOrigin: "*"},
+		"other.org":  {URL: backend.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+
+	for _, tt := range []struct {
+		url  string
+		want string
+	}{
+		{"https://static.org/", "*"},
+		{"https://other.org/", "https://backend.org"},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		if got := w.Header().Get("Timing-Allow-Origin"); got != tt.want {
+			t.Errorf("%s: Timing-Allow-Origin: want %q, got %q", tt.url, tt.want, got)
+		}
+	}
+
+	if _, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, TimingAllowOrigin: "a\nb"}}); err == nil {
+		t.Errorf("want error for bad timingAllowOrigin")
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.URL.Query().Get("hsts"); v != "" {
+			w.Header().Set("Strict-Transport-Security", v)
+		}
+	}))
+	defer backend.Close()
+
+	table := mustRoutes(map[string]string{
+		"foo.com":        backend.URL,
+		"tools.internal": backend.URL,
+	})
+
+	for _, tt := range []struct {
+		hsts HSTS
+		url  string
+		want string
+	}{
+		{HSTS{}, "https://foo.com/", ""},
+		{HSTS{MaxAge: 600}, "https://foo.com/", "max-age=600"},
+		{HSTS{MaxAge: 600, IncludeSubdomains: true, Preload: true}, "https://foo.com/", "max-age=600; includeSubDomains; preload"},
+		{HSTS{MaxAge: 600}, "https://foo.com/?hsts=max-age=0", "max-age=0"},
+		{HSTS{MaxAge: 600, Override: true}, "https://foo.com/?hsts=max-age=0", "max-age=600"},
+	} {
+		o, err := newOptions(Conf{HSTS: tt.hsts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		httpsHandler(table, o).ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		if got := w.Header().Get("Strict-Transport-Security"); got != tt.want {
+			t.Errorf("%+v %s: want %q, got %q", tt.hsts, tt.url, tt.want, got)
+		}
+	}
+
+	// not added over plain HTTP.
+	o, err := newOptions(Conf{
+		Proxy:         map[string]Upstream{"tools.internal": {URL: backend.URL}},
+		HTTPOnlyHosts: []string{"tools.internal"},
+		HSTS:          HSTS{MaxAge: 600},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	httpHandler(table, o).ServeHTTP(w, httptest.NewRequest("GET", "http://tools.internal/", nil))
+	if w.Code != 200 {
+		t.Errorf("status code: want 200, got %d", w.Code)
+	}
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("http: want no header, got %q", got)
+	}
+}
+
+func TestStaticFallback(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("snapshot index"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "about.html"), []byte("snapshot about"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	routes, err := newRoutes(map[string]Upstream{
+		"foo.com": {URL: down.URL, Failover: []string{down.URL}, StaticFallbackRoot: dir},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		code   int
+		body   string
+	}{
+		{"GET", "/", 200, "snapshot index"},
+		{"GET", "/about.html", 200, "snapshot about"},
+		{"GET", "/missing", 404, ""},
+		{"POST", "/", 502, ""},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, "https://foo.com"+tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s %s: status code: want %d, got %d", tt.method, tt.path, tt.code, w.Code)
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s %s: body: want %q, got %q", tt.method, tt.path, tt.body, w.Body.String())
+		}
+	}
+
+	for _, root := range []string{filepath.Join(dir, "nonexistent"), filepath.Join(dir, "index.html")} {
+		if _, err := newRoutes(map[string]Upstream{"foo.com": {URL: down.URL, StaticFallbackRoot: root}}); err == nil {
+			t.Errorf("%s: want error", root)
+		}
+	}
+}
+
+func TestRedirectStatus(t *testing.T) {
+	table := mustRoutes(map[string]string{"foo.com": "http://localhost:8000"})
+
+	for _, tt := range []struct {
+		status int
+		method string
+		want   int
+	}{
+		{0, "GET", 302},
+		{0, "POST", 307},
+		{301, "GET", 301},
+		{301, "HEAD", 301},
+		{301, "POST", 308},
+		{308, "PUT", 308},
+		{303, "GET", 303},
+		{303, "DELETE", 307},
+	} {
+		o, err := newOptions(Conf{RedirectStatus: tt.status})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		httpHandler(table, o).ServeHTTP(w, httptest.NewRequest(tt.method, "http://foo.com/a", nil))
+		if w.Code != tt.want {
+			t.Errorf("%d %s: status code: want %d, got %d", tt.status, tt.method, tt.want, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != "https://foo.com/a" {
+			t.Errorf("%d %s: Location: want %q, got %q", tt.status, tt.method, "https://foo.com/a", got)
+		}
+	}
+
+	for _, status := range []int{200, 304, 300, 404} {
+		c := Conf{RedirectStatus: status, Certs: Certs{CertFile: "cert.pem", KeyFile: "key.pem"}}
+		if err := checkConf(c); err == nil {
+			t.Errorf("%d: want error, got nil", status)
+		}
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(w, "body")
+		w.Header().Set("X-Checksum", "abc")
+		// an undeclared trailer.
+		w.Header().Set(http.TrailerPrefix+"X-Late", "def")
+	}))
+	defer backend.Close()
+
+	for name, u := range map[string]Upstream{
+		"plain":    {URL: backend.URL},
+		"failover": {URL: backend.URL, Failover: []string{backend.URL}, RetryOnStatus: []int{503}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			routes, err := newRoutes(map[string]Upstream{"foo.com": u})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := httptest.NewServer(accessLog(httpsHandler(newRouteTable(routes), options{}), "off", io.Discard))
+			defer s.Close()
+
+			req, _ := http.NewRequest("GET", s.URL, nil)
+			req.Host = "foo.com"
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rsp.Body.Close()
+			b, err := io.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "body" {
+				t.Errorf("body: want %q, got %q", "body", b)
+			}
+			for k, want := range map[string]string{"X-Checksum": "abc", "X-Late": "def"} {
+				if got := rsp.Trailer.Get(k); got != want {
+					t.Errorf("trailer %s: want %q, got %q", k, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthPath(t *testing.T) {
+	table := mustRoutes(map[string]string{"foo.com": "http://localhost:8000"})
+	o, err := newOptions(Conf{HealthPath: "/healthz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, h := range map[string]http.Handler{"http": httpHandler(table, o), "https": httpsHandler(table, o)} {
+		for _, host := range []string{"foo.com", "10.0.0.1", ""} {
+			r := httptest.NewRequest("GET", "/healthz", nil)
+			r.Host = host
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != 200 || w.Body.String() != "ok" {
+				t.Errorf("%s %q: want 200 ok, got %d %q", name, host, w.Code, w.Body.String())
+			}
+		}
+
+		// other paths and methods aren't affected.
+		r := httptest.NewRequest("POST", "/healthz", nil)
+		r.Host = "10.0.0.1"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != 502 {
+			t.Errorf("%s POST: status code: want 502, got %d", name, w.Code)
+		}
+	}
+
+	if _, err := newOptions(Conf{HealthPath: "healthz"}); err == nil {
+		t.Errorf("want error for relative healthPath")
+	}
+}
+
+func TestRewriteMethod(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.Method, b)
+	}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{
+		"hooks.foo.com": {URL: backend.URL, RewriteMethod: map[string]string{"POST": "PUT", "GET": "POST"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+
+	for _, tt := range []struct {
+		method string
+		body   string
+		want   string
+	}{
+		{"POST", "payload", "PUT payload"},
+		{"GET", "", "POST "},
+		{"DELETE", "", "DELETE "},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, "https://hooks.foo.com/", strings.NewReader(tt.body)))
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s: want %q, got %q", tt.method, tt.want, got)
+		}
+	}
+
+	if _, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, RewriteMethod: map[string]string{"POST": "P UT"}}}); err == nil {
+		t.Errorf("want error for bad method")
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	var s http.Server
+	setTimeouts(&s, Timeouts{})
+	if s.ReadHeaderTimeout != 10*time.Second || s.IdleTimeout != 120*time.Second || s.ReadTimeout != 0 || s.WriteTimeout != 0 {
+		t.Errorf("unexpected defaults: %v %v %v %v", s.ReadHeaderTimeout, s.IdleTimeout, s.ReadTimeout, s.WriteTimeout)
+	}
+
+	// a client that is slow to send its headers is disconnected.
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	setTimeouts(srv.Config, Timeouts{ReadHeader: Duration(100 * time.Millisecond)})
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: foo.com\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	io.Copy(io.Discard, conn)
+	if d := time.Since(start); d > 4*time.Second {
+		t.Errorf("want connection closed after the read header timeout, still open after %v", d)
+	}
+
+	c := Conf{Timeouts: Timeouts{Write: -1}, Certs: Certs{CertFile: "cert.pem", KeyFile: "key.pem"}}
+	if err := checkConf(c); err == nil {
+		t.Errorf("want error for negative timeout")
+	}
+}
+
+// serveSOCKS5 serves SOCKS5 CONNECT requests without authentication on l,
+// sending the requested addresses to addrs.
+func serveSOCKS5(l net.Listener, addrs chan<- string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			// greeting: version, methods
+			var hdr [2]byte
+			if _, err := io.ReadFull(br, hdr[:]); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(br, make([]byte, hdr[1])); err != nil {
+				return
+			}
+			conn.Write([]byte{5, 0}) // no authentication
+			// request: version, command, reserved, address type
+			var req [4]byte
+			if _, err := io.ReadFull(br, req[:]); err != nil || req[1] != 1 {
+				return
+			}
+			var host string
+			switch req[3] {
+			case 1:
+				ip := make([]byte, 4)
+				io.ReadFull(br, ip)
+				host = net.IP(ip).String()
+			case 3:
+				n, _ := br.ReadByte()
+				name := make([]byte, n)
+				io.ReadFull(br, name)
+				host = string(name)
+			default:
+				return
+			}
+			var port [2]byte
+			io.ReadFull(br, port[:])
+			addr := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+			addrs <- addr
+			upstream, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer upstream.Close()
+			conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			go io.Copy(upstream, br)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addrs := make(chan string, 10)
+	go serveSOCKS5(l, addrs)
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, SOCKS5Proxy: l.Addr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+	if w.Code != 200 || w.Body.String() != "backend" {
+		t.Errorf("want 200 %q, got %d %q", "backend", w.Code, w.Body.String())
+	}
+	select {
+	case addr := <-addrs:
+		if want := backend.Listener.Addr().String(); addr != want {
+			t.Errorf("SOCKS5 CONNECT: want %s, got %s", want, addr)
+		}
+	default:
+		t.Errorf("want connection through the SOCKS5 proxy")
+	}
+
+	for _, addr := range []string{"localhost", "socks5://localhost:1080"} {
+		if _, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, SOCKS5Proxy: addr}}); err == nil {
+			t.Errorf("%q: want error", addr)
+		}
+	}
+}
+
+func TestUpstreamErrorLogs(t *testing.T) {
+	buf := captureLog(t)
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	routes, err := newRoutes(map[string]Upstream{
+		"down.com": {URL: down.URL},
+		"slow.com": {URL: slow.URL, ResponseHeaderTimeout: Duration(20 * time.Millisecond), IdleConnTimeout: Duration(time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := routes["slow.com"].transport.(*http.Transport).IdleConnTimeout; d != time.Minute {
+		t.Errorf("IdleConnTimeout: want 1m, got %v", d)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+
+	for _, tt := range []struct {
+		url  string
+		code int
+		log  string
+	}{
+		{"https://down.com/a", 502, "connect error to " + down.Listener.Addr().String() + " for down.com/a"},
+		{"https://slow.com/b", 504, "response header timeout from " + slow.Listener.Addr().String() + " for slow.com/b"},
+	} {
+		before := len(buf.String())
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: status code: want %d, got %d", tt.url, tt.code, w.Code)
+		}
+		if logged := buf.String()[before:]; !strings.Contains(logged, tt.log) {
+			t.Errorf("%s: want log containing %q, got %q", tt.url, tt.log, logged)
+		}
+	}
+}
+
+func TestEarlyHints(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		io.WriteString(w, "body")
+	}))
+	defer backend.Close()
+
+	for _, drop := range []bool{false, true} {
+		routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, DropEarlyHints: drop, LogSizes: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := httptest.NewServer(httpsHandler(newRouteTable(routes), options{}))
+		defer s.Close()
+
+		var hints []string
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				hints = append(hints, fmt.Sprintf("%d %s", code, header.Get("Link")))
+				return nil
+			},
+		}
+		req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "GET", s.URL, nil)
+		req.Host = "foo.com"
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != 200 || string(b) != "body" {
+			t.Errorf("drop %v: want 200 body, got %d %q", drop, rsp.StatusCode, b)
+		}
+		if got := rsp.Header.Get("Link"); got != "" {
+			t.Errorf("drop %v: final response has hint header: %q", drop, got)
+		}
+		var want []string
+		if !drop {
+			want = []string{"103 </style.css>; rel=preload; as=style"}
+		}
+		if !reflect.DeepEqual(hints, want) {
+			t.Errorf("drop %v: 1xx responses: want %q, got %q", drop, want, hints)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	backend := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		if h := ws.Request().Header; h.Get("X-Forwarded-Host") != "foo.com" || h.Get("X-Forwarded-For") == "" {
+			// the client sees the connection close.
+			return
+		}
+		io.Copy(ws, ws)
+	}))
+	defer backend.Close()
+
+	for name, u := range map[string]Upstream{
+		"plain":    {URL: backend.URL},
+		"failover": {URL: backend.URL, Failover: []string{backend.URL}, RetryOnStatus: []int{503}},
+		"sizes":    {URL: backend.URL, LogSizes: true, DropEarlyHints: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			routes, err := newRoutes(map[string]Upstream{"foo.com": u})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := httptest.NewServer(accessLog(httpsHandler(newRouteTable(routes), options{}), "text", io.Discard))
+			defer s.Close()
+
+			conn, err := net.Dial("tcp", s.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conf, err := websocket.NewConfig("ws://foo.com/", "http://foo.com/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws, err := websocket.NewClient(conf, conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+
+			for _, msg := range []string{"hello", "world"} {
+				if err := websocket.Message.Send(ws, msg); err != nil {
+					t.Fatal(err)
+				}
+				var got string
+				if err := websocket.Message.Receive(ws, &got); err != nil {
+					t.Fatal(err)
+				}
+				if got != msg {
+					t.Errorf("echo: want %q, got %q", msg, got)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "502.html")
+	if err := os.WriteFile(page, []byte("<h1>Bad gateway</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newOptions(Conf{ErrorPages: map[string]string{"502": filepath.Join(dir, "missing.html")}}); err == nil {
+		t.Error("missing page: want error")
+	}
+	if _, err := newOptions(Conf{ErrorPages: map[string]string{"bad": page}}); err == nil {
+		t.Error("bad status: want error")
+	}
+
+	o, err := newOptions(Conf{ErrorPages: map[string]string{"502": page}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := mustRoutes(map[string]string{"foo.com": "http://127.0.0.1:1"}) // nothing listens
+
+	testcases := []struct {
+		name    string
+		handler http.Handler
+		url     string
+		body    string
+		ct      string
+	}{
+		{"unknown host http", httpHandler(table, o), "http://bar.com/", "<h1>Bad gateway</h1>", "text/html; charset=utf-8"},
+		{"unknown host https", httpsHandler(table, o), "https://bar.com/", "<h1>Bad gateway</h1>", "text/html; charset=utf-8"},
+		{"proxy error", httpsHandler(table, o), "https://foo.com/", "<h1>Bad gateway</h1>", "text/html; charset=utf-8"},
+		{"no page", httpsHandler(table, options{}), "https://bar.com/", "Bad Gateway\n", "text/plain; charset=utf-8"},
+	}
+	for _, tc := range testcases {
+		w := httptest.NewRecorder()
+		tc.handler.ServeHTTP(w, httptest.NewRequest("GET", tc.url, nil))
+		if w.Code != 502 {
+			t.Errorf("%s: status code: want 502, got %d", tc.name, w.Code)
+		}
+		if w.Body.String() != tc.body {
+			t.Errorf("%s: body: want %q, got %q", tc.name, tc.body, w.Body.String())
+		}
+		if got := w.Header().Get("Content-Type"); got != tc.ct {
+			t.Errorf("%s: content type: want %q, got %q", tc.name, tc.ct, got)
+		}
+	}
+}
+
+func TestErrorPagesForRejectedRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	pages := make(map[string]string)
+	for _, code := range []string{"400", "403", "405", "415"} {
+		page := filepath.Join(dir, code+".html")
+		if err := os.WriteFile(page, []byte("<h1>"+code+"</h1>"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pages[code] = page
+	}
+	routes, err := newRoutes(map[string]Upstream{
+		"plain.com":  {URL: backend.URL, RequireHTTPS: true},
+		"signed.com": {URL: backend.URL, SignedURL: &SignedURL{Secret: "s3cret"}},
+		"json.com":   {URL: backend.URL, AllowContentTypes: []string{"application/json"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := newRouteTable(routes)
+
+	newRequest := func(method, url string) *http.Request {
+		var body io.Reader
+		if method == "POST" {
+			body = strings.NewReader("a=b")
+		}
+		r := httptest.NewRequest(method, url, body)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Request-Id", "abc")
+		return r
+	}
+
+	for _, tt := range []struct {
+		name string
+		r    *http.Request
+		code int
+	}{
+		{"https required", newRequest("GET", "http://plain.com/"), 400},
+		{"unsigned", newRequest("GET", "https://signed.com/a.zip"), 403},
+		{"content type", newRequest("POST", "https://json.com/"), 415},
+		{"connect", newRequest("CONNECT", "https://json.com/"), 405},
+	} {
+		o, err := newOptions(Conf{ErrorPages: pages, RequestIDHeader: "X-Request-Id"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		httpsHandler(table, o).ServeHTTP(w, tt.r)
+		if w.Code != tt.code {
+			t.Errorf("%s: status code: want %d, got %d", tt.name, tt.code, w.Code)
+		}
+		if want := fmt.Sprintf("<h1>%d</h1>", tt.code); w.Body.String() != want {
+			t.Errorf("%s: body: want %q, got %q", tt.name, want, w.Body.String())
+		}
+		if got := w.Header().Get("X-Request-Id"); got != "abc" {
+			t.Errorf("%s: request ID: want %q, got %q", tt.name, "abc", got)
+		}
+	}
+
+	// without a page, JSON errors apply, and custom messages are kept
+	// for plain text.
+	o, err := newOptions(Conf{ErrorFormat: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	httpsHandler(table, o).ServeHTTP(w, newRequest("GET", "https://signed.com/a.zip"))
+	if got := w.Header().Get("Content-Type"); w.Code != 403 || got != "application/json" {
+		t.Errorf("json: want 403 application/json, got %d %q", w.Code, got)
+	}
+	w = httptest.NewRecorder()
+	httpsHandler(table, options{}).ServeHTTP(w, newRequest("GET", "http://plain.com/"))
+	if got := w.Body.String(); got != "HTTPS required\n" {
+		t.Errorf("text: body: want %q, got %q", "HTTPS required\n", got)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// ipFilter allows or denies clients by IP address.
+type ipFilter struct {
+	allow []*net.IPNet // empty means all that aren't denied
+	deny  []*net.IPNet
+}
+
+// newIPFilter returns the filter for the allow and deny lists of IP
+// addresses and CIDR ranges, or nil if both are empty. prefix is for the
+// config field names in errors, such as "" or "foo.com: ".
+func newIPFilter(prefix string, allow, deny []string) (*ipFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	a, err := parseIPNets(prefix+"allow", allow)
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseIPNets(prefix+"deny", deny)
+	if err != nil {
+		return nil, err
+	}
+	return &ipFilter{allow: a, deny: d}, nil
+}
+
+// allows reports whether ip isn't denied and, if there is an allow list,
+// is in it. Deny takes precedence over allow.
+func (f *ipFilter) allows(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectIP responds with a 403 and returns true if f, if non-nil, doesn't
+// allow the request's client.
+func (o options) rejectIP(w http.ResponseWriter, r *http.Request, f *ipFilter) bool {
+	if f == nil || f.allows(net.ParseIP(o.clientIP(r))) {
+		return false
+	}
+	o.httpError(w, r, http.StatusForbidden)
+	return true
+}
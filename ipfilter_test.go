@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	f, err := newIPFilter("", []string{"192.0.2.0/24", "2001:db8::/32"}, []string{"192.0.2.7", "2001:db8:bad::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"192.0.2.1":        true,
+		"192.0.2.7":        false,
+		"198.51.100.1":     false,
+		"2001:db8::1":      true,
+		"2001:db8:bad::1":  false,
+		"2001:db9::1":      false,
+		"::ffff:192.0.2.1": true,
+	} {
+		if got := f.allows(net.ParseIP(ip)); got != want {
+			t.Errorf("%s: want %v, got %v", ip, want, got)
+		}
+	}
+
+	f, err = newIPFilter("", nil, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.allows(net.ParseIP("192.0.2.1")) || f.allows(net.ParseIP("10.1.2.3")) {
+		t.Error("deny only: want other clients allowed")
+	}
+
+	if f, err := newIPFilter("", nil, nil); f != nil || err != nil {
+		t.Errorf("empty: want no filter, got %v, %v", f, err)
+	}
+	for _, bad := range []string{"192.0.2.0/33", "not an ip", "2001:db8::/129", "192.0.2"} {
+		if _, err := newIPFilter("", []string{bad}, nil); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+	if _, err := newRoutes(map[string]Upstream{"foo.com": {URL: "http://localhost:8000", Deny: []string{"bad"}}}); err == nil {
+		t.Error("bad upstream deny: want error")
+	}
+	if _, err := newOptions(Conf{Allow: []string{"bad"}}); err == nil {
+		t.Error("bad allow: want error")
+	}
+}
+
+func TestAllowDeny(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	c := Conf{
+		Proxy: map[string]Upstream{
+			"admin.foo.com": {URL: backend.URL, Allow: []string{"192.0.2.0/24", "2001:db8::/32"}},
+			"foo.com":       {URL: backend.URL},
+		},
+		Deny:           []string{"198.51.100.0/24"},
+		TrustedProxies: []string{"10.0.0.1"},
+	}
+	o, err := newOptions(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := newRoutes(c.Proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), o)
+
+	testcases := []struct {
+		host       string
+		remoteAddr string
+		forwarded  string
+		want       int
+	}{
+		{"foo.com", "203.0.113.1:1234", "", 200},
+		{"foo.com", "198.51.100.1:1234", "", 403},
+		{"admin.foo.com", "192.0.2.1:1234", "", 200},
+		{"admin.foo.com", "[2001:db8::1]:1234", "", 200},
+		{"admin.foo.com", "203.0.113.1:1234", "", 403},
+		{"admin.foo.com", "10.0.0.1:1234", "192.0.2.1", 200},
+		{"admin.foo.com", "10.0.0.1:1234", "203.0.113.1", 403},
+		// the forwarded address isn't trusted from other clients.
+		{"admin.foo.com", "203.0.113.1:1234", "192.0.2.1", 403},
+	}
+	for _, tc := range testcases {
+		r := httptest.NewRequest("GET", "https://"+tc.host+"/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s from %s (%q): status code: want %d, got %d", tc.host, tc.remoteAddr, tc.forwarded, tc.want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultLatencyInterval = time.Minute
+
+// defaultLatencyWindow is the default length of the sliding window over
+// which percentiles are logged, in latency intervals, and maxLatencyWindow
+// the largest, which bounds the memory of the histograms.
+const (
+	defaultLatencyWindow = 5
+	maxLatencyWindow     = 60
+)
+
+// latencyWindow returns the latency interval and the length of the sliding
+// window in intervals of c.
+func latencyWindow(c Log) (time.Duration, int) {
+	interval := time.Duration(c.LatencyInterval)
+	if interval == 0 {
+		interval = defaultLatencyInterval
+	}
+	if c.LatencyWindow == 0 {
+		return interval, defaultLatencyWindow
+	}
+	return interval, int(time.Duration(c.LatencyWindow) / interval)
+}
+
+// Values are recorded in buckets whose bounds grow by histogramGrowth,
+// starting at 1, so that percentiles are estimated within 5% using constant
+// memory per interval however many values there are.
+const (
+	histogramGrowth  = 1.05
+	histogramBuckets = 512 // up to about 6.6e10
+)
+
+// histogram estimates percentiles of values over a sliding window of
+// intervals: the current one, whose values are being recorded, and the
+// ones before it, which are kept until they leave the window.
+type histogram struct {
+	mu     sync.Mutex
+	counts [histogramBuckets]int64
+	n      int64
+	past   []*histogramCounts // in the window, most recent last
+}
+
+// histogramCounts are the counts of a past interval.
+type histogramCounts struct {
+	counts [histogramBuckets]int64
+	n      int64
+}
+
+func (h *histogram) record(v float64) {
+	i := 0
+	if v > 1 {
+		i = int(math.Ceil(math.Log(v) / math.Log(histogramGrowth)))
+		if i >= histogramBuckets {
+			i = histogramBuckets - 1
+		}
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.n++
+	h.mu.Unlock()
+}
+
+// rotate returns the percentiles qs of the values recorded in the window
+// of the current interval and the intervals-1 before it, and the number of
+// values, and starts a new interval.
+func (h *histogram) rotate(intervals int, qs ...float64) ([]float64, int64) {
+	h.mu.Lock()
+	h.past = append(h.past, &histogramCounts{counts: h.counts, n: h.n})
+	h.counts, h.n = [histogramBuckets]int64{}, 0
+	if len(h.past) > intervals {
+		h.past = h.past[len(h.past)-intervals:]
+	}
+	var counts [histogramBuckets]int64
+	var n int64
+	for _, p := range h.past {
+		for i, c := range p.counts {
+			counts[i] += c
+		}
+		n += p.n
+	}
+	h.mu.Unlock()
+
+	vs := make([]float64, len(qs))
+	if n == 0 {
+		return vs, 0
+	}
+	for j, q := range qs {
+		rank := int64(math.Ceil(q * float64(n)))
+		var seen int64
+		for i, c := range counts {
+			seen += c
+			if seen >= rank {
+				vs[j] = math.Pow(histogramGrowth, float64(i))
+				break
+			}
+		}
+	}
+	return vs, n
+}
+
+// latencyMin is the unit of recorded latencies; shorter ones are counted
+// as latencyMin.
+const latencyMin = time.Microsecond
+
+// latencyTracker estimates percentiles of request latencies over a sliding
+// window, up to about 18 hours.
+type latencyTracker struct {
+	h histogram
+}
+
+func (t *latencyTracker) record(d time.Duration) {
+	t.h.record(float64(d) / float64(latencyMin))
+}
+
+// rotate returns the percentiles qs of the latencies recorded in the
+// window of the current interval and the intervals-1 before it, and the
+// number of latencies, and starts a new interval.
+func (t *latencyTracker) rotate(intervals int, qs ...float64) ([]time.Duration, int64) {
+	vs, n := t.h.rotate(intervals, qs...)
+	ds := make([]time.Duration, len(vs))
+	for i, v := range vs {
+		ds[i] = time.Duration(v * float64(latencyMin))
+	}
+	return ds, n
+}
+
+// reportStats logs the latency and size percentiles of the routes in table
+// that track them every interval, over a sliding window of the past window
+// intervals, until ctx is done.
+func reportStats(ctx context.Context, table *routeTable, interval time.Duration, window int) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		proxy := table.load()
+		hosts := make([]string, 0, len(proxy))
+		for host, r := range proxy {
+			if r.latency != nil || r.sizes != nil || r.headerSizes != nil {
+				hosts = append(hosts, host)
+			}
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			if r := proxy[host]; r.latency != nil {
+				logLatency(host, r.latency, interval, window)
+			}
+			if r := proxy[host]; r.sizes != nil {
+				logSizes(host, r.sizes, interval, window)
+			}
+			if r := proxy[host]; r.headerSizes != nil {
+				logHeaderSizes(host, r.headerSizes, interval, window)
+			}
+		}
+	}
+}
+
+// logLatency logs the percentiles of the latencies in t over the past
+// window intervals, and starts a new interval.
+func logLatency(host string, t *latencyTracker, interval time.Duration, window int) {
+	ps, n := t.rotate(window, 0.5, 0.9, 0.99)
+	d := interval * time.Duration(window)
+	if n == 0 {
+		log.Printf("latency for %s over %s: no requests", host, d)
+		return
+	}
+	for i := range ps {
+		ps[i] = ps[i].Round(time.Microsecond)
+	}
+	log.Printf("latency for %s over %s: %d requests, p50 %s, p90 %s, p99 %s", host, d, n, ps[0], ps[1], ps[2])
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	var tr latencyTracker
+	// 1ms, 2ms, ..., 100ms, in an order other than sorted.
+	for i := 100; i >= 1; i-- {
+		tr.record(time.Duration(i) * time.Millisecond)
+	}
+
+	ps, n := tr.rotate(1, 0.5, 0.9, 0.99)
+	if n != 100 {
+		t.Errorf("count: want 100, got %d", n)
+	}
+	for i, want := range []time.Duration{50 * time.Millisecond, 90 * time.Millisecond, 99 * time.Millisecond} {
+		// estimates are within the bucket growth of 5%.
+		if ps[i] < want || float64(ps[i]) > float64(want)*histogramGrowth {
+			t.Errorf("percentile %d: want within 5%% above %s, got %s", i, want, ps[i])
+		}
+	}
+
+	if _, n := tr.rotate(1, 0.5); n != 0 {
+		t.Errorf("after rotate: want count 0, got %d", n)
+	}
+
+	// out of range latencies are clamped.
+	tr.record(0)
+	tr.record(100 * time.Hour)
+	ps, _ = tr.rotate(1, 0, 1)
+	if ps[0] != latencyMin {
+		t.Errorf("min: want %s, got %s", latencyMin, ps[0])
+	}
+	if ps[1] < time.Hour {
+		t.Errorf("max: want clamped to the last bucket, got %s", ps[1])
+	}
+}
+
+func TestLogLatency(t *testing.T) {
+	buf := captureLog(t)
+	var tr latencyTracker
+	tr.record(10 * time.Millisecond)
+
+	logLatency("foo.com", &tr, time.Minute, 1)
+	logLatency("foo.com", &tr, time.Minute, 1)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 log lines, got %q", lines)
+	}
+	if want := "latency for foo.com over 1m0s: 1 requests, p50 "; !strings.Contains(lines[0], want) {
+		t.Errorf("want %q, got %q", want, lines[0])
+	}
+	if want := "latency for foo.com over 1m0s: no requests"; !strings.HasSuffix(lines[1], want) {
+		t.Errorf("want %q, got %q", want, lines[1])
+	}
+}
+
+func TestLatencyWindow(t *testing.T) {
+	var tr latencyTracker
+	// 10ms in the first interval, 20ms in the second, and 30ms in the
+	// third, over a window of 2 intervals.
+	for i, want := range []struct {
+		n   int64
+		p50 time.Duration
+	}{{1, 10 * time.Millisecond}, {2, 10 * time.Millisecond}, {2, 20 * time.Millisecond}} {
+		tr.record(time.Duration(i+1) * 10 * time.Millisecond)
+		ps, n := tr.rotate(2, 0.5)
+		if n != want.n || ps[0] < want.p50 || float64(ps[0]) > float64(want.p50)*histogramGrowth {
+			t.Errorf("interval %d: want %d latencies with p50 %s, got %d with %s", i, want.n, want.p50, n, ps[0])
+		}
+	}
+	// the window moves on without new latencies.
+	if _, n := tr.rotate(2, 0.5); n != 1 {
+		t.Errorf("want the last latency in the window, got %d", n)
+	}
+	if _, n := tr.rotate(2, 0.5); n != 0 {
+		t.Errorf("want an empty window, got %d latencies", n)
+	}
+
+	buf := captureLog(t)
+	logLatency("foo.com", &tr, time.Minute, 5)
+	if want := "latency for foo.com over 5m0s: no requests"; !strings.HasSuffix(strings.TrimSpace(buf.String()), want) {
+		t.Errorf("want %q, got %q", want, buf.String())
+	}
+
+	for _, tt := range []struct {
+		c        Log
+		interval time.Duration
+		window   int
+		ok       bool
+	}{
+		{Log{}, time.Minute, 5, true},
+		{Log{LatencyWindow: Duration(time.Hour)}, time.Minute, 60, true},
+		{Log{LatencyInterval: Duration(10 * time.Second), LatencyWindow: Duration(time.Minute)}, 10 * time.Second, 6, true},
+		{Log{LatencyWindow: Duration(90 * time.Second)}, 0, 0, false},
+		{Log{LatencyWindow: Duration(61 * time.Minute)}, 0, 0, false},
+		{Log{LatencyWindow: Duration(-time.Minute)}, 0, 0, false},
+	} {
+		c := Conf{Log: tt.c, Certs: Certs{Auto: true, CertDir: t.TempDir()}}
+		if err := checkConf(c); (err == nil) != tt.ok {
+			t.Errorf("%+v: want ok %v, got %v", tt.c, tt.ok, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if interval, window := latencyWindow(tt.c); interval != tt.interval || window != tt.window {
+			t.Errorf("%+v: want %s and %d intervals, got %s and %d", tt.c, tt.interval, tt.window, interval, window)
+		}
+	}
+}
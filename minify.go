@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/html"
+	"github.com/tdewolff/minify/v2/js"
+)
+
+// maxMinifySize is the largest response body that is minified. Larger
+// bodies are passed through unchanged, to bound memory use.
+const maxMinifySize = 10 << 20
+
+var minifier = func() *minify.M {
+	m := minify.New()
+	m.AddFunc("text/html", html.Minify)
+	m.AddFunc("text/css", css.Minify)
+	m.AddFunc("application/javascript", js.Minify)
+	m.AddFunc("text/javascript", js.Minify)
+	return m
+}()
+
+// minifyResponse minifies the body of an HTML, CSS, or JavaScript response.
+// Only 200 responses are minified; partial content in particular must be
+// passed through, since its range is of the original body. Responses that
+// are encoded, that are of unknown length (which includes
+// streamed responses), that are too large, or whose path indicates that
+// they are already minified are left unchanged.
+func minifyResponse(rsp *http.Response) error {
+	if rsp.StatusCode != http.StatusOK {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(rsp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	switch mediaType {
+	case "text/html", "text/css", "application/javascript", "text/javascript":
+	default:
+		return nil
+	}
+	if rsp.Header.Get("Content-Encoding") != "" ||
+		rsp.ContentLength < 0 || rsp.ContentLength > maxMinifySize ||
+		strings.Contains(rsp.Request.URL.Path, ".min.") {
+		return nil
+	}
+
+	b, err := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if m, err := minifier.Bytes(mediaType, b); err == nil {
+		b = m
+		// the representation changed; the validator is no longer
+		// byte-for-byte accurate.
+		if etag := rsp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			rsp.Header.Set("ETag", "W/"+etag)
+		}
+		// ranges of the minified body can't be requested.
+		rsp.Header.Del("Accept-Ranges")
+	}
+
+	rsp.Body = io.NopCloser(bytes.NewReader(b))
+	rsp.ContentLength = int64(len(b))
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestMinify(t *testing.T) {
+	const page = "<html>\n  <body>\n    <p>\n      hello   world\n    </p>\n  </body>\n</html>\n"
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stream":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(page))
+			w.(http.Flusher).Flush() // no Content-Length
+		case "/text":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(page))
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(page))
+		}
+	}))
+	defer backend.Close()
+
+	serve := func(minify bool, path string) *httptest.ResponseRecorder {
+		routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, Minify: minify}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com"+path, nil))
+		return w
+	}
+
+	t.Run("minified", func(t *testing.T) {
+		w := serve(true, "/")
+		if w.Body.Len() >= len(page) {
+			t.Errorf("want minified body smaller than %d bytes, got %d bytes: %q", len(page), w.Body.Len(), w.Body.String())
+		}
+		if got, want := w.Header().Get("Content-Length"), strconv.Itoa(w.Body.Len()); got != want {
+			t.Errorf("Content-Length: want %s, got %s", want, got)
+		}
+		if got, want := w.Header().Get("ETag"), `W/"v1"`; got != want {
+			t.Errorf("ETag: want %s, got %s", want, got)
+		}
+	})
+
+	for _, tt := range []struct {
+		name   string
+		minify bool
+		path   string
+	}{
+		{"off", false, "/"},
+		{"already minified", true, "/app.min.html"},
+		{"streaming", true, "/stream"},
+		{"other content type", true, "/text"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(tt.minify, tt.path)
+			if got := w.Body.String(); got != page {
+				t.Errorf("want unchanged body, got %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// maxMirrorBodySize limits the size of a request body that is copied to
+// be sent to the mirror. Requests with larger bodies aren't mirrored.
+const maxMirrorBodySize = 1 << 20
+
+// maxMirrorRequests limits the number of requests in flight to a mirror.
+// Requests beyond the limit aren't mirrored, so a slow mirror can't
+// accumulate requests.
+const maxMirrorRequests = 100
+
+const mirrorTimeout = 30 * time.Second
+
+// mirror sends copies of requests to a shadow destination server, whose
+// responses are discarded.
+type mirror struct {
+	target    url.URL
+	transport http.RoundTripper
+	inflight  chan struct{}
+}
+
+// newMirror returns a mirror to target that uses transport, which has the
+// connection settings of the route.
+func newMirror(target url.URL, transport http.RoundTripper) *mirror {
+	return &mirror{
+		target:    target,
+		transport: transport,
+		inflight:  make(chan struct{}, maxMirrorRequests),
+	}
+}
+
+// send sends a copy of r to the mirror in the background. The body of r is
+// copied as it is read for the primary, without holding it up, and the
+// copy is sent once the body has been read entirely; r.Body is replaced to
+// that end. Requests whose body isn't read entirely aren't mirrored.
+func (m *mirror) send(r *http.Request) {
+	if r.ContentLength > maxMirrorBodySize {
+		return
+	}
+	out := r.Clone(context.Background())
+	out.RequestURI = ""
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	(&httputil.ProxyRequest{In: r, Out: out}).SetURL(&m.target)
+	out.Host = r.Host
+
+	if r.Body == nil || r.Body == http.NoBody {
+		m.dispatch(out, nil)
+		return
+	}
+	r.Body = &mirrorBody{ReadCloser: r.Body, done: func(body []byte) {
+		m.dispatch(out, body)
+	}}
+}
+
+// dispatch sends out with body to the mirror in the background, unless
+// too many requests are in flight.
+func (m *mirror) dispatch(out *http.Request, body []byte) {
+	select {
+	case m.inflight <- struct{}{}:
+	default:
+		log.Printf("mirror for %s%s: too many requests in flight; skipping", out.Host, out.URL.Path)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	out = out.WithContext(ctx)
+	out.Body = http.NoBody
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	out.ContentLength = int64(len(body))
+	out.TransferEncoding = nil
+
+	go func() {
+		defer func() { <-m.inflight }()
+		defer cancel()
+		rsp, err := m.transport.RoundTrip(out)
+		if err != nil {
+			log.Printf("mirror for %s%s: %s", out.Host, out.URL.Path, err)
+			return
+		}
+		io.Copy(io.Discard, rsp.Body)
+		rsp.Body.Close()
+	}()
+}
+
+// mirrorBody copies a request body as it is read, and calls done with the
+// copy once it has been read entirely, unless it is larger than
+// maxMirrorBodySize.
+type mirrorBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	over bool
+	done func(body []byte)
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.over {
+		if b.buf.Len()+n > maxMirrorBodySize {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.over && b.done != nil {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "primary got "+string(b))
+	}))
+	defer primary.Close()
+
+	type mirrored struct {
+		method, host, path, body string
+	}
+	got := make(chan mirrored, 1)
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got <- mirrored{r.Method, r.Host, r.URL.Path, string(b)}
+		<-release // a slow shadow doesn't hold up the client
+		w.WriteHeader(500)
+	}))
+	defer shadow.Close()
+	defer close(release)
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: primary.URL, Mirror: shadow.URL + "/v2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "https://foo.com/orders", strings.NewReader("order 1"))
+	httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, r)
+
+	if w.Code != 200 || w.Body.String() != "primary got order 1" {
+		t.Errorf("client: want 200 %q, got %d %q", "primary got order 1", w.Code, w.Body.String())
+	}
+	select {
+	case m := <-got:
+		want := mirrored{"POST", "foo.com", "/v2/orders", "order 1"}
+		if m != want {
+			t.Errorf("shadow: want %+v, got %+v", want, m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("want request mirrored to the shadow")
+	}
+}
+
+func TestMirrorBody(t *testing.T) {
+	firstByte := make(chan struct{})
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(r.Body, b); err != nil {
+			t.Error(err)
+		}
+		close(firstByte)
+		rest, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d", 1+len(rest))
+	}))
+	defer primary.Close()
+
+	got := make(chan int, 1)
+	shadow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got <- len(b)
+	}))
+	defer shadow.Close()
+	// the mirror is reached with the route's TLS settings.
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: shadow.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: primary.URL, Mirror: shadow.URL, UpstreamCA: ca}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+
+	for _, tt := range []struct {
+		size     int
+		mirrored bool
+	}{
+		{100, true},
+		{maxMirrorBodySize + 1, false},
+	} {
+		// the rest of the body is only sent once the primary has read
+		// its start, so that the primary would never get the request
+		// if the body were read for the mirror first.
+		firstByte = make(chan struct{})
+		pr, pw := io.Pipe()
+		go func(size int, firstByte chan struct{}) {
+			pw.Write([]byte("a"))
+			<-firstByte
+			pw.Write(bytes.Repeat([]byte("b"), size-1))
+			pw.Close()
+		}(tt.size, firstByte)
+
+		w := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h.ServeHTTP(w, httptest.NewRequest("POST", "https://foo.com/", pr))
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("size %d: primary request held up by the mirror", tt.size)
+		}
+		if want := fmt.Sprint(tt.size); w.Body.String() != want {
+			t.Errorf("size %d: primary: want %s bytes, got %q", tt.size, want, w.Body.String())
+		}
+
+		select {
+		case n := <-got:
+			if !tt.mirrored {
+				t.Errorf("size %d: want not mirrored, got %d bytes", tt.size, n)
+			} else if n != tt.size {
+				t.Errorf("size %d: mirror: want %d bytes, got %d", tt.size, tt.size, n)
+			}
+		case <-time.After(time.Second):
+			if tt.mirrored {
+				t.Errorf("size %d: want mirrored", tt.size)
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const prewarmTimeout = 10 * time.Second
+
+// prewarm opens the route's configured number of connections to each of its
+// destination servers ahead of client requests. The connections are opened
+// by sending concurrent "OPTIONS *" requests, which any HTTP server can
+// answer without involving its application, and are left idle in the
+// transport's pool for later requests.
+func (r *route) prewarm() {
+	if r.prewarmConns == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), prewarmTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, b := range r.backends {
+		wg.Add(1)
+		go func(target url.URL) {
+			defer wg.Done()
+			r.prewarmBackend(ctx, target)
+		}(b.target)
+	}
+	wg.Wait()
+}
+
+// prewarmBackend opens the route's configured number of connections to the
+// destination server at target.
+func (r *route) prewarmBackend(ctx context.Context, target url.URL) {
+	u := &url.URL{Scheme: target.Scheme, Host: target.Host, Opaque: "*"}
+	var wg sync.WaitGroup
+	for i := 0; i < r.prewarmConns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, "OPTIONS", u.String(), nil)
+			if err != nil {
+				panic(err) // the URL is well-formed
+			}
+			req.URL = u
+			rsp, err := r.transport.RoundTrip(req)
+			if err != nil {
+				log.Printf("prewarm connection to %s: %s", target.Host, err)
+				return
+			}
+			io.Copy(io.Discard, rsp.Body)
+			rsp.Body.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+// prewarmAll prewarms the connections of all the routes concurrently.
+func prewarmAll(routes map[string]*route) {
+	for _, r := range routes {
+		go r.prewarm()
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPrewarm(t *testing.T) {
+	var conns, requests atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, PrewarmConnections: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes["foo.com"].prewarm()
+
+	if got := conns.Load(); got != 3 {
+		t.Errorf("connections after prewarm: want 3, got %d", got)
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("want prewarm not to reach the handler, got %d requests", got)
+	}
+
+	h := httpsHandler(newRouteTable(routes), options{})
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://foo.com/", nil))
+	}
+	if got := conns.Load(); got != 3 {
+		t.Errorf("connections after requests: want 3 (reused), got %d", got)
+	}
+}
+
+func TestPrewarmBackends(t *testing.T) {
+	var conns [2]atomic.Int32
+	var urls []string
+	for i := range conns {
+		n := &conns[i]
+		backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				n.Add(1)
+			}
+		}
+		backend.Start()
+		defer backend.Close()
+		urls = append(urls, backend.URL)
+	}
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {URLs: urls, PrewarmConnections: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes["foo.com"].prewarm()
+
+	for i := range conns {
+		if got := conns[i].Load(); got != 2 {
+			t.Errorf("backend %d: connections after prewarm: want 2, got %d", i, got)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// maxPushes is the largest number of resources pushed with a response.
+const maxPushes = 16
+
+// pushHeaders are the request headers copied to pushed requests, so that
+// they are proxied like the client's own request would be.
+var pushHeaders = []string{"Accept-Encoding", "Accept-Language", "Authorization", "Cookie", "User-Agent"}
+
+// pushWriter pushes the resources that a 2xx response to a GET request
+// preloads with Link headers to HTTP/2 clients, before the response is
+// written. Links with the nopush parameter, and to other origins, aren't
+// pushed.
+type pushWriter struct {
+	http.ResponseWriter
+	pusher http.Pusher
+	req    *http.Request
+	done   bool
+}
+
+// newPushWriter returns w wrapped in a pushWriter for the request, or w if
+// the connection doesn't support push.
+func newPushWriter(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if r.Method != "GET" || r.ProtoMajor != 2 {
+		return w
+	}
+	p := findPusher(w)
+	if p == nil {
+		return w
+	}
+	return &pushWriter{ResponseWriter: w, pusher: p, req: r}
+}
+
+// findPusher returns the http.Pusher that w is, or wraps, if any.
+func findPusher(w http.ResponseWriter) http.Pusher {
+	for {
+		if p, ok := w.(http.Pusher); ok {
+			return p
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+}
+
+func (w *pushWriter) WriteHeader(code int) {
+	if !w.done && code >= 200 {
+		w.done = true
+		if code/100 == 2 {
+			w.push()
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *pushWriter) Write(p []byte) (int, error) {
+	if !w.done {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *pushWriter) push() {
+	targets := preloadLinks(w.Header().Values("Link"))
+	if len(targets) == 0 {
+		return
+	}
+	opts := &http.PushOptions{Header: make(http.Header)}
+	for _, k := range pushHeaders {
+		if v := w.req.Header.Values(k); len(v) > 0 {
+			opts.Header[k] = v
+		}
+	}
+	for i, t := range targets {
+		if i == maxPushes {
+			break
+		}
+		// the client may have disabled push, or already have the
+		// resource; either way, the links still preload it.
+		if err := w.pusher.Push(t, opts); err != nil {
+			return
+		}
+	}
+}
+
+func (w *pushWriter) Flush() {
+	if !w.done {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap supports http.ResponseController.
+func (w *pushWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// preloadLinks returns the same-origin paths that Link header values
+// preload, without those marked nopush.
+func preloadLinks(values []string) []string {
+	var paths []string
+	for _, v := range values {
+		for v != "" {
+			start := strings.IndexByte(v, '<')
+			end := strings.IndexByte(v, '>')
+			if start < 0 || end < start {
+				break
+			}
+			target := v[start+1 : end]
+			params := v[end+1:]
+			// the parameters end at the next link.
+			if i := strings.IndexByte(params, ','); i >= 0 {
+				params, v = params[:i], params[i+1:]
+			} else {
+				v = ""
+			}
+			var preload, nopush bool
+			for _, p := range strings.Split(params, ";") {
+				k, val, _ := strings.Cut(strings.TrimSpace(p), "=")
+				switch strings.ToLower(strings.TrimSpace(k)) {
+				case "rel":
+					for _, rel := range strings.Fields(strings.Trim(val, `"`)) {
+						if strings.EqualFold(rel, "preload") {
+							preload = true
+						}
+					}
+				case "nopush":
+					nopush = true
+				}
+			}
+			if preload && !nopush && strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") {
+				paths = append(paths, target)
+			}
+		}
+	}
+	return paths
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// pushRecorder is a ResponseRecorder that records pushes.
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+	header http.Header // of the first push
+}
+
+func (w *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	if w.pushed == nil {
+		w.header = opts.Header
+	}
+	w.pushed = append(w.pushed, target)
+	return nil
+}
+
+func TestPush(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", `</a.css>; rel=preload; as=style, </b.js>; rel="preload"; as=script`)
+		w.Header().Add("Link", `</c.js>; rel=preload; nopush, <https://cdn.com/d.js>; rel=preload, </e>; rel=next`)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{
+		"push.com":   {URL: backend.URL, Push: true},
+		"nopush.com": {URL: backend.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := newRouteTable(routes)
+
+	testcases := []struct {
+		name        string
+		url         string
+		http1       bool
+		disablePush bool
+		want        []string
+	}{
+		{"push", "https://push.com/", false, false, []string{"/a.css", "/b.js"}},
+		{"not enabled", "https://nopush.com/", false, false, nil},
+		{"disabled", "https://push.com/", false, true, nil},
+		{"HTTP/1.1", "https://push.com/", true, false, nil},
+		{"error", "https://push.com/missing", false, false, nil},
+	}
+	for _, tc := range testcases {
+		h := httpsHandler(table, options{disablePush: tc.disablePush})
+		r := httptest.NewRequest("GET", tc.url, nil)
+		if !tc.http1 {
+			r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+		}
+		r.Header.Set("Cookie", "a=b")
+		w := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		h.ServeHTTP(w, r)
+		if !reflect.DeepEqual(w.pushed, tc.want) {
+			t.Errorf("%s: want pushed %q, got %q", tc.name, tc.want, w.pushed)
+		}
+		if w.pushed != nil && w.header.Get("Cookie") != "a=b" {
+			t.Errorf("%s: want the cookie in pushed requests", tc.name)
+		}
+	}
+}
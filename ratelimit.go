@@ -0,0 +1,112 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit limits the rate of requests from each client IP address.
+type RateLimit struct {
+	// RequestsPerSecond is the sustained rate allowed per client. Zero
+	// means no limit.
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	// Burst is the number of requests a client may make at once. Zero
+	// means RequestsPerSecond, rounded up.
+	Burst int `json:"burst"`
+	// MaxClients is the number of clients tracked. The least recently
+	// seen client is forgotten to make room for a new one. Zero means
+	// 10000.
+	MaxClients int `json:"maxClients"`
+}
+
+const defaultRateLimitMaxClients = 10000
+
+// clientLimiter is a token bucket for each client, kept for the most
+// recently seen clients, so that spoofed or many source addresses can't
+// grow it without bound.
+type clientLimiter struct {
+	limit rate.Limit
+	burst int
+	max   int
+
+	mu      sync.Mutex
+	clients map[string]*list.Element // values are *clientLimit
+	lru     list.List                // most recently seen first
+}
+
+type clientLimit struct {
+	ip      string
+	limiter *rate.Limiter
+}
+
+func newClientLimiter(c RateLimit) (*clientLimiter, error) {
+	if c.RequestsPerSecond < 0 || c.Burst < 0 || c.MaxClients < 0 {
+		return nil, errors.New("rateLimit values must not be negative")
+	}
+	if c.RequestsPerSecond == 0 {
+		return nil, nil
+	}
+	l := &clientLimiter{
+		limit:   rate.Limit(c.RequestsPerSecond),
+		burst:   c.Burst,
+		max:     c.MaxClients,
+		clients: make(map[string]*list.Element),
+	}
+	if l.burst == 0 {
+		l.burst = int(math.Ceil(c.RequestsPerSecond))
+	}
+	if l.max == 0 {
+		l.max = defaultRateLimitMaxClients
+	}
+	return l, nil
+}
+
+// reserve takes a token for a request from ip at now. If none is
+// available, it returns false and how long until one is.
+func (l *clientLimiter) reserve(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var lim *rate.Limiter
+	if e, ok := l.clients[ip]; ok {
+		l.lru.MoveToFront(e)
+		lim = e.Value.(*clientLimit).limiter
+	} else {
+		if l.lru.Len() >= l.max {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.clients, oldest.Value.(*clientLimit).ip)
+		}
+		lim = rate.NewLimiter(l.limit, l.burst)
+		l.clients[ip] = l.lru.PushFront(&clientLimit{ip: ip, limiter: lim})
+	}
+
+	r := lim.ReserveN(now, 1)
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return false, d
+	}
+	return true, 0
+}
+
+// limitRate responds with a 429 and returns true if the request's client
+// is over Conf.RateLimit.
+func (o options) limitRate(w http.ResponseWriter, r *http.Request) bool {
+	if o.rateLimiter == nil {
+		return false
+	}
+	ok, wait := o.rateLimiter.reserve(o.clientIP(r), time.Now())
+	if ok {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	o.httpError(w, r, http.StatusTooManyRequests)
+	return true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientLimiter(t *testing.T) {
+	l, err := newClientLimiter(RateLimit{RequestsPerSecond: 1, Burst: 2, MaxClients: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	for i, want := range []bool{true, true, false} {
+		if ok, _ := l.reserve("192.0.2.1", now); ok != want {
+			t.Errorf("request %d: want %v, got %v", i, want, ok)
+		}
+	}
+	if _, wait := l.reserve("192.0.2.1", now); wait != time.Second {
+		t.Errorf("wait: want 1s, got %s", wait)
+	}
+	if ok, _ := l.reserve("192.0.2.1", now.Add(time.Second)); !ok {
+		t.Error("after a second: want allowed")
+	}
+
+	// other clients have their own buckets; the least recently seen is
+	// forgotten.
+	l.reserve("192.0.2.2", now)
+	l.reserve("192.0.2.3", now)
+	if len(l.clients) != 2 || l.clients["192.0.2.1"] != nil {
+		t.Errorf("want 192.0.2.1 forgotten, got %d clients", len(l.clients))
+	}
+
+	if l, err := newClientLimiter(RateLimit{}); l != nil || err != nil {
+		t.Errorf("zero rate: want no limiter, got %v, %v", l, err)
+	}
+	if _, err := newClientLimiter(RateLimit{RequestsPerSecond: -1}); err == nil {
+		t.Error("negative rate: want error")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	o, err := newOptions(Conf{
+		RateLimit:      RateLimit{RequestsPerSecond: 0.5},
+		TrustedProxies: []string{"10.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := mustRoutes(map[string]string{"foo.com": backend.URL})
+	h := httpsHandler(table, o)
+
+	testcases := []struct {
+		remoteAddr string
+		forwarded  string
+		want       int
+	}{
+		{"192.0.2.1:1234", "", 200},
+		{"192.0.2.1:5678", "", 429},
+		{"192.0.2.2:1234", "", 200},
+		// the forwarded address isn't trusted from other clients.
+		{"192.0.2.2:1234", "198.51.100.1", 429},
+		{"10.0.0.1:1234", "192.0.2.3, 198.51.100.1", 200},
+		{"10.0.0.1:1234", "198.51.100.1", 429},
+		{"10.0.0.1:1234", "198.51.100.2", 200},
+	}
+	for i, tc := range testcases {
+		r := httptest.NewRequest("GET", "https://foo.com/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("request %d: status code: want %d, got %d", i, tc.want, w.Code)
+		}
+		if tc.want == 429 && w.Header().Get("Retry-After") != "2" {
+			t.Errorf("request %d: Retry-After: want 2, got %q", i, w.Header().Get("Retry-After"))
+		}
+	}
+}
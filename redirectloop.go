@@ -0,0 +1,133 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redirectWindow is how long redirects of a client to a URL are counted
+// against Conf.MaxRedirects.
+const redirectWindow = 10 * time.Second
+
+// maxRedirectClients is the number of client and URL pairs whose redirects
+// are counted.
+const maxRedirectClients = 10000
+
+// redirectCounter counts the recent redirects of each client to each URL,
+// for the most recently redirected pairs, to detect loops that can't be
+// seen in a single request.
+type redirectCounter struct {
+	max int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // values are *redirectCount
+	lru     list.List                // most recently redirected first
+}
+
+type redirectCount struct {
+	key   string
+	start time.Time
+	n     int
+}
+
+func newRedirectCounter(max int) (*redirectCounter, error) {
+	if max < 0 {
+		return nil, errors.New("negative maxRedirects")
+	}
+	if max == 0 {
+		return nil, nil
+	}
+	return &redirectCounter{max: max, entries: make(map[string]*list.Element)}, nil
+}
+
+// add counts a redirect of ip to target at now, and reports whether it is
+// within max.
+func (c *redirectCounter) add(ip, target string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := ip + " " + target
+	var rc *redirectCount
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		rc = e.Value.(*redirectCount)
+		if now.Sub(rc.start) >= redirectWindow {
+			rc.start, rc.n = now, 0
+		}
+	} else {
+		if c.lru.Len() >= maxRedirectClients {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*redirectCount).key)
+		}
+		rc = &redirectCount{key: key, start: now}
+		c.entries[key] = c.lru.PushFront(rc)
+	}
+	rc.n++
+	return rc.n <= c.max
+}
+
+// redirect redirects the request to target with code, unless the redirect
+// would loop, in which case it responds with a 400 instead. A redirect
+// loops if target is the URL the client requested, such as when a proxy
+// in front of the HTTP server terminates TLS, or if the client has been
+// redirected to target more than Conf.MaxRedirects times recently.
+func (o options) redirect(w http.ResponseWriter, r *http.Request, target string, code int) {
+	var msg string
+	if sameURL(o.requestURL(r), target) {
+		msg = "the request would be redirected to itself, " + target
+	} else if o.redirects != nil && !o.redirects.add(o.clientIP(r), target, time.Now()) {
+		msg = "too many redirects to " + target
+	}
+	if msg != "" {
+		log.Printf("redirect loop for %s%s: %s", r.Host, r.URL.Path, msg)
+		o.httpErrorText(w, r, http.StatusBadRequest, "Redirect loop: "+msg)
+		return
+	}
+	http.Redirect(w, r, target, code)
+}
+
+// requestURL returns the URL the client requested. The scheme is https if
+// the request arrived over HTTPS, as decided by isHTTPS.
+func (o options) requestURL(r *http.Request) *url.URL {
+	u := &url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+	if o.isHTTPS(r) {
+		u.Scheme = "https"
+	}
+	return u
+}
+
+// sameURL reports whether u and the URL target are the same, ignoring
+// default ports and the case of the host.
+func sameURL(u *url.URL, target string) bool {
+	t, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, t.Scheme) &&
+		strings.EqualFold(withoutDefaultPort(u.Scheme, u.Host), withoutDefaultPort(t.Scheme, t.Host)) &&
+		u.RequestURI() == t.RequestURI()
+}
+
+// withoutDefaultPort returns host without the port if it is the default
+// one for scheme.
+func withoutDefaultPort(scheme, host string) string {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		if strings.Contains(h, ":") {
+			return "[" + h + "]"
+		}
+		return h
+	}
+	return host
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedirectLoop(t *testing.T) {
+	o, err := newOptions(Conf{MaxRedirects: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpHandler(mustRoutes(map[string]string{"foo.com": "http://localhost:8080"}), o)
+
+	get := func(target string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// X-Forwarded-Proto from an untrusted client doesn't make the
+	// request HTTPS.
+	if w := get("http://foo.com/a?b=c", http.Header{"X-Forwarded-Proto": {"https"}}); w.Code != http.StatusFound {
+		t.Errorf("untrusted X-Forwarded-Proto: want 302, got %d %q", w.Code, w.Body.String())
+	}
+
+	// a trusted proxy that terminates TLS forwards an HTTPS request to
+	// the HTTP server, which would redirect it to itself.
+	to, err := newOptions(Conf{TrustedProxies: []string{"192.0.2.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "http://foo.com/a?b=c", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	httpHandler(mustRoutes(map[string]string{"foo.com": "http://localhost:8080"}), to).ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "https://foo.com/a?b=c") {
+		t.Errorf("self redirect: want 400 naming the URL, got %d %q", w.Code, w.Body.String())
+	}
+
+	// the same client redirected to the same URL too often.
+	for i, want := range []int{http.StatusFound, http.StatusFound, http.StatusBadRequest} {
+		if w := get("http://foo.com/x", nil); w.Code != want {
+			t.Errorf("redirect %d: want %d, got %d", i, want, w.Code)
+		}
+	}
+	if w := get("http://foo.com/y", nil); w.Code != http.StatusFound {
+		t.Errorf("other URL: want 302, got %d", w.Code)
+	}
+
+	if _, err := newOptions(Conf{MaxRedirects: -1}); err == nil {
+		t.Error("negative maxRedirects: want error")
+	}
+}
+
+func TestRedirectCounter(t *testing.T) {
+	c, err := newRedirectCounter(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if !c.add("192.0.2.1", "https://foo.com/", now) {
+		t.Error("first: want allowed")
+	}
+	if c.add("192.0.2.1", "https://foo.com/", now.Add(time.Second)) {
+		t.Error("second: want loop")
+	}
+	if !c.add("192.0.2.2", "https://foo.com/", now.Add(time.Second)) {
+		t.Error("other client: want allowed")
+	}
+	if !c.add("192.0.2.1", "https://foo.com/", now.Add(redirectWindow+time.Second)) {
+		t.Error("after window: want allowed")
+	}
+	if c, err := newRedirectCounter(0); c != nil || err != nil {
+		t.Errorf("zero: want no counter, got %v, %v", c, err)
+	}
+}
+
+func TestSameURL(t *testing.T) {
+	testcases := []struct {
+		in, target string
+		want       bool
+	}{
+		{"https://foo.com/a?b", "https://foo.com/a?b", true},
+		{"https://FOO.com:443/a", "https://foo.com/a", true},
+		{"https://[::1]:443/", "https://[::1]/", true},
+		{"http://foo.com/a", "https://foo.com/a", false},
+		{"https://foo.com:8443/a", "https://foo.com/a", false},
+		{"https://foo.com/a", "https://foo.com/a?b", false},
+		{"https://foo.com/a", "https://www.foo.com/a", false},
+	}
+	for _, tc := range testcases {
+		u, err := url.Parse(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sameURL(u, tc.target); got != tc.want {
+			t.Errorf("%s, %s: want %v, got %v", tc.in, tc.target, tc.want, got)
+		}
+	}
+}
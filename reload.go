@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultConfigInterval = time.Minute
+
+// maxConfigSize limits the size of a config fetched from a URL.
+const maxConfigSize = 10 << 20
+
+var configClient = &http.Client{Timeout: 30 * time.Second}
+
+// runningConf is the running config, whose proxy map is replaced both on
+// SIGHUP and by the configPoller, and the table of the routes of its proxy
+// map.
+type runningConf struct {
+	table *routeTable
+
+	mu      sync.Mutex
+	conf    Conf                     // with the proxy map of the current routes
+	reloads map[string]reloadOutcome // by source
+}
+
+// reloadOutcome is the outcome of the last reload from a source, a config
+// file or URL.
+type reloadOutcome struct {
+	Source string    `json:"source"`
+	Time   time.Time `json:"time"`
+	OK     bool      `json:"ok"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func newRunningConf(c Conf, table *routeTable) *runningConf {
+	return &runningConf{table: table, conf: c, reloads: make(map[string]reloadOutcome)}
+}
+
+// recordReload records the outcome of a reload from source at now.
+func (rc *runningConf) recordReload(source string, err error, now time.Time) {
+	o := reloadOutcome{Source: source, Time: now, OK: err == nil}
+	if err != nil {
+		o.Error = err.Error()
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.reloads[source] = o
+}
+
+// lastReloads returns the outcomes of the last reload from each source,
+// sorted by source.
+func (rc *runningConf) lastReloads() []reloadOutcome {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	list := make([]reloadOutcome, 0, len(rc.reloads))
+	for _, o := range rc.reloads {
+		list = append(list, o)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Source < list[j].Source })
+	return list
+}
+
+// serveReloadStatus responds to a GET or HEAD request for the reload
+// status path, whatever its host, with the outcomes of the last reloads as
+// JSON: a 200 if none failed, or a 500 otherwise, so that deploys can tell
+// that a reload failed. It reports whether it responded.
+func (o options) serveReloadStatus(w http.ResponseWriter, r *http.Request) bool {
+	if o.reloadPath == "" || r.URL.Path != o.reloadPath || (r.Method != "GET" && r.Method != "HEAD") {
+		return false
+	}
+	var reloads []reloadOutcome
+	if o.reloads != nil {
+		reloads = o.reloads.lastReloads()
+	}
+	status := struct {
+		OK      bool            `json:"ok"`
+		Reloads []reloadOutcome `json:"reloads"`
+	}{true, reloads}
+	if status.Reloads == nil {
+		status.Reloads = []reloadOutcome{}
+	}
+	for _, o := range reloads {
+		status.OK = status.OK && o.OK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !status.OK {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(status)
+	return true
+}
+
+// replaceProxy replaces the proxy map of the running config, and the routes
+// in the table, with proxy, if it differs and is valid with the rest of the
+// running config. It reports whether it replaced them.
+func (rc *runningConf) replaceProxy(proxy map[string]Upstream) (bool, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if reflect.DeepEqual(proxy, rc.conf.Proxy) {
+		return false, nil // unchanged; keep the existing transports and their connections
+	}
+	next := rc.conf
+	next.Proxy = proxy
+	routes, err := checkedRoutes(next)
+	if err != nil {
+		return false, err
+	}
+	rc.table.replace(routes)
+	rc.conf = next
+	return true, nil
+}
+
+// differsBeyondProxy reports whether c differs from the running config
+// other than in its proxy map.
+func (rc *runningConf) differsBeyondProxy(c Conf) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	c.Proxy = rc.conf.Proxy
+	return !reflect.DeepEqual(c, rc.conf)
+}
+
+// configPoller replaces the proxy map of the running config with that of
+// the config at a URL.
+type configPoller struct {
+	url  string
+	conf *runningConf
+}
+
+// run polls the config every interval until ctx is done. A config that
+// can't be fetched or that is invalid is logged and otherwise ignored, so
+// the last good routes continue to be used.
+func (p *configPoller) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := p.poll(ctx); err != nil {
+			log.Printf("reload config from %s: %s", p.url, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// poll fetches the config once and, if its proxy map has changed, replaces
+// the routes. The outcome is recorded in the running config.
+func (p *configPoller) poll(ctx context.Context) (err error) {
+	defer func() { p.conf.recordReload(p.url, err, time.Now()) }()
+	c, err := fetchConf(ctx, p.url)
+	if err != nil {
+		return err
+	}
+	// only the proxy map is used, so it is checked against the rest of
+	// the running config.
+	replaced, err := p.conf.replaceProxy(c.Proxy)
+	if err != nil {
+		return err
+	}
+	if replaced {
+		log.Printf("reloaded proxy config from %s", p.url)
+	}
+	return nil
+}
+
+// reloadOnHangup replaces the proxy map of the running config with that of
+// the config file at path each time the program receives SIGHUP, until ctx
+// is done. An invalid config is logged and otherwise ignored.
+func reloadOnHangup(ctx context.Context, path string, rc *runningConf) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+		}
+		err := reloadFile(path, rc)
+		rc.recordReload(path, err, time.Now())
+		if err != nil {
+			log.Printf("reload config from %s: %s", path, err)
+			continue
+		}
+		log.Printf("reloaded proxy config from %s", path)
+	}
+}
+
+// reloadFile replaces the proxy map of the running config with that of the
+// config file at path, if the config is valid. Only the proxy map is used;
+// changes to the rest of the config need a restart, and are warned about.
+func reloadFile(path string, rc *runningConf) error {
+	c, err := parseConf(path)
+	if err != nil {
+		return fmt.Errorf("parse conf: %s", err)
+	}
+	if err := checkConf(c); err != nil {
+		return fmt.Errorf("check conf: %s", err)
+	}
+	if rc.differsBeyondProxy(c) {
+		log.Printf("warning: reload config from %s: only proxy is reloaded; other changes need a restart", path)
+	}
+	_, err = rc.replaceProxy(c.Proxy)
+	return err
+}
+
+// checkedRoutes returns the routes of the proxy map of c, if c passes the
+// checks of checkConf.
+func checkedRoutes(c Conf) (map[string]*route, error) {
+	if err := checkConf(c); err != nil {
+		return nil, fmt.Errorf("check conf: %s", err)
+	}
+	routes, err := newRoutes(c.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("check conf: %s", err)
+	}
+	return routes, nil
+}
+
+func fetchConf(ctx context.Context, url string) (Conf, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return Conf{}, err
+	}
+	rsp, err := configClient.Do(req)
+	if err != nil {
+		return Conf{}, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		return Conf{}, fmt.Errorf("status %s", rsp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, maxConfigSize))
+	if err != nil {
+		return Conf{}, err
+	}
+	var c Conf
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Conf{}, fmt.Errorf("parse conf: %s", err)
+	}
+	return c, nil
+}
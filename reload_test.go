@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCerts are certificates from files for configs that are checked.
+var testCerts = Certs{CertFile: filepath.Join("testdata", "cert.pem"), KeyFile: filepath.Join("testdata", "key.pem")}
+
+func TestConfigPoller(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	a := backend("a")
+	b := backend("b")
+
+	var mu sync.Mutex
+	var status int
+	var body string
+	set := func(s int, b string) {
+		mu.Lock()
+		defer mu.Unlock()
+		status, body = s, b
+	}
+	confServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer confServer.Close()
+
+	proxy := map[string]Upstream{"foo.com": {URL: a.URL}}
+	routes, err := newRoutes(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := newRouteTable(routes)
+	p := &configPoller{url: confServer.URL, conf: newRunningConf(Conf{Proxy: proxy, Certs: testCerts}, table)}
+	h := httpsHandler(table, options{})
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+		return w.Body.String()
+	}
+
+	set(200, `{"proxy": {"foo.com": "`+b.URL+`"}}`)
+	if err := p.poll(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := get(); got != "b" {
+		t.Errorf("after reload: want %q, got %q", "b", got)
+	}
+
+	for _, tt := range []struct {
+		status int
+		body   string
+	}{
+		{500, `{"proxy": {"foo.com": "` + a.URL + `"}}`},
+		{200, `{"proxy": `},
+		{200, `{"proxy": {"foo.com": "%"}}`},
+	} {
+		set(tt.status, tt.body)
+		if err := p.poll(context.Background()); err == nil {
+			t.Errorf("%d %s: want error, got nil", tt.status, tt.body)
+		}
+		if got := get(); got != "b" {
+			t.Errorf("%d %s: want last good config kept, got %q", tt.status, tt.body, got)
+		}
+	}
+
+	// the proxy map is checked against the rest of the running config,
+	// such as for hosts that certificates can't be obtained for.
+	p.conf.conf.Domains = []string{"foo.com"}
+	p.conf.conf.Certs = Certs{Auto: true, CertDir: t.TempDir()}
+	set(200, `{"proxy": {"foo.com": "`+a.URL+`", "bar.com": "`+a.URL+`"}}`)
+	if err := p.poll(context.Background()); err == nil {
+		t.Errorf("host not in domains: want error, got nil")
+	}
+	if got := get(); got != "b" {
+		t.Errorf("host not in domains: want last good config kept, got %q", got)
+	}
+	set(200, `{"proxy": {"foo.com": "`+a.URL+`"}}`)
+	if err := p.poll(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := get(); got != "a" {
+		t.Errorf("after reload: want %q, got %q", "a", got)
+	}
+}
+
+func TestConfigPollerClosesIdleConnections(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateClosed {
+			select {
+			case closed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	confServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"proxy": {}}`))
+	}))
+	defer confServer.Close()
+
+	proxy := map[string]Upstream{"foo.com": {URL: backend.URL}}
+	routes, err := newRoutes(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := newRouteTable(routes)
+	p := &configPoller{url: confServer.URL, conf: newRunningConf(Conf{Proxy: proxy, Certs: testCerts}, table)}
+
+	// leave an idle connection to the backend in the pool.
+	w := httptest.NewRecorder()
+	httpsHandler(table, options{}).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+	if w.Code != 200 {
+		t.Fatalf("status code: want 200, got %d", w.Code)
+	}
+
+	if err := p.poll(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("want idle connection closed after the host was removed")
+	}
+}
+
+func TestReloadFile(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	a := backend("a")
+	b := backend("b")
+
+	proxy := map[string]Upstream{"foo.com": {URL: a.URL}}
+	routes, err := newRoutes(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := newRouteTable(routes)
+	rc := newRunningConf(Conf{Proxy: proxy, Certs: testCerts}, table)
+	h := httpsHandler(table, options{})
+	get := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+		return w.Body.String()
+	}
+
+	path := filepath.Join(t.TempDir(), "conf.json")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const certs = `"certs": {"certFile": "testdata/cert.pem", "keyFile": "testdata/key.pem"}`
+
+	write(`{` + certs + `, "proxy": {"foo.com": "` + b.URL + `"}}`)
+	if err := reloadFile(path, rc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := get(); got != "b" {
+		t.Errorf("after reload: want %q, got %q", "b", got)
+	}
+
+	for _, s := range []string{
+		`{"proxy": `,
+		`{"proxy": {"foo.com": "` + a.URL + `"}}`, // fails checkConf
+		`{` + certs + `, "proxy": {"foo.com": "%"}}`,
+	} {
+		write(s)
+		if err := reloadFile(path, rc); err == nil {
+			t.Errorf("%s: want error, got nil", s)
+		}
+		if got := get(); got != "b" {
+			t.Errorf("%s: want last good config kept, got %q", s, got)
+		}
+	}
+}
+
+func TestReloadSharesRunningConf(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	a := backend("a")
+	b := backend("b")
+
+	proxy := map[string]Upstream{"foo.com": {URL: a.URL}}
+	routes, err := newRoutes(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := newRouteTable(routes)
+	rc := newRunningConf(Conf{Proxy: proxy, Certs: testCerts}, table)
+	get := func() string {
+		w := httptest.NewRecorder()
+		httpsHandler(table, options{}).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+		return w.Body.String()
+	}
+
+	confServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"proxy": {"foo.com": "` + a.URL + `"}}`))
+	}))
+	defer confServer.Close()
+	p := &configPoller{url: confServer.URL, conf: rc}
+
+	// after the file is reloaded, the poller's unchanged map differs from
+	// the running one, so it is applied.
+	path := filepath.Join(t.TempDir(), "conf.json")
+	if err := os.WriteFile(path, []byte(`{"certs": {"certFile": "testdata/cert.pem", "keyFile": "testdata/key.pem"}, "proxy": {"foo.com": "`+b.URL+`"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadFile(path, rc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := get(); got != "b" {
+		t.Errorf("after file reload: want %q, got %q", "b", got)
+	}
+	if err := p.poll(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := get(); got != "a" {
+		t.Errorf("after poll: want %q, got %q", "a", got)
+	}
+
+	// changes other than to the proxy map are warned about.
+	buf := captureLog(t)
+	if err := os.WriteFile(path, []byte(`{"certs": {"certFile": "testdata/cert.pem", "keyFile": "testdata/key.pem"}, "httpAddr": ":8080", "proxy": {"foo.com": "`+a.URL+`"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadFile(path, rc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(buf.String(), "other changes need a restart") {
+		t.Errorf("want a warning, got %q", buf.String())
+	}
+	if rc.conf.HTTPAddr != "" {
+		t.Errorf("want httpAddr not applied, got %q", rc.conf.HTTPAddr)
+	}
+}
+
+func TestReloadStatus(t *testing.T) {
+	var mu sync.Mutex
+	body := `{"proxy": {}}`
+	confServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write([]byte(body))
+	}))
+	defer confServer.Close()
+
+	table := newRouteTable(map[string]*route{})
+	rc := newRunningConf(Conf{Certs: testCerts}, table)
+	p := &configPoller{url: confServer.URL, conf: rc}
+	o, err := newOptions(Conf{ReloadStatusPath: "/reloadz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.reloads = rc
+	h := httpHandler(table, o)
+
+	type status struct {
+		OK      bool
+		Reloads []reloadOutcome
+	}
+	get := func() (int, status) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://any.org/reloadz", nil))
+		var s status
+		if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+			t.Fatalf("body %q: %s", w.Body.String(), err)
+		}
+		return w.Code, s
+	}
+
+	if code, s := get(); code != 200 || !s.OK || len(s.Reloads) != 0 {
+		t.Errorf("before any reload: want 200, ok, no reloads, got %d %+v", code, s)
+	}
+
+	mu.Lock()
+	body = `{"proxy": {"foo.com": "%"}}`
+	mu.Unlock()
+	before := time.Now()
+	if err := p.poll(context.Background()); err == nil {
+		t.Fatal("want error")
+	}
+	code, s := get()
+	if code != 500 || s.OK || len(s.Reloads) != 1 {
+		t.Fatalf("after failed reload: want 500, not ok, 1 reload, got %d %+v", code, s)
+	}
+	if r := s.Reloads[0]; r.Source != confServer.URL || r.OK || r.Error == "" || r.Time.Before(before) {
+		t.Errorf("after failed reload: got %+v", r)
+	}
+
+	mu.Lock()
+	body = `{"proxy": {}}`
+	mu.Unlock()
+	if err := p.poll(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if code, s := get(); code != 200 || !s.OK || len(s.Reloads) != 1 || !s.Reloads[0].OK {
+		t.Errorf("after good reload: want 200, ok, got %d %+v", code, s)
+	}
+
+	// reloads from each source are kept apart.
+	rc.recordReload("conf.json", errors.New("check conf: bad"), time.Now())
+	if code, s := get(); code != 500 || len(s.Reloads) != 2 || s.Reloads[0].Source != "conf.json" {
+		t.Errorf("after failed file reload: want 500 with both sources, got %d %+v", code, s)
+	}
+
+	for _, c := range []Conf{{ReloadStatusPath: "reloadz"}, {ReloadStatusPath: "/z", HealthPath: "/z"}} {
+		if _, err := newOptions(c); err == nil {
+			t.Errorf("%+v: want error", c)
+		}
+	}
+}
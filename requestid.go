@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID in ctx, or the empty string if
+// there is none.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// setRequestID returns r with a request ID in its context, if
+// Conf.RequestIDHeader is set: the request's own ID in the header, if it is
+// valid, or else a new one. A request that already has an ID is returned
+// unchanged.
+func (o options) setRequestID(r *http.Request) *http.Request {
+	if o.requestIDHeader == "" || requestIDFrom(r.Context()) != "" {
+		return r
+	}
+	id := r.Header.Get(o.requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	return r.WithContext(withRequestID(r.Context(), id))
+}
+
+// requestIDHandler returns a handler that serves requests using h, with a
+// request ID set by setRequestID.
+func (o options) requestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, o.setRequestID(r))
+	})
+}
+
+// echoRequestID sets the ID of the request with ctx, if any, in the
+// response header h. Only error responses and responses from destination
+// servers have it.
+func (o options) echoRequestID(h http.Header, ctx context.Context) {
+	if id := requestIDFrom(ctx); id != "" {
+		h.Set(o.requestIDHeader, id)
+	}
+}
+
+// logRequestID returns the request ID in ctx in a form to add to log
+// lines, such as " (request 4bf92f35...)", or the empty string if there is
+// none.
+func logRequestID(ctx context.Context) string {
+	if id := requestIDFrom(ctx); id != "" {
+		return " (request " + id + ")"
+	}
+	return ""
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether id, from a client, is used as is: up to
+// 128 letters, digits, and "-", "_", ".", or ":".
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// writeJSONError responds with a JSON body with the status text and the
+// request ID, if any, such as
+//
+//	{"error":"Bad Gateway","requestId":"4bf92f3577b34da6a3ce929d0e0e4736"}
+func writeJSONError(w http.ResponseWriter, r *http.Request, code int) {
+	b, err := json.Marshal(struct {
+		Error     string `json:"error"`
+		RequestID string `json:"requestId,omitempty"`
+	}{http.StatusText(code), requestIDFrom(r.Context())})
+	if err != nil {
+		panic(err) // all fields are marshalable
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(append(b, '\n'))
+}
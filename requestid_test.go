@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Got-Id", r.Header.Get("X-Request-Id"))
+		// an echoed ID isn't duplicated.
+		w.Header().Set("X-Request-Id", r.Header.Get("X-Request-Id"))
+	}))
+	defer backend.Close()
+
+	o, err := newOptions(Conf{RequestIDHeader: "x-request-id", ErrorFormat: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := mustRoutes(map[string]string{
+		"foo.com": backend.URL,
+		"bar.com": "http://127.0.0.1:1", // nothing listens
+	})
+	h := httpsHandler(table, o)
+
+	t.Run("proxied", func(t *testing.T) {
+		for _, tc := range []struct {
+			sent string
+			keep bool
+		}{
+			{"", false},
+			{"abc-123_x.y:z", true},
+			{"bad id", false},
+		} {
+			r := httptest.NewRequest("GET", "https://foo.com/", nil)
+			if tc.sent != "" {
+				r.Header.Set("X-Request-Id", tc.sent)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			ids := w.Header().Values("X-Request-Id")
+			if len(ids) != 1 {
+				t.Fatalf("sent %q: response IDs: want 1, got %q", tc.sent, ids)
+			}
+			if got := w.Header().Get("Got-Id"); got != ids[0] {
+				t.Errorf("sent %q: backend got %q, response has %q", tc.sent, got, ids[0])
+			}
+			if tc.keep && ids[0] != tc.sent {
+				t.Errorf("sent %q: want kept, got %q", tc.sent, ids[0])
+			}
+			if !tc.keep && (ids[0] == tc.sent || len(ids[0]) != 32) {
+				t.Errorf("sent %q: want generated, got %q", tc.sent, ids[0])
+			}
+		}
+	})
+
+	for name, host := range map[string]string{"proxy error": "bar.com", "unknown host": "baz.com"} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://"+host+"/", nil)
+			r.Header.Set("X-Request-Id", "abc")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != 502 {
+				t.Errorf("status code: want 502, got %d", w.Code)
+			}
+			if got := w.Header().Get("X-Request-Id"); got != "abc" {
+				t.Errorf("response ID: want abc, got %q", got)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("content type: want application/json, got %q", got)
+			}
+			var body struct{ Error, RequestID string }
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error != "Bad Gateway" || body.RequestID != "abc" {
+				t.Errorf("body: got %s", w.Body.Bytes())
+			}
+		})
+	}
+}
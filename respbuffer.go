@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// ResponseBuffer makes responses be read completely from the destination
+// server before they are sent to the client, so that slow clients don't
+// hold up the destination server.
+type ResponseBuffer struct {
+	// Threshold is the size of the largest body kept in memory. Larger
+	// bodies are written to a temporary file. Zero means 1 MB.
+	Threshold int64 `json:"threshold"`
+	// Dir is the directory for the temporary files. The empty string
+	// means the system's temporary directory.
+	Dir string `json:"dir"`
+}
+
+const defaultResponseBufferThreshold = 1 << 20
+
+// responseBuffer is the ready-to-use form of a ResponseBuffer.
+type responseBuffer struct {
+	threshold int64
+	dir       string
+}
+
+func newResponseBuffer(c *ResponseBuffer) (*responseBuffer, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.Threshold < 0 {
+		return nil, errors.New("negative responseBuffer.threshold")
+	}
+	b := &responseBuffer{threshold: c.Threshold, dir: c.Dir}
+	if b.threshold == 0 {
+		b.threshold = defaultResponseBufferThreshold
+	}
+	if b.dir != "" {
+		fi, err := os.Stat(b.dir)
+		if err != nil {
+			return nil, fmt.Errorf("responseBuffer.dir: %s", err)
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("responseBuffer.dir %s is not a directory", b.dir)
+		}
+	}
+	return b, nil
+}
+
+// buffer reads the body of rsp completely, into memory if it is at most
+// threshold bytes, or else into a temporary file that is removed when the
+// body is closed. The body is then sent with a Content-Length, unless it
+// has trailers. Event streams, which don't end, are left unchanged.
+func (b *responseBuffer) buffer(rsp *http.Response) error {
+	if rsp.Body == nil || rsp.Body == http.NoBody || rsp.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(rsp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return nil
+	}
+
+	head, err := io.ReadAll(io.LimitReader(rsp.Body, b.threshold+1))
+	if err != nil {
+		rsp.Body.Close()
+		return err
+	}
+	if int64(len(head)) <= b.threshold {
+		rsp.Body.Close()
+		rsp.Body = io.NopCloser(bytes.NewReader(head))
+		setBufferedLength(rsp, int64(len(head)))
+		return nil
+	}
+
+	f, err := os.CreateTemp(b.dir, "httpserver-response-")
+	if err != nil {
+		rsp.Body.Close()
+		return err
+	}
+	body := &tempFileBody{f}
+	if _, err := f.Write(head); err != nil {
+		rsp.Body.Close()
+		body.Close()
+		return err
+	}
+	n, err := io.Copy(f, rsp.Body)
+	rsp.Body.Close()
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		body.Close()
+		return err
+	}
+	rsp.Body = body
+	setBufferedLength(rsp, int64(len(head))+n)
+	return nil
+}
+
+// setBufferedLength sets the length of a buffered response body. Trailers
+// need the body to be chunked, so responses with trailers are unchanged.
+func setBufferedLength(rsp *http.Response, n int64) {
+	if len(rsp.Trailer) > 0 {
+		return
+	}
+	rsp.ContentLength = n
+	rsp.TransferEncoding = nil
+	rsp.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+}
+
+// tempFileBody is a body read from a temporary file, which is removed on
+// Close.
+type tempFileBody struct {
+	*os.File
+}
+
+func (b *tempFileBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.Name())
+	return err
+}
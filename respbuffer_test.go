@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestResponseBuffer(t *testing.T) {
+	dir := t.TempDir()
+	b, err := newResponseBuffer(&ResponseBuffer{Threshold: 10, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := func() int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	for _, body := range []string{"small", "larger than the threshold"} {
+		rsp := &http.Response{
+			StatusCode:    200,
+			Header:        http.Header{},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: -1,
+		}
+		if err := b.buffer(rsp); err != nil {
+			t.Fatal(err)
+		}
+		wantFiles := 0
+		if len(body) > 10 {
+			wantFiles = 1
+		}
+		if n := files(); n != wantFiles {
+			t.Errorf("%q: files: want %d, got %d", body, wantFiles, n)
+		}
+		got, err := io.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if string(got) != body {
+			t.Errorf("body: want %q, got %q", body, got)
+		}
+		if rsp.ContentLength != int64(len(body)) {
+			t.Errorf("%q: content length: want %d, got %d", body, len(body), rsp.ContentLength)
+		}
+		if n := files(); n != 0 {
+			t.Errorf("%q: files after close: want 0, got %d", body, n)
+		}
+	}
+}
+
+func TestResponseBufferLarge(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) // 1 MiB
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// streamed, without a Content-Length.
+		for b := large; len(b) > 0; b = b[4096:] {
+			w.Write(b[:4096])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	routes, err := newRoutes(map[string]Upstream{
+		"foo.com": {URL: backend.URL, ResponseBuffer: &ResponseBuffer{Threshold: 64 << 10, Dir: dir}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(httpsHandler(newRouteTable(routes), options{}))
+	defer s.Close()
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	req.Host = "foo.com"
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.ContentLength != int64(len(large)) {
+		t.Errorf("content length: want %d, got %d", len(large), rsp.ContentLength)
+	}
+	got, err := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, large) {
+		t.Errorf("body: want %d bytes, got %d different bytes", len(large), len(got))
+	}
+
+	s.Close() // wait for the handler to finish
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temporary files left: %d", len(entries))
+	}
+
+	if _, err := newRoutes(map[string]Upstream{
+		"foo.com": {URL: backend.URL, ResponseBuffer: &ResponseBuffer{Dir: dir + "/missing"}},
+	}); err == nil {
+		t.Error("missing dir: want error")
+	}
+}
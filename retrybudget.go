@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// RetryBudget limits failover retries to a fraction of requests, so that
+// retries don't multiply the load on destination servers that are already
+// struggling.
+type RetryBudget struct {
+	// Ratio is the number of retries allowed per request, such as 0.1 to
+	// allow retries for 10% of requests.
+	Ratio float64 `json:"ratio"`
+	// Burst is the number of retries allowed on top of Ratio, such as
+	// after a quiet period. Zero means 10.
+	Burst int `json:"burst"`
+}
+
+const defaultRetryBurst = 10
+
+// retryBudget is a token bucket: each request adds ratio tokens, up to
+// max, and each retry takes one.
+type retryBudget struct {
+	ratio float64
+	max   float64
+
+	mu        sync.Mutex
+	tokens    float64
+	exhausted bool // the last check found no tokens
+}
+
+func newRetryBudget(c *RetryBudget) (*retryBudget, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.Ratio <= 0 || c.Ratio > 1 {
+		return nil, errors.New("retryBudget.ratio must be in (0, 1]")
+	}
+	if c.Burst < 0 {
+		return nil, errors.New("negative retryBudget.burst")
+	}
+	max := float64(c.Burst)
+	if c.Burst == 0 {
+		max = defaultRetryBurst
+	}
+	return &retryBudget{ratio: c.Ratio, max: max, tokens: max}, nil
+}
+
+// deposit adds the tokens for a request.
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+	b.mu.Unlock()
+}
+
+// allow reports whether a retry is within the budget. The token is taken
+// by spend, once the retry is needed; concurrent requests may overdraw the
+// budget slightly in between. The second result reports whether the budget
+// has just become exhausted.
+func (b *retryBudget) allow() (ok, exhausted bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ok = b.tokens >= 1
+	exhausted = !ok && !b.exhausted
+	b.exhausted = !ok
+	return ok, exhausted
+}
+
+// spend takes the token for a retry.
+func (b *retryBudget) spend() {
+	b.mu.Lock()
+	b.tokens--
+	b.mu.Unlock()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRetryBudget(t *testing.T) {
+	var primaryHits int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits++
+		w.WriteHeader(503)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer secondary.Close()
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {
+		URL:           primary.URL,
+		Failover:      []string{secondary.URL},
+		RetryOnStatus: []int{503},
+		RetryBudget:   &RetryBudget{Ratio: 0.25, Burst: 2},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+	serve := func() int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+		return w.Code
+	}
+
+	// the burst allows the first two retries; the third request's
+	// deposit isn't enough for another.
+	for i, want := range []int{200, 200, 503} {
+		if got := serve(); got != want {
+			t.Errorf("request %d: status code: want %d, got %d", i, want, got)
+		}
+	}
+	// each request earns a quarter of a retry, and half is left over.
+	for i, want := range []int{503, 200, 503, 503} {
+		if got := serve(); got != want {
+			t.Errorf("request %d: status code: want %d, got %d", i+3, want, got)
+		}
+	}
+	if primaryHits != 7 {
+		t.Errorf("primary hits: want 7, got %d", primaryHits)
+	}
+
+	for _, c := range []*RetryBudget{{Ratio: 0}, {Ratio: 1.5}, {Ratio: 0.1, Burst: -1}} {
+		if _, err := newRetryBudget(c); err == nil {
+			t.Errorf("%+v: want error", *c)
+		}
+	}
+	if _, err := newRoutes(map[string]Upstream{"foo.com": {URL: primary.URL, RetryBudget: &RetryBudget{Ratio: 0.1}}}); err == nil {
+		t.Errorf("want error for retryBudget without failover")
+	}
+}
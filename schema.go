@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// maxSchemaBodySize limits the size of a request body that is buffered to
+// be validated against a JSON schema.
+const maxSchemaBodySize = 10 << 20
+
+// isJSON reports whether the media type of a Content-Type header value is
+// JSON, such as application/json or application/problem+json.
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "application/json" || (strings.HasPrefix(mt, "application/") && strings.HasSuffix(mt, "+json"))
+}
+
+// validateBody validates a JSON request body against schema. It responds
+// with a 422 (or 400, 413 when the body can't be read) and returns false if
+// the body isn't valid. Otherwise the request body is replaced with the
+// buffered body. Requests without a JSON body are left as is.
+func (o options) validateBody(w http.ResponseWriter, r *http.Request, schema *jsonschema.Schema) bool {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 || !isJSON(r.Header.Get("Content-Type")) {
+		return true
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxSchemaBodySize+1))
+	r.Body.Close()
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		// a decompressed body.
+		o.tooLarge(w, r)
+		return false
+	}
+	if err != nil {
+		o.httpError(w, r, http.StatusBadRequest)
+		return false
+	}
+	if len(b) > maxSchemaBodySize {
+		o.httpError(w, r, http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		o.validationError(w, r, []jsonschema.BasicError{{Error: "invalid JSON: " + err.Error()}})
+		return false
+	}
+	if err := schema.Validate(v); err != nil {
+		var ve *jsonschema.ValidationError
+		if !errors.As(err, &ve) {
+			o.httpError(w, r, http.StatusInternalServerError)
+			return false
+		}
+		o.validationError(w, r, ve.BasicOutput().Errors)
+		return false
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+	r.TransferEncoding = nil
+	return true
+}
+
+// validationError responds with a 422 whose JSON body lists errs, along with
+// the request ID like the body of writeJSONError, or with the error page for
+// 422 if there is one.
+func (o options) validationError(w http.ResponseWriter, r *http.Request, errs []jsonschema.BasicError) {
+	if _, ok := o.errorPages[http.StatusUnprocessableEntity]; ok {
+		o.httpError(w, r, http.StatusUnprocessableEntity)
+		return
+	}
+	o.echoRequestID(w.Header(), r.Context())
+	b, err := json.Marshal(struct {
+		Error     string                  `json:"error"`
+		RequestID string                  `json:"requestId,omitempty"`
+		Errors    []jsonschema.BasicError `json:"errors"`
+	}{http.StatusText(http.StatusUnprocessableEntity), requestIDFrom(r.Context()), errs})
+	if err != nil {
+		panic(err) // all fields are marshalable
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	w.Write(append(b, '\n'))
+}
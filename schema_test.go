@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestJSONSchema(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Length", strconv.FormatInt(r.ContentLength, 10))
+		io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+
+	schema := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(schema, []byte(`{
+		"type": "object",
+		"properties": {"name": {"type": "string"}},
+		"required": ["name"]
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := newRoutes(map[string]Upstream{"api.foo.com": {URL: backend.URL, JSONSchema: schema}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+
+	testcases := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"valid", "application/json", `{"name": "gopher"}`, 200},
+		{"missing property", "application/json", `{}`, 422},
+		{"wrong type", "application/json; charset=utf-8", `{"name": 1}`, 422},
+		{"not JSON", "application/json", `{"name":`, 422},
+		{"other content type", "text/plain", `{}`, 200},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "https://api.foo.com/", strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", tc.contentType)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Fatalf("status code: want %d, got %d", tc.want, w.Code)
+			}
+			if w.Code == 200 {
+				// the validated body is forwarded.
+				if w.Body.String() != tc.body {
+					t.Errorf("body: want %q, got %q", tc.body, w.Body.String())
+				}
+				return
+			}
+			var rsp struct {
+				Errors []struct {
+					Error string `json:"error"`
+				} `json:"errors"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatalf("unmarshal response: %s", err)
+			}
+			if len(rsp.Errors) == 0 {
+				t.Errorf("want validation errors, got none")
+			}
+		})
+	}
+
+	// a chunked body is forwarded with its length once buffered.
+	r := httptest.NewRequest("POST", "https://api.foo.com/", strings.NewReader(`{"name": "gopher"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.ContentLength = -1
+	r.TransferEncoding = []string{"chunked"}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("X-Content-Length"); got != "18" {
+		t.Errorf("chunked: Content-Length: want 18, got %q", got)
+	}
+
+	// the errors have the request ID, or the error page is served instead.
+	page := filepath.Join(t.TempDir(), "422.html")
+	if err := os.WriteFile(page, []byte("<p>invalid</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Conf{{RequestIDHeader: "X-Request-Id"}, {RequestIDHeader: "X-Request-Id", ErrorPages: map[string]string{"422": page}}} {
+		o, err := newOptions(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "https://api.foo.com/", strings.NewReader(`{}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Request-Id", "abc")
+		w := httptest.NewRecorder()
+		httpsHandler(newRouteTable(routes), o).ServeHTTP(w, r)
+		if w.Code != 422 {
+			t.Errorf("%v: status code: want 422, got %d", c.ErrorPages, w.Code)
+		}
+		if got := w.Header().Get("X-Request-Id"); got != "abc" {
+			t.Errorf("%v: X-Request-Id: want abc, got %q", c.ErrorPages, got)
+		}
+		body := w.Body.String()
+		if c.ErrorPages == nil && (!strings.Contains(body, `"requestId":"abc"`) || !strings.Contains(body, `"errors":[`)) {
+			t.Errorf("want the errors with the request ID, got %s", body)
+		}
+		if c.ErrorPages != nil && body != "<p>invalid</p>" {
+			t.Errorf("want the error page, got %s", body)
+		}
+	}
+
+	if _, err := newRoutes(map[string]Upstream{"api.foo.com": {URL: backend.URL, JSONSchema: filepath.Join(t.TempDir(), "missing.json")}}); err == nil {
+		t.Errorf("want error for missing schema, got nil")
+	}
+}
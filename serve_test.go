@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServeAll(t *testing.T) {
+	// a port that is already in use.
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	cantBind := func() error {
+		return (&http.Server{Addr: taken.Addr().String()}).ListenAndServe()
+	}
+
+	// newServer returns a server that serves until stop is called.
+	newServer := func(t *testing.T) (serve func() error, addr string, stop func()) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+		return func() error { return s.Serve(l) }, l.Addr().String(), func() { s.Close() }
+	}
+
+	t.Run("fail fast", func(t *testing.T) {
+		serve, _, stop := newServer(t)
+		defer stop()
+
+		done := make(chan error, 1)
+		go func() { done <- serveAll(true, cantBind, serve) }()
+		select {
+		case err := <-done:
+			var opErr *net.OpError
+			if !errors.As(err, &opErr) || opErr.Op != "listen" {
+				t.Errorf("want listen error, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("want serveAll to return after a server failed")
+		}
+	})
+
+	t.Run("keep serving", func(t *testing.T) {
+		serve, addr, stop := newServer(t)
+
+		done := make(chan error, 1)
+		go func() { done <- serveAll(false, cantBind, serve) }()
+
+		// the other server keeps serving.
+		time.Sleep(50 * time.Millisecond)
+		select {
+		case err := <-done:
+			t.Fatalf("want serveAll to keep running, returned %v", err)
+		default:
+		}
+		rsp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatalf("want surviving server to serve, got %s", err)
+		}
+		rsp.Body.Close()
+
+		stop()
+		select {
+		case err := <-done:
+			if !errors.Is(err, http.ErrServerClosed) {
+				t.Errorf("want %v, got %v", http.ErrServerClosed, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("want serveAll to return after all servers stopped")
+		}
+	})
+}
+
+func TestBindServers(t *testing.T) {
+	var order []string
+	defer func(orig func(string, string) (net.Listener, error)) { listen = orig }(listen)
+	listen = func(network, addr string) (net.Listener, error) {
+		order = append(order, addr)
+		return net.Listen(network, "127.0.0.1:0")
+	}
+
+	for _, tc := range []struct {
+		httpsFirst bool
+		want       []string
+	}{
+		{true, []string{":443", ":80"}},
+		{false, []string{":80", ":443"}},
+	} {
+		order = nil
+		httpL, httpsL, httpErr, httpsErr := bindServers(tc.httpsFirst, ":80", ":443")
+		if httpErr != nil || httpsErr != nil {
+			t.Fatal(httpErr, httpsErr)
+		}
+		httpL.Close()
+		httpsL.Close()
+		if !reflect.DeepEqual(order, tc.want) {
+			t.Errorf("httpsFirst %v: want %q, got %q", tc.httpsFirst, tc.want, order)
+		}
+	}
+
+	// a failure to bind one address doesn't keep the other from being
+	// bound.
+	listen = func(network, addr string) (net.Listener, error) {
+		if addr == ":443" {
+			return nil, errors.New("in use")
+		}
+		return net.Listen(network, "127.0.0.1:0")
+	}
+	httpL, _, httpErr, httpsErr := bindServers(true, ":80", ":443")
+	if httpErr != nil || httpsErr == nil {
+		t.Fatalf("want only the https error, got %v, %v", httpErr, httpsErr)
+	}
+	httpL.Close()
+}
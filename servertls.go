@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// TLS configures the TLS connections of the HTTPS server.
+type TLS struct {
+	// MinVersion is the minimum TLS version, "1.0", "1.1", "1.2", or
+	// "1.3". The empty string means Go's default of 1.2.
+	MinVersion string `json:"minVersion"`
+	// CipherSuites, if set, lists the names of the cipher suites, such as
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, allowed for TLS 1.0–1.2.
+	// Those of TLS 1.3 aren't configurable.
+	CipherSuites []string `json:"cipherSuites"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// configureTLS applies the settings in c to cfg, keeping its other
+// settings, such as those of an autocert.Manager.
+func configureTLS(cfg *tls.Config, c TLS) error {
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return fmt.Errorf("unknown tls.minVersion %q", c.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	if len(c.CipherSuites) == 0 {
+		return nil
+	}
+	if cfg.MinVersion == tls.VersionTLS13 {
+		return errors.New("tls.cipherSuites has no effect with tls.minVersion \"1.3\"")
+	}
+	byName := make(map[string]*tls.CipherSuite)
+	for _, s := range tls.CipherSuites() {
+		byName[s.Name] = s
+	}
+	suites := make([]uint16, 0, len(c.CipherSuites))
+	for _, name := range c.CipherSuites {
+		s, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("unknown or insecure cipher suite %q in tls.cipherSuites", name)
+		}
+		if !supportsPreTLS13(s) {
+			return fmt.Errorf("cipher suite %s in tls.cipherSuites is TLS 1.3 only and isn't configurable", name)
+		}
+		suites = append(suites, s.ID)
+	}
+	cfg.CipherSuites = suites
+	return nil
+}
+
+func supportsPreTLS13(s *tls.CipherSuite) bool {
+	for _, v := range s.SupportedVersions {
+		if v < tls.VersionTLS13 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestConfigureTLS(t *testing.T) {
+	// the settings are merged into the autocert config.
+	cfg := (&autocert.Manager{}).TLSConfig()
+	err := configureTLS(cfg, TLS{
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GetCertificate == nil || len(cfg.NextProtos) == 0 {
+		t.Error("want autocert settings kept")
+	}
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("MinVersion: want %x, got %x", tls.VersionTLS12, cfg.MinVersion)
+	}
+	if len(cfg.CipherSuites) != 2 || cfg.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("CipherSuites: got %x", cfg.CipherSuites)
+	}
+
+	for _, c := range []TLS{
+		{MinVersion: "1.4"},
+		{MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+		{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{CipherSuites: []string{"foo"}},
+	} {
+		if err := configureTLS(&tls.Config{}, c); err == nil {
+			t.Errorf("%+v: want error", c)
+		}
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.TLS = &tls.Config{}
+	if err := configureTLS(s.TLS, TLS{MinVersion: "1.3"}); err != nil {
+		t.Fatal(err)
+	}
+	s.StartTLS()
+	defer s.Close()
+
+	for _, tc := range []struct {
+		max  uint16
+		fail bool
+	}{
+		{tls.VersionTLS12, true},
+		{tls.VersionTLS13, false},
+	} {
+		client := s.Client()
+		client.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tc.max
+		rsp, err := client.Get(s.URL)
+		if err == nil {
+			rsp.Body.Close()
+		}
+		if (err != nil) != tc.fail {
+			t.Errorf("max version %x: want failure %v, got %v", tc.max, tc.fail, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedURL(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{
+		"dl.foo.com": {URL: backend.URL, SignedURL: &SignedURL{Secret: "s3cret"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+	s := routes["dl.foo.com"].signedURL
+
+	sign := func(pathAndQuery string) string {
+		return pathAndQuery + "&sig=" + hex.EncodeToString(s.sign(pathAndQuery))
+	}
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	for _, tt := range []struct {
+		name string
+		url  string
+		want int
+	}{
+		{"valid", sign("/a.zip?exp=" + future), 200},
+		{"valid with other params", sign("/a.zip?v=2&exp=" + future + "&x=%20"), 200},
+		{"expired", sign("/a.zip?exp=" + past), 403},
+		{"tampered path", strings.Replace(sign("/a.zip?exp="+future), "/a.zip", "/b.zip", 1), 403},
+		{"tampered expiry", strings.Replace(sign("/a.zip?exp="+past), past, future, 1), 403},
+		{"tampered params", sign("/a.zip?v=2&exp="+future) + "&v=3", 403},
+		{"missing signature", "/a.zip?exp=" + future, 403},
+		{"missing expiry", sign("/a.zip?"), 403},
+		{"bad signature", "/a.zip?exp=" + future + "&sig=zz", 403},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "https://dl.foo.com"+tt.url, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s (%s): status code: want %d, got %d", tt.name, tt.url, tt.want, w.Code)
+		}
+	}
+
+	for _, c := range []*SignedURL{{}, {Secret: "x", SigParam: "t", ExpParam: "t"}} {
+		if _, err := newSignedURL(c); err == nil {
+			t.Errorf("%+v: want error", *c)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// sizeTracker estimates percentiles of request and response sizes, of
+// bodies or of headers, over a sliding window. Sizes are recorded plus one, so that
+// empty bodies fall in the first bucket of the histograms and are reported
+// as 0.
+type sizeTracker struct {
+	req, rsp histogram
+}
+
+func (t *sizeTracker) record(req, rsp int64) {
+	t.recordRequest(req)
+	t.recordResponse(rsp)
+}
+
+func (t *sizeTracker) recordRequest(n int64) {
+	t.req.record(float64(n + 1))
+}
+
+func (t *sizeTracker) recordResponse(n int64) {
+	t.rsp.record(float64(n + 1))
+}
+
+func logSizes(host string, t *sizeTracker, interval time.Duration, window int) {
+	logSizeStats("sizes", host, t, interval, window)
+}
+
+func logHeaderSizes(host string, t *sizeTracker, interval time.Duration, window int) {
+	logSizeStats("header sizes", host, t, interval, window)
+}
+
+// logSizeStats logs the percentiles of the sizes in t over the past window
+// intervals as what, and starts a new interval.
+func logSizeStats(what, host string, t *sizeTracker, interval time.Duration, window int) {
+	req, n := t.req.rotate(window, 0.5, 0.9, 0.99)
+	rsp, _ := t.rsp.rotate(window, 0.5, 0.9, 0.99)
+	d := interval * time.Duration(window)
+	if n == 0 {
+		log.Printf("%s for %s over %s: no requests", what, host, d)
+		return
+	}
+	b := func(v float64) int64 { return int64(v) - 1 }
+	log.Printf("%s for %s over %s: %d requests, request p50 %d, p90 %d, p99 %d, response p50 %d, p90 %d, p99 %d bytes",
+		what, host, d, n, b(req[0]), b(req[1]), b(req[2]), b(rsp[0]), b(rsp[1]), b(rsp[2]))
+}
+
+// headerSize returns the size of the header fields of h in HTTP/1.1, with
+// "Name: value\r\n" for each value.
+func headerSize(h http.Header) int64 {
+	var n int64
+	for k, vs := range h {
+		for _, v := range vs {
+			n += int64(len(k) + len(": ") + len(v) + len("\r\n"))
+		}
+	}
+	return n
+}
+
+// countingBody counts the bytes read from a request body. The transport
+// may read the body concurrently with the handler.
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
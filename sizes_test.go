@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSizeTracker(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, strings.Repeat("x", 1000))
+	}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, LogSizes: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "https://foo.com/", strings.NewReader(strings.Repeat("y", 100))))
+		if w.Code != 200 {
+			t.Fatalf("status code: want 200, got %d", w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+
+	tr := routes["foo.com"].sizes
+	req, n := tr.req.rotate(1, 0.5, 1)
+	rsp, _ := tr.rsp.rotate(1, 0.5)
+	if n != 11 {
+		t.Errorf("count: want 11, got %d", n)
+	}
+	// estimates are within the bucket growth of 5%.
+	within := func(name string, got float64, want int64) {
+		if got-1 < float64(want) || got-1 > float64(want+1)*histogramGrowth {
+			t.Errorf("%s: want within 5%% above %d, got %v", name, want, got-1)
+		}
+	}
+	within("request p50", req[0], 100)
+	within("request p100", req[1], 100)
+	within("response p50", rsp[0], 1000)
+
+	// an empty body is reported as 0.
+	buf := captureLog(t)
+	tr.record(0, 0)
+	logSizes("foo.com", tr, time.Minute, 1)
+	if want := "sizes for foo.com over 1m0s: 1 requests, request p50 0, p90 0, p99 0, response p50 0, p90 0, p99 0 bytes"; !strings.Contains(buf.String(), want) {
+		t.Errorf("want %q, got %q", want, buf.String())
+	}
+}
+
+func TestHeaderSizeTracker(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Big", strings.Repeat("x", 1000))
+	}))
+	defer backend.Close()
+
+	routes, err := newRoutes(map[string]Upstream{"foo.com": {URL: backend.URL, LogHeaderSizes: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpsHandler(newRouteTable(routes), options{})
+	r := httptest.NewRequest("GET", "https://foo.com/", nil)
+	r.Header.Set("Cookie", strings.Repeat("y", 100))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("status code: want 200, got %d", w.Code)
+	}
+
+	tr := routes["foo.com"].headerSizes
+	req, n := tr.req.rotate(1, 0.5)
+	rsp, _ := tr.rsp.rotate(1, 0.5)
+	if n != 1 {
+		t.Errorf("count: want 1, got %d", n)
+	}
+	if want := headerSize(r.Header); req[0]-1 < float64(want) || req[0]-1 > float64(want+1)*histogramGrowth {
+		t.Errorf("request p50: want within 5%% above %d, got %v", want, req[0]-1)
+	}
+	if rsp[0]-1 < 1000 || rsp[0]-1 > 1200 {
+		t.Errorf("response p50: want about 1000, got %v", rsp[0]-1)
+	}
+
+	buf := captureLog(t)
+	logHeaderSizes("foo.com", tr, time.Minute, 1)
+	if want := "header sizes for foo.com over 1m0s: no requests"; !strings.Contains(buf.String(), want) {
+		t.Errorf("want %q, got %q", want, buf.String())
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	h := http.Header{"A": {"b", "cd"}}
+	if got, want := headerSize(h), int64(len("A: b\r\nA: cd\r\n")); got != want {
+		t.Errorf("want %d, got %d", want, got)
+	}
+}
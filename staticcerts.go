@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// CertPair is a certificate file and the matching private key file.
+type CertPair struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+// certPairs returns the certificate and key files of c, that of CertFile
+// and KeyFile first.
+func certPairs(c Certs) []CertPair {
+	var pairs []CertPair
+	if c.CertFile != "" || c.KeyFile != "" {
+		pairs = append(pairs, CertPair{CertFile: c.CertFile, KeyFile: c.KeyFile})
+	}
+	return append(pairs, c.Pairs...)
+}
+
+// loadCertificates loads the certificates of c when Auto is false. The TLS
+// handshake selects the certificate for the server name the client asks
+// for, or the first certificate if none matches.
+func loadCertificates(c Certs) ([]tls.Certificate, error) {
+	var certs []tls.Certificate
+	for _, p := range certPairs(c) {
+		if p.CertFile == "" || p.KeyFile == "" {
+			return nil, errors.New("require both certFile and keyFile in certs")
+		}
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load certificate %s and key %s: %s", p.CertFile, p.KeyFile, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadCertificates(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	// the files hold both the key and the certificate.
+	writeCachedCert(t, dir, "a.pem", "a.com", now)
+	writeCachedCert(t, dir, "b.pem", "b.com", now)
+	a := filepath.Join(dir, "a.pem")
+	b := filepath.Join(dir, "b.pem")
+
+	c := Conf{Certs: Certs{CertFile: a, KeyFile: a, Pairs: []CertPair{{CertFile: b, KeyFile: b}}}}
+	if err := checkConf(c); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := loadCertificates(c.Certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		serverName, want string
+	}{
+		{"a.com", "a.com"},
+		{"b.com", "b.com"},
+		{"c.com", "a.com"},
+	} {
+		client, server := net.Pipe()
+		go tls.Server(server, &tls.Config{Certificates: certs}).Handshake()
+		tc := tls.Client(client, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+		if err := tc.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if got := tc.ConnectionState().PeerCertificates[0].DNSNames[0]; got != tt.want {
+			t.Errorf("%s: want certificate for %s, got %s", tt.serverName, tt.want, got)
+		}
+		client.Close()
+		server.Close()
+	}
+
+	// pairs alone are enough.
+	if err := checkConf(Conf{Certs: Certs{Pairs: []CertPair{{CertFile: b, KeyFile: b}}}}); err != nil {
+		t.Errorf("pairs only: want ok, got %s", err)
+	}
+
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		certs Certs
+		want  string
+	}{
+		{Certs{CertFile: a, KeyFile: a, Pairs: []CertPair{{CertFile: b}}}, "require both"},
+		{Certs{CertFile: a, KeyFile: a, Pairs: []CertPair{{CertFile: notPEM, KeyFile: b}}}, notPEM},
+		{Certs{CertFile: a, KeyFile: a, Pairs: []CertPair{{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: b}}}, "missing.pem"},
+		{Certs{CertFile: a, KeyFile: b}, "private key does not match"},
+		{Certs{Auto: true, CertDir: dir, Pairs: []CertPair{{CertFile: b, KeyFile: b}}}, "certs.pairs"},
+	} {
+		err := checkConf(Conf{Certs: tt.certs})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: want error containing %q, got %v", tt.certs, tt.want, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+func checkSyslog(c Syslog) error {
+	if _, ok := syslogFacilities[c.Facility]; !ok && c.Facility != "" {
+		return fmt.Errorf("unknown log.syslog.facility %q", c.Facility)
+	}
+	switch c.Network {
+	case "", "udp", "tcp", "unix", "unixgram":
+	default:
+		return fmt.Errorf("unknown log.syslog.network %q", c.Network)
+	}
+	if c.Network != "" && c.Address == "" {
+		return fmt.Errorf("require log.syslog.address when log.syslog.network is set")
+	}
+	return nil
+}
+
+// openSyslog connects to the syslog server configured by c. Messages are
+// logged with the info severity.
+func openSyslog(c Syslog) (io.Writer, error) {
+	facility := syslog.LOG_DAEMON
+	if c.Facility != "" {
+		facility = syslogFacilities[c.Facility]
+	}
+	tag := c.Tag
+	if tag == "" {
+		tag = "httpserver"
+	}
+	return syslog.Dial(c.Network, c.Address, facility|syslog.LOG_INFO, tag)
+}
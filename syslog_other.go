@@ -0,0 +1,17 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+func checkSyslog(c Syslog) error {
+	return fmt.Errorf("log.syslog is not supported on %s", runtime.GOOS)
+}
+
+func openSyslog(c Syslog) (io.Writer, error) {
+	return nil, fmt.Errorf("syslog is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,55 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslog(t *testing.T) {
+	// a fake syslog server.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	c := Syslog{Network: "udp", Address: pc.LocalAddr().String(), Facility: "local3", Tag: "edge"}
+	if err := checkSyslog(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	w, err := openSyslog(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.New(w, "", 0).Printf("reloaded proxy config")
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	// local3 is facility 19, and info is severity 6: 19*8 + 6 = 158.
+	if !strings.HasPrefix(msg, "<158>") {
+		t.Errorf("want priority <158>, got %q", msg)
+	}
+	if !strings.Contains(msg, " edge[") || !strings.Contains(msg, "reloaded proxy config") {
+		t.Errorf("want tag and message, got %q", msg)
+	}
+
+	for _, c := range []Syslog{
+		{Facility: "local9"},
+		{Network: "udp"},
+		{Network: "http", Address: "localhost:514"},
+	} {
+		if err := checkSyslog(c); err == nil {
+			t.Errorf("%+v: want error, got nil", c)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// handshakeLogger is the error log of the HTTPS server. It adds the server
+// name requested by the client to the log lines for TLS handshake errors,
+// or drops those lines if off is true.
+type handshakeLogger struct {
+	off         bool
+	serverNames sync.Map // client address -> server name
+}
+
+// install sets up s to log through h. It must be called before s starts.
+func (h *handshakeLogger) install(s *http.Server) {
+	if s.TLSConfig == nil {
+		s.TLSConfig = &tls.Config{}
+	}
+	getConfigForClient := s.TLSConfig.GetConfigForClient
+	s.TLSConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		h.serverNames.Store(hello.Conn.RemoteAddr().String(), hello.ServerName)
+		if getConfigForClient != nil {
+			return getConfigForClient(hello)
+		}
+		return nil, nil
+	}
+
+	connState := s.ConnState
+	s.ConnState = func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateActive, http.StateHijacked, http.StateClosed:
+			// past the handshake.
+			h.serverNames.Delete(c.RemoteAddr().String())
+		}
+		if connState != nil {
+			connState(c, state)
+		}
+	}
+
+	s.ErrorLog = log.New(h, "", 0)
+}
+
+const handshakeErrorPrefix = "http: TLS handshake error from "
+
+func (h *handshakeLogger) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	if !strings.HasPrefix(msg, handshakeErrorPrefix) {
+		log.Print(msg)
+		return len(p), nil
+	}
+
+	addr, reason, _ := strings.Cut(strings.TrimPrefix(msg, handshakeErrorPrefix), ": ")
+	serverName, _ := h.serverNames.LoadAndDelete(addr)
+	if h.off {
+		return len(p), nil
+	}
+	if serverName == nil {
+		serverName = "" // handshake failed before the client hello was read
+	}
+	log.Printf("tls handshake error: client %s, server name %q: %s", addr, serverName, reason)
+	return len(p), nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog redirects the standard logger to the returned buffer for the
+// duration of the test.
+func captureLog(t *testing.T) *syncBuffer {
+	var buf syncBuffer
+	orig := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(orig) })
+	return &buf
+}
+
+func TestHandshakeLogger(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join("testdata", "cert.pem"), filepath.Join("testdata", "key.pem"))
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err)
+	}
+
+	// serve starts a HTTPS server using h and returns its address.
+	serve := func(h *handshakeLogger) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &http.Server{
+			Handler:   http.NotFoundHandler(),
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		}
+		h.install(s)
+		go s.ServeTLS(l, "", "")
+		t.Cleanup(func() { s.Close() })
+		return l.Addr().String()
+	}
+
+	// failHandshake makes a TLS connection that fails because the client
+	// doesn't trust the server's self-signed certificate.
+	failHandshake := func(addr string) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "foo.com"})
+		if err == nil {
+			conn.Close()
+			t.Fatalf("want handshake error, got nil")
+		}
+	}
+
+	t.Run("log", func(t *testing.T) {
+		buf := captureLog(t)
+		failHandshake(serve(&handshakeLogger{}))
+
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(buf.String(), "tls handshake error") {
+			if time.Now().After(deadline) {
+				t.Fatalf("handshake error not logged")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		got := buf.String()
+		if !strings.Contains(got, "client 127.0.0.1:") {
+			t.Errorf("want client address in log, got %q", got)
+		}
+		if !strings.Contains(got, `server name "foo.com"`) {
+			t.Errorf("want server name in log, got %q", got)
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		buf := captureLog(t)
+		failHandshake(serve(&handshakeLogger{off: true}))
+
+		time.Sleep(100 * time.Millisecond) // give the server time to log
+
+		if got := buf.String(); got != "" {
+			t.Errorf("want nothing logged, got %q", got)
+		}
+	})
+}
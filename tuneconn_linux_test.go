@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+)
+
+func TestTuneConn(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	sockopt := func(conn net.Conn, level, opt int) int {
+		rc, err := conn.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v int
+		var serr error
+		if err := rc.Control(func(fd uintptr) {
+			v, serr = syscall.GetsockoptInt(int(fd), level, opt)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if serr != nil {
+			t.Fatal(serr)
+		}
+		return v
+	}
+
+	noDelay := false
+	dial := newDialer(Upstream{TCPNoDelay: &noDelay, TCPReadBuffer: 64 << 10, TCPWriteBuffer: 32 << 10})
+	conn, err := dial(context.Background(), "tcp", backend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if v := sockopt(conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != 0 {
+		t.Errorf("TCP_NODELAY: want 0, got %d", v)
+	}
+	// Linux doubles the requested buffer sizes.
+	if v := sockopt(conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF); v < 64<<10 {
+		t.Errorf("SO_RCVBUF: want at least %d, got %d", 64<<10, v)
+	}
+	if v := sockopt(conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF); v < 32<<10 {
+		t.Errorf("SO_SNDBUF: want at least %d, got %d", 32<<10, v)
+	}
+
+	// without TCPNoDelay, Go's default is kept.
+	conn2, err := newDialer(Upstream{})(context.Background(), "tcp", backend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	if v := sockopt(conn2, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v == 0 {
+		t.Errorf("TCP_NODELAY: want default of enabled, got %d", v)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// upstreamTLSConfig returns the TLS config for connections to the
+// destination server of the upstream, or nil for the default config.
+func upstreamTLSConfig(u Upstream) (*tls.Config, error) {
+	if (u.UpstreamClientCert == "") != (u.UpstreamClientKey == "") {
+		return nil, errors.New("require both upstreamClientCert and upstreamClientKey")
+	}
+	if u.UpstreamClientCert == "" && u.UpstreamCA == "" {
+		return nil, nil
+	}
+
+	c := &tls.Config{}
+	if u.UpstreamClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(u.UpstreamClientCert, u.UpstreamClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load upstream client certificate: %s", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	if u.UpstreamCA != "" {
+		b, err := os.ReadFile(u.UpstreamCA)
+		if err != nil {
+			return nil, fmt.Errorf("read upstreamCA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates in upstreamCA %s", u.UpstreamCA)
+		}
+		c.RootCAs = pool
+	}
+	return c, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpstreamClientCert(t *testing.T) {
+	clientCert := filepath.Join("testdata", "cert.pem")
+	clientKey := filepath.Join("testdata", "key.pem")
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].DNSNames[0]))
+	}))
+	// the test certificate isn't valid for client authentication, so
+	// only require that one is presented.
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+
+	// trust the backend's certificate.
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(u Upstream) *httptest.ResponseRecorder {
+		routes, err := newRoutes(map[string]Upstream{"foo.com": u})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		httpsHandler(newRouteTable(routes), options{}).ServeHTTP(w, httptest.NewRequest("GET", "https://foo.com/", nil))
+		return w
+	}
+
+	for _, http10 := range []bool{false, true} {
+		w := serve(Upstream{URL: backend.URL, UpstreamCA: ca, UpstreamClientCert: clientCert, UpstreamClientKey: clientKey, HTTP10: http10})
+		if w.Code != 200 {
+			t.Errorf("http10 %t: status code: want 200, got %d", http10, w.Code)
+		}
+		if got := w.Body.String(); got != "littleroot.org" {
+			t.Errorf("http10 %t: client certificate: want %q, got %q", http10, "littleroot.org", got)
+		}
+	}
+
+	// without a client certificate the handshake fails.
+	if w := serve(Upstream{URL: backend.URL, UpstreamCA: ca}); w.Code != 502 {
+		t.Errorf("without client certificate: status code: want 502, got %d", w.Code)
+	}
+
+	for _, u := range []Upstream{
+		{URL: backend.URL, UpstreamClientCert: clientCert},
+		{URL: backend.URL, UpstreamClientCert: clientCert, UpstreamClientKey: ca},
+		{URL: backend.URL, UpstreamCA: clientKey},
+	} {
+		if _, err := newRoutes(map[string]Upstream{"foo.com": u}); err == nil {
+			t.Errorf("%+v: want error, got nil", u)
+		}
+	}
+}